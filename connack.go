@@ -15,6 +15,7 @@
 package mqtt
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -29,12 +30,27 @@ import (
 type ConnackMessage struct {
 	fixedHeader
 
+	version        byte
 	sessionPresent bool
 	returnCode     ConnackCode
+
+	// Only encoded and decoded when version is 5
+	properties Properties
 }
 
 var _ Message = (*ConnackMessage)(nil)
 
+// ConnackError is returned by ConnackMessage.AsError for a version 5 reason code that
+// has no equivalent ConnackCode, such as ReasonBanned.
+type ConnackError struct {
+	Reason ReasonCode
+}
+
+// Error returns the description of the reason code.
+func (this *ConnackError) Error() string {
+	return "Connection Refused, " + this.Reason.String()
+}
+
 // NewConnackMessage creates a new CONNACK message
 func NewConnackMessage() *ConnackMessage {
 	msg := &ConnackMessage{}
@@ -49,6 +65,133 @@ func (this ConnackMessage) String() string {
 		this.fixedHeader, this.sessionPresent, this.returnCode)
 }
 
+// Version returns the protocol version of the connection this message is sent over.
+// The CONNACK packet does not carry the version itself, but for version 5 (MQTT 5.0)
+// the variable header includes a properties section.
+func (this *ConnackMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *ConnackMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("connack/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// Properties returns the properties of the message. Properties are only encoded
+// and decoded when the message version is 5.
+func (this *ConnackMessage) Properties() *Properties {
+	return &this.properties
+}
+
+// ReceiveMaximum returns the number of QoS 1 and QoS 2 publications the Server is
+// willing to process concurrently. If the property is not present, the default of
+// 65535 is returned.
+func (this *ConnackMessage) ReceiveMaximum() uint16 {
+	if v, ok := this.properties.Uint(PropReceiveMaximum); ok {
+		return uint16(v)
+	}
+
+	return 65535
+}
+
+// SetReceiveMaximum sets the number of QoS 1 and QoS 2 publications the Server is
+// willing to process concurrently. An error is returned if the value is 0.
+func (this *ConnackMessage) SetReceiveMaximum(v uint16) error {
+	return this.properties.SetUint(PropReceiveMaximum, uint32(v))
+}
+
+// MaximumPacketSize returns the maximum packet size in bytes the Server is willing
+// to accept. The Client must not send packets larger than this to the Server. The
+// second return value is false if the property is not present, in which case there
+// is no limit beyond the limit imposed by the protocol.
+func (this *ConnackMessage) MaximumPacketSize() (uint32, bool) {
+	return this.properties.Uint(PropMaximumPacketSize)
+}
+
+// SetMaximumPacketSize sets the maximum packet size in bytes the Server is willing
+// to accept. An error is returned if the value is 0.
+func (this *ConnackMessage) SetMaximumPacketSize(v uint32) error {
+	return this.properties.SetUint(PropMaximumPacketSize, v)
+}
+
+// AssignedClientIdentifier returns the ClientId assigned by the Server when the
+// Client connected with a zero-byte ClientId. The second return value is false if the
+// property is not present.
+func (this *ConnackMessage) AssignedClientIdentifier() ([]byte, bool) {
+	return this.properties.Bytes(PropAssignedClientIdentifier)
+}
+
+// SetAssignedClientIdentifier sets the ClientId assigned by the Server, see
+// ConnectMessage.IsClientIdAssigned.
+func (this *ConnackMessage) SetAssignedClientIdentifier(v []byte) error {
+	return this.properties.SetBytes(PropAssignedClientIdentifier, v)
+}
+
+// ServerKeepAlive returns the keep alive time in seconds assigned by the Server,
+// which the Client must use instead of the keep alive it sent in the CONNECT. The
+// second return value is false if the property is not present, in which case the
+// Client's keep alive is used.
+func (this *ConnackMessage) ServerKeepAlive() (uint16, bool) {
+	v, ok := this.properties.Uint(PropServerKeepAlive)
+	return uint16(v), ok
+}
+
+// SetServerKeepAlive sets the keep alive time in seconds assigned by the Server.
+func (this *ConnackMessage) SetServerKeepAlive(v uint16) {
+	// Never fails, as any 16-bit value is valid
+	this.properties.SetUint(PropServerKeepAlive, uint32(v))
+}
+
+// NegotiateKeepAlive returns the keep alive the Client must use, given the keep
+// alive requested in the CONNECT and the maximum allowed by the Server. If the
+// requested keep alive is 0, which turns the mechanism off, or larger than max, then
+// max is used instead, and set as the Server Keep Alive so the Client is told about
+// it. A max of 0 means there's no limit, in which case the requested keep alive is
+// returned unchanged. The property is only encoded when the version is 5, as there's
+// no way to tell earlier versions about it.
+func (this *ConnackMessage) NegotiateKeepAlive(requested, max uint16) uint16 {
+	if max == 0 || (requested > 0 && requested <= max) {
+		return requested
+	}
+
+	this.SetServerKeepAlive(max)
+
+	return max
+}
+
+// ServerReference returns the Server Reference, which identifies another Server the
+// Client can use, e.g., with the return code ReasonUseAnotherServer or
+// ReasonServerMoved. The second return value is false if the property is not
+// present.
+func (this *ConnackMessage) ServerReference() ([]byte, bool) {
+	return this.properties.Bytes(PropServerReference)
+}
+
+// SetServerReference sets the Server Reference. An error is returned if v is not
+// valid UTF-8.
+func (this *ConnackMessage) SetServerReference(v []byte) error {
+	return this.properties.SetBytes(PropServerReference, v)
+}
+
+// ReasonString returns the Reason String, a human readable string describing why
+// the connection was refused, which is designed for diagnostics. The second return
+// value is false if the property is not present.
+func (this *ConnackMessage) ReasonString() ([]byte, bool) {
+	return this.properties.Bytes(PropReasonString)
+}
+
+// SetReasonString sets the Reason String. An error is returned if v is not valid
+// UTF-8.
+func (this *ConnackMessage) SetReasonString(v []byte) error {
+	return this.properties.SetBytes(PropReasonString, v)
+}
+
 // SessionPresent returns the session present flag value
 func (this *ConnackMessage) SessionPresent() bool {
 	return this.sessionPresent
@@ -73,17 +216,39 @@ func (this *ConnackMessage) SetReturnCode(ret ConnackCode) {
 	this.returnCode = ret
 }
 
+// AsError returns nil if the connection is accepted, and otherwise the error for the
+// return code, which is one of the errors returned by ConnackCode.Error. For version
+// 5, reason codes with an equivalent ConnackCode return the same errors, and the
+// others return a *ConnackError.
+func (this *ConnackMessage) AsError() error {
+	if this.returnCode == ConnectionAccepted {
+		return nil
+	}
+
+	code := this.returnCode
+
+	if this.version == 0x5 {
+		var ok bool
+		if code, ok = ReasonCode(this.returnCode).ToConnackCode(); !ok {
+			return &ConnackError{Reason: ReasonCode(this.returnCode)}
+		}
+	}
+
+	if err := code.Error(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("connack/AsError: Invalid CONNACK return code (%d)", this.returnCode)
+}
+
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *ConnackMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
 
 	var b byte
 
@@ -91,10 +256,9 @@ func (this *ConnackMessage) Decode(src io.Reader) (int, error) {
 	if b, err = this.buf.ReadByte(); err != nil {
 		return total, err
 	}
-	total += 1
 
 	if b&254 != 0 {
-		return 0, fmt.Errorf("connack/Decode: Bits 7-1 in Connack Acknowledge Flags byte (1) are not 0")
+		return total, fmt.Errorf("connack/Decode: Bits 7-1 in Connack Acknowledge Flags byte (1) are not 0")
 	}
 
 	this.sessionPresent = b&0x1 == 1
@@ -103,14 +267,25 @@ func (this *ConnackMessage) Decode(src io.Reader) (int, error) {
 	if b, err = this.buf.ReadByte(); err != nil {
 		return total, err
 	}
-	total += 1
 
-	if b > 5 {
-		return 0, fmt.Errorf("connack/Decode: Invalid CONNACK return code (%d)", b)
+	if !this.validReturnCode(ConnackCode(b)) {
+		return total, fmt.Errorf("connack/Decode: Invalid CONNACK return code (%d)", b)
 	}
 
 	this.returnCode = ConnackCode(b)
 
+	// If a Server sends a CONNACK packet containing a non-zero return code it MUST set
+	// Session Present to 0 [MQTT-3.2.2-4]. For version 5, 0 is the Success reason code.
+	if this.sessionPresent && this.returnCode != ConnectionAccepted {
+		return total, protocolError("connack/Decode", "Session Present must be 0 with a non-zero return code (%d)", b)
+	}
+
+	if this.version == 0x5 {
+		if _, err = this.properties.decode(this.buf, connackPropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
+	}
+
 	return total, nil
 }
 
@@ -120,12 +295,43 @@ func (this *ConnackMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *ConnackMessage) Encode() (io.Reader, int, error) {
-	// CONNACK remaining length fixed at 2 bytes
-	this.SetRemainingLength(2)
+	buf := this.encodeBuf()
 
-	_, total, err := this.fixedHeader.Encode()
+	n, err := this.encode(buf)
 	if err != nil {
-		return nil, 0, err
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *ConnackMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *ConnackMessage) encode(buf *bytes.Buffer) (int, error) {
+	// CONNACK remaining length fixed at 2 bytes, plus the properties for version 5
+	if this.version == 0x5 {
+		if err := this.setEncodedLength(2 + int64(this.properties.size())); err != nil {
+			return 0, err
+		}
+	} else {
+		this.SetRemainingLength(2)
+	}
+
+	total, err := this.fixedHeader.encode(buf)
+	if err != nil {
+		return 0, err
 	}
 
 	var b [2]byte
@@ -133,17 +339,39 @@ func (this *ConnackMessage) Encode() (io.Reader, int, error) {
 		b[0] = 1
 	}
 
-	if this.returnCode > 5 {
-		return nil, 0, fmt.Errorf("connack/Encode: Invalid CONNACK return code (%d)", this.returnCode)
+	if !this.validReturnCode(this.returnCode) {
+		return 0, fmt.Errorf("connack/Encode: Invalid CONNACK return code (%d)", this.returnCode)
+	}
+
+	if this.sessionPresent && this.returnCode != ConnectionAccepted {
+		return 0, fmt.Errorf("connack/Encode: Protocol violation: Session Present must be 0 with a non-zero return code (%d)", this.returnCode)
 	}
 
 	b[1] = this.returnCode.Value()
 
-	n, err := this.buf.Write(b[:])
+	n, err := buf.Write(b[:])
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
 	total += n
 
-	return this.buf, total, nil
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, connackPropertySet); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// validReturnCode checks the return code against the version of the message. For
+// version 5 the return code is a reason code, where 0 is success and values of 0x80
+// or greater indicate failure.
+func (this *ConnackMessage) validReturnCode(code ConnackCode) bool {
+	if this.version == 0x5 {
+		return code == 0 || code >= 0x80
+	}
+
+	return code.Valid()
 }
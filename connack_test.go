@@ -137,3 +137,244 @@ func TestConnackMessageEncode(t *testing.T) {
 
 	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding connack message.")
 }
+
+// test version 5 with maximum packet size
+func TestConnackMessageMaximumPacketSize(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNACK << 4),
+		8,
+		0,          // session not present
+		0,          // connection accepted
+		5,          // properties length (5)
+		0x27,       // maximum packet size
+		0, 0, 4, 0, // 1024 bytes
+	}
+
+	msg := NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, ok := msg.MaximumPacketSize()
+	assert.False(t, true, ok, "Maximum packet size should not be present.")
+
+	err := msg.SetMaximumPacketSize(0)
+	assert.Error(t, true, err)
+
+	err = msg.SetMaximumPacketSize(1024)
+	assert.NoError(t, true, err, "Error setting maximum packet size.")
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding message.")
+
+	msg2 := NewConnackMessage()
+	msg2.SetVersion(0x5)
+
+	_, err = msg2.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	v, ok := msg2.MaximumPacketSize()
+	assert.True(t, true, ok, "Maximum packet size should be present.")
+
+	assert.Equal(t, true, 1024, v, "Incorrect maximum packet size.")
+}
+
+func TestConnackMessageReceiveMaximum(t *testing.T) {
+	msg := NewConnackMessage()
+
+	assert.Equal(t, true, 65535, msg.ReceiveMaximum(), "Incorrect default receive maximum.")
+
+	err := msg.SetReceiveMaximum(0)
+	assert.Error(t, true, err)
+
+	err = msg.SetReceiveMaximum(20)
+	assert.NoError(t, true, err, "Error setting receive maximum.")
+
+	assert.Equal(t, true, 20, msg.ReceiveMaximum(), "Incorrect receive maximum.")
+}
+
+func TestConnackMessageAssignedClientIdentifier(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNACK << 4),
+		9,
+		0,    // session present
+		0,    // return code
+		6,    // properties length
+		0x12, // assigned client identifier
+		0, 3, // string length (3)
+		'c', 'i', 'd',
+	}
+
+	msg := NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, ok := msg.AssignedClientIdentifier()
+	assert.False(t, true, ok, "Unexpected assigned client identifier.")
+
+	err := msg.SetAssignedClientIdentifier([]byte("cid"))
+	assert.NoError(t, true, err, "Error setting assigned client identifier.")
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded bytes.")
+
+	msg = NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	v, ok := msg.AssignedClientIdentifier()
+	assert.True(t, true, ok, "Expecting assigned client identifier.")
+
+	assert.Equal(t, true, "cid", string(v), "Incorrect assigned client identifier.")
+}
+
+// test session present with a non-zero return code
+func TestConnackMessageSessionPresentRefused(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNACK << 4),
+		2,
+		1, // session present
+		5, // not authorized
+	}
+
+	_, err := NewConnackMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg := NewConnackMessage()
+	msg.SetSessionPresent(true)
+	msg.SetReturnCode(NotAuthorized)
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	// version 5 reason code
+	msgBytes = []byte{
+		byte(CONNACK << 4),
+		3,
+		1,    // session present
+		0x87, // not authorized
+		0,    // properties length (0)
+	}
+
+	msg = NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg.SetSessionPresent(true)
+	msg.SetReturnCode(ConnackCode(ReasonNotAuthorized))
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	msg.SetSessionPresent(false)
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+func TestConnackMessageAsError(t *testing.T) {
+	tests := []struct {
+		code ConnackCode
+		err  error
+	}{
+		{ConnectionAccepted, nil},
+		{UnacceptableProtocolVersion, ErrUnacceptableProtocolVersion},
+		{IdentifierRejected, ErrIdentifierRejected},
+		{ServerUnavailable, ErrServerUnavailable},
+		{BadUsernameOrPassword, ErrBadUsernameOrPassword},
+		{NotAuthorized, ErrNotAuthorized},
+	}
+
+	for _, test := range tests {
+		msg := NewConnackMessage()
+		msg.SetReturnCode(test.code)
+
+		assert.Equal(t, true, test.err, msg.AsError(), "Incorrect error.")
+
+		// the same error for the equivalent version 5 reason code
+		msg = NewConnackMessage()
+		msg.SetVersion(0x5)
+		msg.SetReturnCode(ConnackCode(test.code.ToReasonCode()))
+
+		assert.Equal(t, true, test.err, msg.AsError(), "Incorrect version 5 error.")
+	}
+
+	msg := NewConnackMessage()
+	msg.SetVersion(0x5)
+	msg.SetReturnCode(ConnackCode(ReasonBanned))
+
+	err, ok := msg.AsError().(*ConnackError)
+	assert.True(t, true, ok, "Expecting ConnackError.")
+
+	assert.Equal(t, true, ReasonBanned, err.Reason, "Incorrect reason code.")
+
+	msg = NewConnackMessage()
+	msg.SetReturnCode(6)
+
+	assert.Error(t, true, msg.AsError())
+}
+
+func TestConnackMessageNegotiateKeepAlive(t *testing.T) {
+	msg := NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, ok := msg.ServerKeepAlive()
+	assert.False(t, true, ok, "Unexpected server keep alive.")
+
+	// below the max
+	assert.Equal(t, true, uint16(30), msg.NegotiateKeepAlive(30, 60), "Incorrect keep alive.")
+
+	_, ok = msg.ServerKeepAlive()
+	assert.False(t, true, ok, "Unexpected server keep alive.")
+
+	// equal to the max
+	assert.Equal(t, true, uint16(60), msg.NegotiateKeepAlive(60, 60), "Incorrect keep alive.")
+
+	_, ok = msg.ServerKeepAlive()
+	assert.False(t, true, ok, "Unexpected server keep alive.")
+
+	// no max
+	assert.Equal(t, true, uint16(0), msg.NegotiateKeepAlive(0, 0), "Incorrect keep alive.")
+
+	_, ok = msg.ServerKeepAlive()
+	assert.False(t, true, ok, "Unexpected server keep alive.")
+
+	// keep alive turned off
+	assert.Equal(t, true, uint16(60), msg.NegotiateKeepAlive(0, 60), "Incorrect keep alive.")
+
+	v, ok := msg.ServerKeepAlive()
+	assert.True(t, true, ok, "Expecting server keep alive.")
+	assert.Equal(t, true, uint16(60), v, "Incorrect server keep alive.")
+
+	// above the max
+	msg = NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	assert.Equal(t, true, uint16(60), msg.NegotiateKeepAlive(300, 60), "Incorrect keep alive.")
+
+	v, ok = msg.ServerKeepAlive()
+	assert.True(t, true, ok, "Expecting server keep alive.")
+	assert.Equal(t, true, uint16(60), v, "Incorrect server keep alive.")
+
+	msgBytes := []byte{
+		byte(CONNACK << 4),
+		6,
+		0,     // session present
+		0,     // return code
+		3,     // properties length
+		0x13,  // server keep alive
+		0, 60, // keep alive (60)
+	}
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded bytes.")
+}
@@ -44,6 +44,16 @@ var (
 	// Error represention of ConnectionAccepted
 	ErrUnacceptableProtocolVersion = errors.New("Connection Refused, unacceptable protocol version")
 
+	// Error returned when the protocol version is known, but not supported. The
+	// Server should respond with UnacceptableProtocolVersion, or
+	// ReasonUnsupportedProtocolVersion for version 5.
+	ErrUnsupportedProtocolVersion = errors.New("Connection Refused, protocol version not supported")
+
+	// Error returned when the protocol version is supported, but the protocol name
+	// doesn't match it, e.g., "MQTT" with version 0x3, or "MQIsdp" with version 0x4.
+	// The Server should respond with UnacceptableProtocolVersion.
+	ErrProtocolNameMismatch = errors.New("Connection Refused, protocol name does not match protocol version")
+
 	// Error represention of IdentifierRejected
 	ErrIdentifierRejected = errors.New("Connection Refused, identifier rejected")
 
@@ -107,6 +117,17 @@ func (this ConnackCode) Valid() bool {
 	return this <= 5
 }
 
+// ToReasonCode returns the version 5 reason code equivalent to the ConnackCode, e.g.,
+// to forward the CONNACK of a version 4 Server to a version 5 Client. Invalid codes
+// map to ReasonUnspecifiedError.
+func (this ConnackCode) ToReasonCode() ReasonCode {
+	if reason, ok := connackReasonCodes[this]; ok {
+		return reason
+	}
+
+	return ReasonUnspecifiedError
+}
+
 // Error returns the corresonding error for the ConnackCode
 func (this ConnackCode) Error() error {
 	switch this {
@@ -15,10 +15,50 @@
 package mqtt
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 )
 
+var (
+	// ErrMissingWill is returned when decoding a CONNECT message that has the Will Flag
+	// set, but is missing the Will Topic or Will Message.
+	ErrMissingWill = errors.New("Will flag is set, but the will topic or will message is missing")
+
+	// ErrInvalidUsername is returned when decoding a CONNECT message whose User Name is
+	// not well-formed UTF-8, or contains the null character U+0000.
+	ErrInvalidUsername = errors.New("User name is not valid UTF-8")
+)
+
+// ServerConstraints is the configuration a Server checks each CONNECT message against
+// before accepting the connection, see ConnectMessage.CheckAgainst. Anonymous Clients
+// are only accepted if AllowAnonymous is set, so the zero value accepts every CONNECT
+// message with a user name.
+type ServerConstraints struct {
+	// MaxKeepAlive is the maximum keep alive in seconds. A version 3.1 or 3.1.1 Client
+	// asking for a longer keep alive, or for none (0), is rejected with NotAuthorized,
+	// as there's no other way to tell it which keep alive to use. There's no return
+	// code for it, and NotAuthorized, i.e., refused by the Server's policy, is the
+	// closest one that doesn't point at the ClientId or the Server being down. A
+	// version 5 Client isn't rejected, the Server tells it the keep alive to use
+	// instead, see ConnackMessage.NegotiateKeepAlive. 0 means there's no limit.
+	MaxKeepAlive uint16
+
+	// RequireAuth requires both a user name and a password, and rejects the connection
+	// with BadUsernameOrPassword if either is missing.
+	RequireAuth bool
+
+	// AllowAnonymous allows Clients to connect without a user name. Otherwise the
+	// connection is rejected with NotAuthorized.
+	AllowAnonymous bool
+
+	// MaxClientIdLen is the maximum length of the ClientId in bytes. A longer ClientId
+	// is rejected with IdentifierRejected. 0 means there's no limit beyond the limit of
+	// the protocol version.
+	MaxClientIdLen int
+}
+
 // After a Network Connection is established by a Client to a Server, the first Packet
 // sent from the Client to the Server MUST be a CONNECT Packet [MQTT-3.1.0-1].
 //
@@ -48,6 +88,17 @@ type ConnectMessage struct {
 	willMessage,
 	username,
 	password []byte
+
+	// Only encoded and decoded when version is 5
+	properties,
+	willProperties Properties
+
+	lenient           bool
+	lenientWillRetain bool
+	acceptedVersions  []byte
+
+	// Spec violations normalized by Decode, see Warnings
+	warnings []string
 }
 
 var _ Message = (*ConnectMessage)(nil)
@@ -60,8 +111,26 @@ func NewConnectMessage() *ConnectMessage {
 	return msg
 }
 
-// String returns a string representation of the CONNECT message
+// String returns a string representation of the CONNECT message. The password is
+// redacted, printed as "****" if it's set, so the message can be logged safely. Use
+// StringUnsafe to include the password.
 func (this ConnectMessage) String() string {
+	var password string
+
+	if this.PasswordFlag() {
+		password = "****"
+	}
+
+	return this.string(password)
+}
+
+// StringUnsafe returns a string representation of the CONNECT message like String,
+// except that the password is printed as is. It MUST NOT be used for logging.
+func (this ConnectMessage) StringUnsafe() string {
+	return this.string(string(this.Password()))
+}
+
+func (this ConnectMessage) string(password string) string {
 	return fmt.Sprintf("%v\nConnect Flags: %08b\nVersion: %d\nKeepAlive: %d\nClient ID: %s\nWill Topic: %s\nWill Message: %s\nUsername: %s\nPassword: %s\n",
 		this.fixedHeader,
 		this.connectFlags,
@@ -71,7 +140,7 @@ func (this ConnectMessage) String() string {
 		this.WillTopic(),
 		this.WillMessage(),
 		this.Username(),
-		this.Password(),
+		password,
 	)
 }
 
@@ -92,6 +161,50 @@ func (this *ConnectMessage) SetVersion(v byte) error {
 	return nil
 }
 
+// Properties returns the properties of the message. Properties are only encoded
+// and decoded when the message version is 5.
+func (this *ConnectMessage) Properties() *Properties {
+	return &this.properties
+}
+
+// WillProperties returns the properties to be sent with the Will Message when it is
+// published. Will properties are only encoded and decoded when the message version
+// is 5 and the Will Flag is set.
+func (this *ConnectMessage) WillProperties() *Properties {
+	return &this.willProperties
+}
+
+// ReceiveMaximum returns the number of QoS 1 and QoS 2 publications the Client is
+// willing to process concurrently. If the property is not present, the default of
+// 65535 is returned.
+func (this *ConnectMessage) ReceiveMaximum() uint16 {
+	if v, ok := this.properties.Uint(PropReceiveMaximum); ok {
+		return uint16(v)
+	}
+
+	return 65535
+}
+
+// SetReceiveMaximum sets the number of QoS 1 and QoS 2 publications the Client is
+// willing to process concurrently. An error is returned if the value is 0.
+func (this *ConnectMessage) SetReceiveMaximum(v uint16) error {
+	return this.properties.SetUint(PropReceiveMaximum, uint32(v))
+}
+
+// MaximumPacketSize returns the maximum packet size in bytes the Client is willing
+// to accept. The Server must not send packets larger than this to the Client. The
+// second return value is false if the property is not present, in which case there
+// is no limit beyond the limit imposed by the protocol.
+func (this *ConnectMessage) MaximumPacketSize() (uint32, bool) {
+	return this.properties.Uint(PropMaximumPacketSize)
+}
+
+// SetMaximumPacketSize sets the maximum packet size in bytes the Client is willing
+// to accept. An error is returned if the value is 0.
+func (this *ConnectMessage) SetMaximumPacketSize(v uint32) error {
+	return this.properties.SetUint(PropMaximumPacketSize, v)
+}
+
 // CleanSession returns the bit that specifies the handling of the Session state.
 // The Client and Server can store Session state to enable reliable messaging to
 // continue across a sequence of Network Connections. This bit is used to control
@@ -109,6 +222,37 @@ func (this *ConnectMessage) SetCleanSession(v bool) {
 	}
 }
 
+// CleanStart returns the bit that specifies whether the Connection starts a new
+// Session or is a continuation of an existing Session. It is the MQTT 5.0 name for
+// the clean session bit. In MQTT 5.0, the lifetime of the Session after the Network
+// Connection is closed is controlled separately by the Session Expiry Interval, so
+// clean start with a session expiry interval of 0 behaves like clean session in
+// earlier versions.
+func (this *ConnectMessage) CleanStart() bool {
+	return this.CleanSession()
+}
+
+// SetCleanStart sets the bit that specifies whether the Connection starts a new
+// Session or is a continuation of an existing Session.
+func (this *ConnectMessage) SetCleanStart(v bool) {
+	this.SetCleanSession(v)
+}
+
+// SessionExpiryInterval returns the time in seconds the Session state is kept after
+// the Network Connection is closed. If the property is not present, 0 is returned,
+// meaning the Session ends when the Network Connection is closed. A value of
+// 0xFFFFFFFF means the Session does not expire.
+func (this *ConnectMessage) SessionExpiryInterval() uint32 {
+	v, _ := this.properties.Uint(PropSessionExpiryInterval)
+	return v
+}
+
+// SetSessionExpiryInterval sets the time in seconds the Session state is kept after
+// the Network Connection is closed.
+func (this *ConnectMessage) SetSessionExpiryInterval(v uint32) {
+	this.properties.SetUint(PropSessionExpiryInterval, v)
+}
+
 // WillFlag returns the bit that specifies whether a Will Message should be stored
 // on the server. If the Will Flag is set to 1 this indicates that, if the Connect
 // request is accepted, a Will Message MUST be stored on the Server and associated
@@ -192,6 +336,66 @@ func (this *ConnectMessage) SetPasswordFlag(v bool) {
 	}
 }
 
+// Lenient returns whether Decode normalizes the Will QoS and Will Retain bits instead
+// of rejecting the message when they are set while the Will Flag is not.
+func (this *ConnectMessage) Lenient() bool {
+	return this.lenient
+}
+
+// SetLenient sets whether Decode normalizes the Will QoS and Will Retain bits instead
+// of rejecting the message. By default the message is rejected as required by the
+// spec [MQTT-3.1.2-13], [MQTT-3.1.2-15]. Some clients set these bits without the
+// Will Flag, and a lenient Server may choose to accept them by clearing the bits.
+func (this *ConnectMessage) SetLenient(v bool) {
+	this.lenient = v
+}
+
+// LenientWillRetain returns whether Decode clears the Will Retain bit instead of
+// rejecting the message when it's set while the Will Flag is not.
+func (this *ConnectMessage) LenientWillRetain() bool {
+	return this.lenientWillRetain
+}
+
+// SetLenientWillRetain sets whether Decode clears the Will Retain bit instead of
+// rejecting the message when it's set while the Will Flag is not, which some embedded
+// clients do. Unlike SetLenient, the Will QoS bits must still be zero. Each time the
+// bit is cleared, a warning is added to Warnings, so the Server can log it.
+func (this *ConnectMessage) SetLenientWillRetain(v bool) {
+	this.lenientWillRetain = v
+}
+
+// Warnings returns the spec violations that were normalized instead of rejected by
+// the last Decode, because of SetLenient or SetLenientWillRetain. It's empty if the
+// message decoded was valid.
+func (this *ConnectMessage) Warnings() []string {
+	return this.warnings
+}
+
+// AcceptedVersions returns the protocol versions accepted by Decode. If it's empty,
+// all the versions in SupportedVersions are accepted.
+func (this *ConnectMessage) AcceptedVersions() []byte {
+	return this.acceptedVersions
+}
+
+// SetAcceptedVersions restricts the protocol versions accepted by Decode to a subset
+// of SupportedVersions, e.g., to refuse the legacy MQTT 3.1 (0x3) protocol. A CONNECT
+// message with any other version is rejected with ErrUnsupportedProtocolVersion,
+// for which the Server should respond with UnacceptableProtocolVersion. If v is
+// empty, all the versions in SupportedVersions are accepted, which is the default.
+func (this *ConnectMessage) SetAcceptedVersions(v []byte) {
+	this.acceptedVersions = v
+}
+
+// acceptsVersion checks to see if the version is supported and, if the accepted
+// versions are set, one of them.
+func (this *ConnectMessage) acceptsVersion(v byte) bool {
+	if _, ok := SupportedVersions[v]; !ok {
+		return false
+	}
+
+	return len(this.acceptedVersions) == 0 || bytes.IndexByte(this.acceptedVersions, v) != -1
+}
+
 // KeepAlive returns a time interval measured in seconds. Expressed as a 16-bit word,
 // it is the maximum time interval that is permitted to elapse between the point at
 // which the Client finishes transmitting one Control Packet and the point it starts
@@ -214,9 +418,76 @@ func (this *ConnectMessage) ClientId() []byte {
 	return this.clientId
 }
 
-// SetClientId sets an ID that identifies the Client to the Server.
+// IsClientIdAssigned returns true if the Client supplied a zero-byte ClientId, which
+// is only allowed with CleanSession set to 1. The Server must then assign a unique
+// ClientId to the Client, and for version 5 return it in the Assigned Client
+// Identifier property of the CONNACK message, see
+// ConnackMessage.SetAssignedClientIdentifier.
+func (this *ConnectMessage) IsClientIdAssigned() bool {
+	return len(this.clientId) == 0 && this.CleanSession()
+}
+
+// CheckAgainst checks the message against the constraints of the Server, and returns
+// the return code of the CONNACK message to respond with. If the connection is
+// rejected, the error corresponding to the return code is returned as well. The
+// ClientId is checked first, then the user name and password, then the keep alive,
+// which is only checked for versions 3.1 and 3.1.1.
+func (this *ConnectMessage) CheckAgainst(c ServerConstraints) (ConnackCode, error) {
+	if c.MaxClientIdLen > 0 && len(this.clientId) > c.MaxClientIdLen {
+		return IdentifierRejected, ErrIdentifierRejected
+	}
+
+	if !c.AllowAnonymous && !this.UsernameFlag() {
+		return NotAuthorized, ErrNotAuthorized
+	}
+
+	if c.RequireAuth && (!this.UsernameFlag() || !this.PasswordFlag()) {
+		return BadUsernameOrPassword, ErrBadUsernameOrPassword
+	}
+
+	if c.MaxKeepAlive > 0 && this.version != 0x5 && (this.keepAlive == 0 || this.keepAlive > c.MaxKeepAlive) {
+		return NotAuthorized, ErrNotAuthorized
+	}
+
+	return ConnectionAccepted, nil
+}
+
+// Accept returns the CONNACK message accepting the connection, for the same protocol
+// version as the CONNECT. sessionPresent tells the Client whether the Server already
+// has a Session for it. It's cleared if the Clean Session bit is set, as the Server
+// MUST then set Session Present to 0 [MQTT-3.2.2-1], and for version 3, whose CONNACK
+// has no Session Present flag.
+func (this *ConnectMessage) Accept(sessionPresent bool) *ConnackMessage {
+	msg := NewConnackMessage()
+	msg.version = this.version
+	msg.SetReturnCode(ConnectionAccepted)
+	msg.SetSessionPresent(sessionPresent && !this.CleanSession() && this.version != 0x3)
+
+	return msg
+}
+
+// Refuse returns the CONNACK message refusing the connection with the return code,
+// for the same protocol version as the CONNECT. For version 5, the return code is
+// replaced with the equivalent reason code, see ConnackCode.ToReasonCode. Session
+// Present is always 0, as a CONNACK with a non-zero return code MUST NOT set it
+// [MQTT-3.2.2-4]. If code is ConnectionAccepted, it's the same as Accept(false).
+func (this *ConnectMessage) Refuse(code ConnackCode) *ConnackMessage {
+	msg := NewConnackMessage()
+	msg.version = this.version
+
+	if this.version == 0x5 {
+		msg.SetReturnCode(ConnackCode(code.ToReasonCode()))
+	} else {
+		msg.SetReturnCode(code)
+	}
+
+	return msg
+}
+
+// SetClientId sets an ID that identifies the Client to the Server. The ClientId is
+// checked against the requirement of the current version, see ValidClientIdVersion.
 func (this *ConnectMessage) SetClientId(v []byte) error {
-	if len(v) > 0 && !ValidClientId(v) {
+	if len(v) > 0 && !ValidClientIdVersion(v, this.version) {
 		return ErrIdentifierRejected
 	}
 
@@ -230,8 +501,15 @@ func (this *ConnectMessage) WillTopic() []byte {
 	return this.willTopic
 }
 
-// SetWillTopic sets the topic in which the Will Message should be published to.
-func (this *ConnectMessage) SetWillTopic(v []byte) {
+// SetWillTopic sets the topic in which the Will Message should be published to. The
+// Will Topic is the topic name of a PUBLISH message, so an error is returned, and the
+// topic is left unchanged, if ValidTopic() is false, e.g., it contains wildcards. An
+// empty topic removes the Will Topic.
+func (this *ConnectMessage) SetWillTopic(v []byte) error {
+	if len(v) > 0 && !ValidTopic(v) {
+		return fmt.Errorf("connect/SetWillTopic: Invalid will topic %q", v)
+	}
+
 	this.willTopic = v
 
 	if len(v) > 0 {
@@ -239,9 +517,13 @@ func (this *ConnectMessage) SetWillTopic(v []byte) {
 	} else if len(this.willMessage) == 0 {
 		this.SetWillFlag(false)
 	}
+
+	return nil
 }
 
 // WillMessage returns the Will Message that is to be published to the Will Topic.
+// Like the payload of a PUBLISH message, it's binary data, which is never checked to
+// be valid UTF-8.
 func (this *ConnectMessage) WillMessage() []byte {
 	return this.willMessage
 }
@@ -257,6 +539,74 @@ func (this *ConnectMessage) SetWillMessage(v []byte) {
 	}
 }
 
+// WillMessageString returns the Will Message as a string.
+func (this *ConnectMessage) WillMessageString() string {
+	return string(this.willMessage)
+}
+
+// SetWillMessageString sets the Will Message to the bytes of v, the same as
+// SetWillMessage.
+func (this *ConnectMessage) SetWillMessageString(v string) {
+	this.SetWillMessage([]byte(v))
+}
+
+// WillPublish returns the PUBLISH message the Server publishes when the Network
+// Connection is closed without a DISCONNECT, using the Will Topic, Will Message, Will
+// QoS and Will Retain of this message. For version 5, the will properties are included
+// as the PUBLISH properties, except the Will Delay Interval which only applies to
+// when the message is published. The topic, payload and properties are copied, so
+// the PUBLISH message remains valid after this message is reused or released. An
+// error is returned if the Will Flag is not set.
+func (this *ConnectMessage) WillPublish() (*PublishMessage, error) {
+	if !this.WillFlag() {
+		return nil, fmt.Errorf("connect/WillPublish: Will flag is not set")
+	}
+
+	msg := NewPublishMessage()
+
+	if err := msg.SetTopic(copyBytes(this.willTopic)); err != nil {
+		return nil, err
+	}
+
+	if err := msg.SetQoS(this.WillQos()); err != nil {
+		return nil, err
+	}
+
+	msg.SetRetain(this.WillRetain())
+	msg.SetPayload(copyBytes(this.willMessage))
+
+	if this.version == 0x5 {
+		msg.version = this.version
+
+		for _, p := range this.willProperties.props {
+			if p.id != PropWillDelayInterval {
+				msg.properties.props = append(msg.properties.props, property{p.id, p.num, copyBytes(p.data)})
+			}
+		}
+
+		for _, up := range this.willProperties.userProps {
+			msg.properties.userProps = append(msg.properties.userProps, UserProperty{copyBytes(up.Key), copyBytes(up.Value)})
+		}
+	}
+
+	return msg, nil
+}
+
+// WillEqual checks to see if this message and other have the same will, i.e., the same
+// Will Topic, Will Message, Will QoS and Will Retain. Other fields, including the will
+// properties, are ignored. Messages that both have the Will Flag unset have the same
+// will, regardless of the other will bits and fields.
+func (this *ConnectMessage) WillEqual(other *ConnectMessage) bool {
+	if !this.WillFlag() || !other.WillFlag() {
+		return this.WillFlag() == other.WillFlag()
+	}
+
+	return this.WillQos() == other.WillQos() &&
+		this.WillRetain() == other.WillRetain() &&
+		bytes.Equal(this.willTopic, other.willTopic) &&
+		bytes.Equal(this.willMessage, other.willMessage)
+}
+
 // Username returns the username from the payload. If the User Name Flag is set to 1,
 // this must be in the payload. It can be used by the Server for authentication and
 // authorization.
@@ -277,7 +627,8 @@ func (this *ConnectMessage) SetUsername(v []byte) {
 
 // Password returns the password from the payload. If the Password Flag is set to 1,
 // this must be in the payload. It can be used by the Server for authentication and
-// authorization.
+// authorization. Unlike the user name, it's binary data, which is never checked to
+// be valid UTF-8.
 func (this *ConnectMessage) Password() []byte {
 	return this.password
 }
@@ -305,18 +656,14 @@ func (this *ConnectMessage) SetPassword(v []byte) {
 // a Connack error. If so, caller should send the Client back the corresponding
 // CONNACK message.
 func (this *ConnectMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
 
-	if n, err = this.decodeMessage(); err != nil {
-		return total + n, err
+	if _, err = this.decodeMessage(); err != nil {
+		return total, this.decodeError(err)
 	}
-	total += n
 
 	return total, nil
 }
@@ -327,15 +674,45 @@ func (this *ConnectMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *ConnectMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *ConnectMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *ConnectMessage) encode(buf *bytes.Buffer) (int, error) {
 	if this.Type() != CONNECT {
-		return nil, 0, fmt.Errorf("connect/Encode: Invalid message type. Expecting %d, got %d", CONNECT, this.Type())
+		return 0, fmt.Errorf("connect/Encode: Invalid message type. Expecting %d, got %d", CONNECT, this.Type())
 	}
 
-	total := 0
+	var remlen int64
 	var n int
 	verstr, ok := SupportedVersions[this.version]
 	if !ok {
-		return nil, 0, fmt.Errorf("connect/Encode: Unsupported protocol version %d", this.version)
+		return 0, fmt.Errorf("connect/Encode: Unsupported protocol version %d", this.version)
+	}
+
+	// The Will Message is published to the Will Topic, so it must be a valid topic name
+	if this.WillFlag() && !ValidTopic(this.willTopic) {
+		return 0, fmt.Errorf("connect/Encode: Invalid will topic %q", this.willTopic)
 	}
 
 	// 2 bytes protocol name length
@@ -343,51 +720,57 @@ func (this *ConnectMessage) Encode() (io.Reader, int, error) {
 	// 1 byte protocol version
 	// 1 byte connect flags
 	// 2 bytes keep alive timer
-	total += 2 + len(verstr) + 1 + 1 + 2
+	remlen += int64(2 + len(verstr) + 1 + 1 + 2)
+
+	// Add the properties length, including the length prefix
+	if this.version == 0x5 {
+		remlen += int64(this.properties.size())
+	}
 
 	// Add the clientID length, 2 is the length prefix
-	total += 2 + len(this.clientId)
+	remlen += int64(2 + len(this.clientId))
 
 	// Add the will topic and will message length, and the length prefixes
 	if this.WillFlag() {
-		total += 2 + len(this.willTopic) + 2 + len(this.willMessage)
+		remlen += int64(2 + len(this.willTopic) + 2 + len(this.willMessage))
+
+		if this.version == 0x5 {
+			remlen += int64(this.willProperties.size())
+		}
 	}
 
-	// Add the username length
-	// According to the 3.1 spec, it's possible that the usernameFlag is set,
-	// but the user name string is missing.
-	if this.UsernameFlag() && len(this.username) > 0 {
-		total += 2 + len(this.username)
+	// Add the username length. The user name is always encoded if the flag is set,
+	// even if it's empty, so a decoded message is encoded back to the same bytes.
+	if this.UsernameFlag() {
+		remlen += int64(2 + len(this.username))
 	}
 
 	// Add the password length
-	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.PasswordFlag() && len(this.password) > 0 {
-		total += 2 + len(this.password)
+	if this.PasswordFlag() {
+		remlen += int64(2 + len(this.password))
 	}
 
-	if err := this.SetRemainingLength(int32(total)); err != nil {
-		return nil, 0, err
+	if err := this.setEncodedLength(remlen); err != nil {
+		return 0, err
 	}
 
-	total = 0
+	total := 0
 
-	_, n, err := this.fixedHeader.Encode()
+	n, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, total + n, err
+		return total + n, err
 	}
 	total += n
 
-	if n, err = this.encodeMessage(); err != nil {
-		return nil, total + n, err
+	if n, err = this.encodeMessage(buf); err != nil {
+		return total + n, err
 	}
 	total += n
 
-	return this.buf, total, nil
+	return total, nil
 }
 
-func (this *ConnectMessage) encodeMessage() (int, error) {
+func (this *ConnectMessage) encodeMessage(buf *bytes.Buffer) (int, error) {
 	total := 0
 
 	verstr, ok := SupportedVersions[this.version]
@@ -395,53 +778,64 @@ func (this *ConnectMessage) encodeMessage() (int, error) {
 		return 0, fmt.Errorf("connect/encodeVariableHeader: Unsupported protocol version %d", this.version)
 	}
 
-	n, err := writeLPBytes(this.buf, []byte(verstr))
+	n, err := writeLPBytes(buf, []byte(verstr))
 	if err != nil {
 		return 0, err
 	}
 	total += int(n)
 
-	this.buf.WriteByte(this.version)
+	buf.WriteByte(this.version)
 	total += 1
 
-	this.buf.WriteByte(this.connectFlags)
+	buf.WriteByte(this.connectFlags)
 	total += 1
 
-	if err = writeUint16(this.buf, this.keepAlive); err != nil {
+	if err = writeUint16(buf, this.keepAlive); err != nil {
 		return total, err
 	}
 	total += 2
 
-	if n, err = writeLPBytes(this.buf, this.clientId); err != nil {
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, connectPropertySet); err != nil {
+			return total + n, err
+		}
+		total += n
+	}
+
+	if n, err = writeUTF8(buf, this.clientId); err != nil {
 		return total + n, err
 	}
 	total += n
 
 	if this.WillFlag() {
-		if n, err = writeLPBytes(this.buf, this.willTopic); err != nil {
+		if this.version == 0x5 {
+			if n, err = this.willProperties.encode(buf, willPropertySet); err != nil {
+				return total + n, err
+			}
+			total += n
+		}
+
+		if n, err = writeUTF8(buf, this.willTopic); err != nil {
 			return total + n, err
 		}
 		total += n
 
-		if n, err = writeLPBytes(this.buf, this.willMessage); err != nil {
+		// The Will Message and the Password are binary data, not UTF-8 strings
+		if n, err = writeLPBytes(buf, this.willMessage); err != nil {
 			return total + n, err
 		}
 		total += n
 	}
 
-	// According to the 3.1 spec, it's possible that the usernameFlag is set,
-	// but the username string is missing.
-	if this.UsernameFlag() && len(this.username) > 0 {
-		if n, err = writeLPBytes(this.buf, this.username); err != nil {
+	if this.UsernameFlag() {
+		if n, err = writeUTF8(buf, this.username); err != nil {
 			return total + n, err
 		}
 		total += n
 	}
 
-	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.PasswordFlag() && len(this.password) > 0 {
-		if n, err = writeLPBytes(this.buf, this.password); err != nil {
+	if this.PasswordFlag() {
+		if n, err = writeLPBytes(buf, this.password); err != nil {
 			return total + n, err
 		}
 		total += n
@@ -454,6 +848,8 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	var n, total int
 	var err error
 
+	this.warnings = this.warnings[:0]
+
 	if this.protoName, n, err = readLPBytes(this.buf); err != nil {
 		return total + n, err
 	}
@@ -464,10 +860,14 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	}
 	total += 1
 
-	if verstr, ok := SupportedVersions[this.version]; !ok {
+	if verstr, ok := KnownVersions[this.version]; !ok {
 		return total, ErrUnacceptableProtocolVersion
 	} else if verstr != string(this.protoName) {
-		return total, ErrUnacceptableProtocolVersion
+		return total, ErrProtocolNameMismatch
+	}
+
+	if !this.acceptsVersion(this.version) {
+		return total, ErrUnsupportedProtocolVersion
 	}
 
 	if this.connectFlags, err = this.buf.ReadByte(); err != nil {
@@ -484,11 +884,24 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	}
 
 	if !this.WillFlag() && (this.WillRetain() || this.WillQos() != QosAtMostOnce) {
-		return total, fmt.Errorf("connect/decodeMessage: Protocol violation: If the Will Flag (%t) is set to 0 the Will QoS (%d) and Will Retain (%t) fields MUST be set to zero", this.WillFlag(), this.WillQos(), this.WillRetain())
+		switch {
+		case this.lenient:
+			this.warnings = append(this.warnings, fmt.Sprintf("Will QoS (%d) and Will Retain (%t) cleared, as the Will Flag is not set", this.WillQos(), this.WillRetain()))
+			this.connectFlags &= 199 // 11000111
+
+		case this.lenientWillRetain && this.WillQos() == QosAtMostOnce:
+			this.warnings = append(this.warnings, "Will Retain cleared, as the Will Flag is not set")
+			this.connectFlags &= 223 // 11011111
+
+		default:
+			return total, protocolError("connect/decodeMessage", "If the Will Flag (%t) is set to 0 the Will QoS (%d) and Will Retain (%t) fields MUST be set to zero", this.WillFlag(), this.WillQos(), this.WillRetain())
+		}
 	}
 
-	if this.UsernameFlag() && !this.PasswordFlag() {
-		return total, fmt.Errorf("connect/decodeMessage: Username flag is set but Password flag is not set")
+	// If the User Name Flag is set to 0, the Password Flag MUST be set to 0 [MQTT-3.1.2-22].
+	// A password without a user name is allowed in version 5.
+	if this.PasswordFlag() && !this.UsernameFlag() && this.version != 0x5 {
+		return total, fmt.Errorf("connect/decodeMessage: Password flag is set but Username flag is not set")
 	}
 
 	if this.keepAlive, err = readUint16(this.buf); err != nil {
@@ -496,6 +909,13 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	}
 	total += 2
 
+	if this.version == 0x5 {
+		if n, err = this.properties.decode(this.buf, connectPropertySet); err != nil {
+			return total + n, err
+		}
+		total += n
+	}
+
 	if this.clientId, n, err = readLPBytes(this.buf); err != nil {
 		return total + n, err
 	}
@@ -507,45 +927,77 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	}
 
 	// The ClientId must contain only characters 0-9, a-z, and A-Z
-	// We also support ClientId longer than 23 encoded bytes
+	// We also support ClientId longer than 23 encoded bytes, except for version 0x3
 	// We do not support ClientId outside of the above characters
-	if len(this.clientId) > 0 && !ValidClientId(this.clientId) {
+	if !ValidClientIdVersion(this.clientId, this.version) {
 		return total, ErrIdentifierRejected
 	}
 
+	// Clear the optional fields, in case the message is reused
+	this.willTopic, this.willMessage, this.username, this.password = nil, nil, nil, nil
+
 	if this.WillFlag() {
+		if this.version == 0x5 {
+			if n, err = this.willProperties.decode(this.buf, willPropertySet); err != nil {
+				return total + n, err
+			}
+			total += n
+		}
+
 		if this.willTopic, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, missingWill(err)
 		}
 		total += n
 
+		if !ValidTopic(this.willTopic) || !validUTF8(this.willTopic) {
+			return total, fmt.Errorf("connect/decodeMessage: Invalid will topic %q", this.willTopic)
+		}
+
 		if this.willMessage, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, missingWill(err)
 		}
 		total += n
 	}
 
-	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.UsernameFlag() && this.buf.Len() > 0 {
+	// If the User Name Flag is set, the User Name MUST be present, even if it's empty
+	if this.UsernameFlag() {
 		if this.username, n, err = readLPBytes(this.buf); err != nil {
 			return total + n, err
 		}
 		total += n
+
+		// Unlike the password, which is binary data, the User Name is a UTF-8 string,
+		// and may be used as is to authenticate the Client
+		if !validUTF8(this.username) {
+			return total, ErrInvalidUsername
+		}
 	}
 
-	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.PasswordFlag() && this.buf.Len() > 0 {
+	// If the Password Flag is set, the Password MUST be present, even if it's empty.
+	// The 3.1 spec allowed the password string to be missing, but that can't be told
+	// apart from a truncated message, so it's required for version 0x3 as well, the
+	// same as the User Name.
+	if this.PasswordFlag() {
 		if this.password, n, err = readLPBytes(this.buf); err != nil {
 			return total + n, err
 		}
 		total += n
 	}
 
-	if this.buf.Len() > 0 {
-		return total, fmt.Errorf("connect/decodeMessage: Invalid buffer size. Still has %d bytes at the end.", this.buf.Len())
+	if err = this.lengthError(); err != nil {
+		return total, err
 	}
 
 	return total, nil
 }
+
+// missingWill replaces the error of a DecodeError returned while reading the will
+// fields with ErrMissingWill, which is more meaningful than the generic buffer size
+// error, while keeping the offset.
+func missingWill(err error) error {
+	if de, ok := err.(*DecodeError); ok {
+		de.Err = ErrMissingWill
+	}
+
+	return err
+}
@@ -16,6 +16,7 @@ package mqtt
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/dataence/assert"
@@ -29,7 +30,7 @@ func TestConnectMessageFields(t *testing.T) {
 
 	assert.Equal(t, false, 0x3, msg.Version(), "Incorrect version number")
 
-	err = msg.SetVersion(0x5)
+	err = msg.SetVersion(0x6)
 	assert.Error(t, false, err)
 
 	msg.SetCleanSession(true)
@@ -173,6 +174,50 @@ func TestConnectMessageDecode(t *testing.T) {
 	assert.Equal(t, true, "verysecret", string(msg.Password()), "Incorrect password value.")
 }
 
+// test a remaining length 2 bytes larger than the message
+func TestConnectMessageDecodeLengthMismatch(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		62,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		206, // connect flags 11001110, will QoS = 01
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		7,   // Client ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // Will Topic MSB (0)
+		4, // Will Topic LSB (4)
+		'w', 'i', 'l', 'l',
+		0,  // Will Message MSB (0)
+		12, // Will Message LSB (12)
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+		0, // Username ID MSB (0)
+		7, // Username ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0,  // Password ID MSB (0)
+		10, // Password ID LSB (10)
+		'v', 'e', 'r', 'y', 's', 'e', 'c', 'r', 'e', 't',
+		0, // extra byte
+		0, // extra byte
+	}
+
+	msg := NewConnectMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	le, ok := err.(*LengthError)
+	assert.True(t, true, ok, "Incorrect error type.")
+	assert.Equal(t, true, CONNECT, le.Type, "Incorrect message type.")
+	assert.Equal(t, true, 62, le.Declared, "Incorrect declared length.")
+	assert.Equal(t, true, 60, le.Consumed, "Incorrect consumed length.")
+	assert.Equal(t, true, "CONNECT message remaining length mismatch: declared 62, consumed 60", err.Error(), "Incorrect error.")
+}
+
 func TestConnectMessageDecode2(t *testing.T) {
 	// missing last byte 't'
 	msgBytes := []byte{
@@ -321,10 +366,1060 @@ func TestConnectMessageEncode(t *testing.T) {
 	msg.SetUsername([]byte("surgemq"))
 	msg.SetPassword([]byte("verysecret"))
 
+	testRoundTrip(t, msg, msgBytes)
+}
+
+// test version 5 with maximum packet size
+func TestConnectMessageMaximumPacketSize(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		36,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		5,             // Protocol level 5
+		6,             // connect flags 00000110, will QoS = 00
+		0,             // Keep Alive MSB (0)
+		10,            // Keep Alive LSB (10)
+		5,             // properties length (5)
+		0x27,          // maximum packet size
+		0, 0, 0x10, 0, // 4096 bytes
+		0, // Client ID MSB (0)
+		7, // Client ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // will properties length (0)
+		0, // Will Topic MSB (0)
+		4, // Will Topic LSB (4)
+		'w', 'i', 'l', 'l',
+		0, // Will Message MSB (0)
+		2, // Will Message LSB (2)
+		'h', 'i',
+	}
+
+	msg := NewConnectMessage()
+	msg.SetVersion(5)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetKeepAlive(10)
+	msg.SetWillTopic([]byte("will"))
+	msg.SetWillMessage([]byte("hi"))
+
+	err := msg.SetMaximumPacketSize(4096)
+	assert.NoError(t, true, err, "Error setting maximum packet size.")
+
 	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding message.")
+
+	msg2 := NewConnectMessage()
+
+	_, err = msg2.Decode(bytes.NewBuffer(msgBytes))
 	assert.NoError(t, true, err, "Error decoding message.")
 
-	assert.Equal(t, true, len(msgBytes), n, "Error decoding message.")
+	assert.Equal(t, true, 5, msg2.Version(), "Incorrect version.")
+
+	v, ok := msg2.MaximumPacketSize()
+	assert.True(t, true, ok, "Maximum packet size should be present.")
+
+	assert.Equal(t, true, 4096, v, "Incorrect maximum packet size.")
+
+	assert.Equal(t, true, "will", string(msg2.WillTopic()), "Incorrect will topic.")
+}
+
+func TestConnectMessageReceiveMaximum(t *testing.T) {
+	msg := NewConnectMessage()
+
+	assert.Equal(t, true, 65535, msg.ReceiveMaximum(), "Incorrect default receive maximum.")
+
+	err := msg.SetReceiveMaximum(0)
+	assert.Error(t, true, err)
+
+	err = msg.SetReceiveMaximum(10)
+	assert.NoError(t, true, err, "Error setting receive maximum.")
+
+	assert.Equal(t, true, 10, msg.ReceiveMaximum(), "Incorrect receive maximum.")
+}
+
+func TestConnectMessageCleanStart(t *testing.T) {
+	msg := NewConnectMessage()
+
+	msg.SetCleanStart(true)
+	assert.True(t, true, msg.CleanStart(), "Error setting clean start flag.")
+
+	assert.True(t, true, msg.CleanSession(), "Clean start should set the clean session flag.")
+
+	msg.SetCleanSession(false)
+	assert.False(t, true, msg.CleanStart(), "Clean session should clear the clean start flag.")
+
+	assert.Equal(t, true, 0, msg.SessionExpiryInterval(), "Incorrect default session expiry interval.")
+
+	msg.SetSessionExpiryInterval(0xffffffff)
+	assert.Equal(t, true, uint32(0xffffffff), msg.SessionExpiryInterval(), "Error setting session expiry interval.")
+}
+
+func TestConnectMessageSessionExpiryInterval(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		25,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		5,                // Protocol level 5
+		2,                // connect flags 00000010, clean start
+		0,                // Keep Alive MSB (0)
+		30,               // Keep Alive LSB (30)
+		5,                // properties length (5)
+		0x11,             // session expiry interval
+		0, 0, 0x0e, 0x10, // 3600 seconds
+		0, // Client ID MSB (0)
+		7, // Client ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	msg := NewConnectMessage()
+	msg.SetVersion(5)
+	msg.SetCleanStart(true)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetKeepAlive(30)
+	msg.SetSessionExpiryInterval(3600)
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding message.")
+
+	msg2 := NewConnectMessage()
+
+	_, err = msg2.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.True(t, true, msg2.CleanStart(), "Incorrect clean start flag.")
+
+	assert.Equal(t, true, 3600, msg2.SessionExpiryInterval(), "Incorrect session expiry interval.")
+}
+
+func TestConnectMessageLenient(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		15,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		42, // connect flags 00101010, will retain = 1, will QoS = 01, will flag = 0
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	msg := NewConnectMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg = NewConnectMessage()
+	msg.SetLenient(true)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.False(t, true, msg.WillFlag(), "Incorrect will flag.")
+
+	assert.False(t, true, msg.WillRetain(), "Incorrect will retain.")
+
+	assert.Equal(t, true, QosAtMostOnce, msg.WillQos(), "Incorrect will QoS.")
+
+	assert.True(t, true, msg.CleanSession(), "Incorrect clean session.")
+
+	assert.Equal(t, true, "cid", string(msg.ClientId()), "Incorrect client ID.")
+
+	assert.Equal(t, true, 1, len(msg.Warnings()), "Incorrect number of warnings.")
+}
+
+func TestConnectMessageLenientWillRetain(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		15,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		34, // connect flags 00100010, will retain = 1, will QoS = 00, will flag = 0
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	msg := NewConnectMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg = NewConnectMessage()
+	msg.SetLenientWillRetain(true)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.False(t, true, msg.WillRetain(), "Will retain should be cleared.")
+
+	assert.True(t, true, msg.CleanSession(), "Incorrect clean session.")
+
+	assert.Equal(t, true, []string{"Will Retain cleared, as the Will Flag is not set"}, msg.Warnings(), "Incorrect warnings.")
+
+	// the warnings are reset by the next Decode
+	msgBytes[9] = 2 // connect flags 00000010
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 0, len(msg.Warnings()), "Incorrect number of warnings.")
+
+	// the Will QoS bits must still be zero
+	msgBytes[9] = 42 // connect flags 00101010, will retain = 1, will QoS = 01, will flag = 0
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+}
+
+// test round trip of the full CONNECT fixture
+func TestConnectMessageDecodeEncode(t *testing.T) {
+	msg := NewConnectMessage()
+
+	n, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+}
+
+// test round trip of user name without password, and an empty user name
+func TestConnectMessageDecodeEncode2(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		24,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		130, // connect flags 10000010
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		3,   // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Username ID MSB (0)
+		7, // Username ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	for _, b := range [][]byte{msgBytes, append(append([]byte{byte(CONNECT << 4), 17}, msgBytes[2:17]...), 0, 0)} {
+		msg := NewConnectMessage()
+
+		_, err := msg.Decode(bytes.NewBuffer(b))
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		assert.True(t, true, msg.UsernameFlag(), "Incorrect username flag.")
+
+		assert.False(t, true, msg.PasswordFlag(), "Incorrect password flag.")
+
+		dst, _, err := msg.Encode()
+		assert.NoError(t, true, err, "Error encoding message.")
+
+		assert.Equal(t, true, b, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+	}
+}
+
+// test password without user name
+func TestConnectMessageDecode5(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		24,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		66, // connect flags 01000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Password MSB (0)
+		7, // Password LSB (7)
+		's', 'e', 'c', 'r', 'e', 't', 's',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+}
+
+// test a known version that's not supported
+func TestConnectMessageUnsupportedVersion(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		16,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		5,  // Protocol level 5
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // properties length (0)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// a known version that isn't accepted
+	msg := NewConnectMessage()
+	msg.SetAcceptedVersions([]byte{0x3, 0x4})
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrUnsupportedProtocolVersion, err, "Incorrect error.")
+
+	assert.True(t, true, ValidConnackError(err), "Expecting CONNACK error.")
+
+	// a known version that isn't supported
+	delete(SupportedVersions, 0x5)
+	defer func() { SupportedVersions[0x5] = "MQTT" }()
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrUnsupportedProtocolVersion, err, "Incorrect error.")
+
+	// unknown version
+	msgBytes[8] = 6
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrUnacceptableProtocolVersion, err, "Incorrect error.")
+}
+
+func TestConnectMessageWillPublish(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetClientId([]byte("cid"))
+
+	_, err := msg.WillPublish()
+	assert.Error(t, true, err)
+
+	msg.SetWillFlag(true)
+	msg.SetWillTopic([]byte("will"))
+	msg.SetWillMessage([]byte("send me home"))
+	msg.SetWillQos(1)
+	msg.SetWillRetain(true)
+
+	pub, err := msg.WillPublish()
+	assert.NoError(t, true, err, "Error building will message.")
+
+	assert.Equal(t, true, "will", string(pub.Topic()), "Incorrect topic.")
+
+	assert.Equal(t, true, "send me home", string(pub.Payload()), "Incorrect payload.")
+
+	assert.Equal(t, true, 1, pub.QoS(), "Incorrect QoS.")
+
+	assert.True(t, true, pub.Retain(), "Incorrect retain flag.")
+
+	// will properties, except the will delay interval
+	msg.SetVersion(0x5)
+	msg.WillProperties().SetUint(PropWillDelayInterval, 10)
+	msg.WillProperties().SetUint(PropMessageExpiryInterval, 60)
+	msg.WillProperties().AddUserProperty([]byte("k"), []byte("v"))
+
+	pub, err = msg.WillPublish()
+	assert.NoError(t, true, err, "Error building will message.")
+
+	assert.Equal(t, true, 0x5, pub.Version(), "Incorrect version.")
+
+	assert.False(t, true, pub.Properties().Has(PropWillDelayInterval), "Unexpected will delay interval.")
+
+	v, ok := pub.Properties().Uint(PropMessageExpiryInterval)
+	assert.True(t, true, ok, "Expecting message expiry interval.")
+
+	assert.Equal(t, true, 60, v, "Incorrect message expiry interval.")
+
+	assert.Equal(t, true, 1, len(pub.Properties().UserProperties()), "Incorrect user properties.")
+}
+
+// test the 23 byte ClientId limit of version 0x3
+func TestConnectMessageClientIdVersion(t *testing.T) {
+	cid := []byte("abcdefghijklmnopqrstuvwxyz0123")
+
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		44,
+		0, // Length MSB (0)
+		6, // Length LSB (6)
+		'M', 'Q', 'I', 's', 'd', 'p',
+		3,  // Protocol level 3
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		30, // Client ID LSB (30)
+	}
+	msgBytes = append(msgBytes, cid...)
+
+	msg := NewConnectMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrIdentifierRejected, err, "Incorrect error.")
+
+	msgBytes = []byte{
+		byte(CONNECT << 4),
+		42,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		30, // Client ID LSB (30)
+	}
+	msgBytes = append(msgBytes, cid...)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, cid, msg.ClientId(), "Incorrect client ID.")
+
+	msg = NewConnectMessage()
+	msg.SetVersion(0x3)
+
+	err = msg.SetClientId(cid)
+	assert.Equal(t, true, ErrIdentifierRejected, err, "Incorrect error.")
+
+	err = msg.SetClientId(cid[:23])
+	assert.NoError(t, true, err, "Error setting client ID.")
+
+	assert.False(t, true, ValidClientIdVersion(nil, 0x3), "Expecting invalid client ID.")
+
+	assert.True(t, true, ValidClientIdVersion(nil, 0x4), "Expecting valid client ID.")
+}
+
+func TestConnectMessageWillEqual(t *testing.T) {
+	newWill := func(qos byte) *ConnectMessage {
+		msg := NewConnectMessage()
+		msg.SetWillFlag(true)
+		msg.SetWillTopic([]byte("will"))
+		msg.SetWillMessage([]byte("send me home"))
+		msg.SetWillQos(qos)
+
+		return msg
+	}
+
+	msg1, msg2 := newWill(1), newWill(1)
+	msg2.SetClientId([]byte("cid"))
+
+	assert.True(t, true, msg1.WillEqual(msg2), "Expecting equal wills.")
+
+	msg2.SetWillQos(2)
+	assert.False(t, true, msg1.WillEqual(msg2), "Expecting different wills.")
+
+	msg2.SetWillQos(1)
+	msg2.SetWillRetain(true)
+	assert.False(t, true, msg1.WillEqual(msg2), "Expecting different wills.")
+
+	msg2.SetWillRetain(false)
+	msg2.SetWillMessage([]byte("send me away"))
+	assert.False(t, true, msg1.WillEqual(msg2), "Expecting different wills.")
+
+	// one has no will
+	msg3 := NewConnectMessage()
+
+	assert.False(t, true, msg1.WillEqual(msg3), "Expecting different wills.")
+
+	assert.False(t, true, msg3.WillEqual(msg1), "Expecting different wills.")
+
+	// both have no will, even though the will fields are still set in one
+	msg4 := newWill(2)
+	msg4.SetWillFlag(false)
+
+	assert.True(t, true, msg3.WillEqual(msg4), "Expecting equal wills.")
+}
+
+// test a will message without a will topic
+func TestConnectMessageEncodeEmptyWillTopic(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientId([]byte("cid"))
+	msg.SetWillMessage([]byte("send me home"))
+
+	assert.True(t, true, msg.WillFlag(), "Expecting will flag.")
+
+	_, _, err := msg.Encode()
+	assert.Error(t, true, err)
+
+	_, err = msg.AppendTo(nil)
+	assert.Error(t, true, err)
+
+	msg.SetWillTopic([]byte("will"))
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+// test a zero-byte ClientId with clean session set
+func TestConnectMessageClientIdAssigned(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		12,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		2,  // connect flags 00000010, clean session = 1
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		0,  // Client ID LSB (0)
+	}
+
+	msg := NewConnectMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.True(t, true, msg.IsClientIdAssigned(), "Expecting client ID to be assigned.")
+
+	// clean session = 0
+	msgBytes[9] = 0
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrIdentifierRejected, err, "Incorrect error.")
+
+	msg = NewConnectMessage()
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte("cid"))
+
+	assert.False(t, true, msg.IsClientIdAssigned(), "Expecting client ID not to be assigned.")
+}
+
+// test username and password flags without the username and password
+func TestConnectMessageDecodeMissingCredentials(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		21,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		194, // connect flags 11000010, username = 1, password = 1
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		3,   // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Username MSB (0)
+		4, // Username LSB (4)
+		'u', 's', 'e', 'r',
+	}
+
+	// password missing
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	// username missing
+	msgBytes[1] = 15
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes[:17]))
+	assert.Error(t, true, err)
+
+	// empty password
+	msgBytes[1] = 23
+	msgBytes = append(msgBytes, 0, 0)
+
+	msg := NewConnectMessage()
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "user", string(msg.Username()), "Incorrect username.")
+
+	assert.Equal(t, true, 0, len(msg.Password()), "Incorrect password.")
+}
+
+// test the password flag without the password in version 0x3
+func TestConnectMessageDecodeMissingPassword3(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		23,
+		0, // Length MSB (0)
+		6, // Length LSB (6)
+		'M', 'Q', 'I', 's', 'd', 'p',
+		3,   // Protocol level 3
+		194, // connect flags 11000010, username = 1, password = 1
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		3,   // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Username MSB (0)
+		4, // Username LSB (4)
+		'u', 's', 'e', 'r',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	// empty password
+	msgBytes[1] = 25
+	msgBytes = append(msgBytes, 0, 0)
+
+	msg := NewConnectMessage()
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "user", string(msg.Username()), "Incorrect username.")
+
+	assert.Equal(t, true, 0, len(msg.Password()), "Incorrect password.")
+}
+
+// test will flag set, but the message ends after the client ID
+func TestConnectMessageDecodeMissingWill(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		15,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		14, // connect flags 00001110, will flag = 1, will QoS = 01
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+
+	de, ok := err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, ErrMissingWill, de.Err, "Incorrect error.")
+
+	assert.Equal(t, true, 17, de.Offset, "Incorrect offset.")
+}
+
+// test will topics with wildcards
+func TestConnectMessageWillTopicWildcard(t *testing.T) {
+	msg := NewConnectMessage()
+
+	for _, topic := range []string{"a/#", "a/+/b", "+"} {
+		err := msg.SetWillTopic([]byte(topic))
+		assert.Error(t, true, err)
+	}
+
+	assert.False(t, true, msg.WillFlag(), "Will flag should not be set.")
+
+	assert.Equal(t, true, 0, len(msg.WillTopic()), "Will topic should not be set.")
+
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		24,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		6,  // connect flags 00000110, will flag = 1
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Will Topic MSB (0)
+		3, // Will Topic LSB (3)
+		'a', '/', '#',
+		0, // Will Message MSB (0)
+		2, // Will Message LSB (2)
+		'h', 'i',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msgBytes[21] = 'b'
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestConnectMessageString(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetUsername([]byte("surgemq"))
+	msg.SetPassword([]byte("verysecret"))
+
+	assert.False(t, true, strings.Contains(msg.String(), "verysecret"), "Password should be redacted.")
+
+	assert.True(t, true, strings.Contains(msg.String(), "Password: ****\n"), "Incorrect password string.")
+
+	assert.True(t, true, strings.Contains(msg.String(), "Username: surgemq\n"), "Incorrect username string.")
+
+	assert.True(t, true, strings.Contains(msg.StringUnsafe(), "Password: verysecret\n"), "Incorrect password string.")
+
+	msg.SetPassword(nil)
+
+	assert.True(t, true, strings.Contains(msg.String(), "Password: \n"), "Incorrect password string.")
+}
+
+func TestConnectMessageAcceptedVersions(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		17,
+		0, // Length MSB (0)
+		6, // Length LSB (6)
+		'M', 'Q', 'I', 's', 'd', 'p',
+		3,  // Protocol level 3
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.AcceptedVersions = []byte{0x4}
+
+	_, _, err := d.Decode()
+	assert.Equal(t, true, ErrUnsupportedProtocolVersion, err, "Incorrect error.")
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.AcceptedVersions = []byte{0x3, 0x4}
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, byte(0x3), msg.(*ConnectMessage).Version(), "Incorrect version.")
+
+	// all supported versions are accepted by default
+	_, _, err = NewDecoder(bytes.NewBuffer(msgBytes)).Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestConnectMessageCheckAgainst(t *testing.T) {
+	tests := []struct {
+		name      string
+		clientId  string
+		username  string
+		password  string
+		keepAlive uint16
+		c         ServerConstraints
+		code      ConnackCode
+	}{
+		{"accepted", "surgemq", "surgemq", "verysecret", 10, ServerConstraints{MaxKeepAlive: 60, RequireAuth: true, MaxClientIdLen: 23}, ConnectionAccepted},
+		{"anonymous allowed", "surgemq", "", "", 10, ServerConstraints{AllowAnonymous: true}, ConnectionAccepted},
+		{"client ID too long", "surgemqsurgemqsurgemq", "surgemq", "", 10, ServerConstraints{MaxClientIdLen: 20}, IdentifierRejected},
+		{"anonymous", "surgemq", "", "", 10, ServerConstraints{}, NotAuthorized},
+		{"missing password", "surgemq", "surgemq", "", 10, ServerConstraints{RequireAuth: true}, BadUsernameOrPassword},
+		{"anonymous with auth", "surgemq", "", "", 10, ServerConstraints{RequireAuth: true, AllowAnonymous: true}, BadUsernameOrPassword},
+		{"keep alive too long", "surgemq", "surgemq", "", 61, ServerConstraints{MaxKeepAlive: 60}, NotAuthorized},
+		{"keep alive off", "surgemq", "surgemq", "", 0, ServerConstraints{MaxKeepAlive: 60}, NotAuthorized},
+	}
+
+	for _, test := range tests {
+		msg := NewConnectMessage()
+		msg.SetVersion(4)
+		msg.SetClientId([]byte(test.clientId))
+		msg.SetUsername([]byte(test.username))
+		msg.SetPassword([]byte(test.password))
+		msg.SetKeepAlive(test.keepAlive)
+
+		code, err := msg.CheckAgainst(test.c)
+		assert.Equal(t, true, test.code, code, "Incorrect return code for "+test.name+".")
+
+		if test.code == ConnectionAccepted {
+			assert.NoError(t, true, err, "Unexpected error for "+test.name+".")
+		} else {
+			assert.Equal(t, true, test.code.Error(), err, "Incorrect error for "+test.name+".")
+		}
+	}
+
+	// version 5 negotiates the keep alive instead
+	for _, keepAlive := range []uint16{0, 61} {
+		msg := NewConnectMessage()
+		msg.SetVersion(0x5)
+		msg.SetClientId([]byte("surgemq"))
+		msg.SetUsername([]byte("surgemq"))
+		msg.SetKeepAlive(keepAlive)
+
+		code, err := msg.CheckAgainst(ServerConstraints{MaxKeepAlive: 60})
+		assert.NoError(t, true, err, "Unexpected error.")
+		assert.Equal(t, true, ConnectionAccepted, code, "Incorrect return code.")
+
+		ack := msg.Accept(false)
+		assert.Equal(t, true, 60, ack.NegotiateKeepAlive(msg.KeepAlive(), 60), "Incorrect keep alive.")
+	}
+}
+
+func TestConnectMessageProtocolNameMismatch(t *testing.T) {
+	// version 0x3 with "MQTT"
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		15,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		3,  // Protocol level 3
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrProtocolNameMismatch, err, "Incorrect error.")
+
+	assert.True(t, true, ValidConnackError(err), "Expecting CONNACK error.")
+
+	// version 0x4 with "MQIsdp"
+	msgBytes = []byte{
+		byte(CONNECT << 4),
+		17,
+		0, // Length MSB (0)
+		6, // Length LSB (6)
+		'M', 'Q', 'I', 's', 'd', 'p',
+		4,  // Protocol level 4
+		2,  // connect flags 00000010
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrProtocolNameMismatch, err, "Incorrect error.")
+
+	// unknown version
+	msgBytes[10] = 9
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrUnacceptableProtocolVersion, err, "Incorrect error.")
+}
+
+func TestConnectMessageDecodeInvalidUsername(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		25,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		194, // connect flags 11000010, username = 1, password = 1
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		3,   // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Username MSB (0)
+		4, // Username LSB (4)
+		'u', 0xff, 'e', 'r',
+		0, // Password MSB (0)
+		2, // Password LSB (2)
+		0xff, 0,
+	}
+
+	// invalid UTF-8
+	_, err := NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrInvalidUsername, err, "Incorrect error.")
+
+	// null character
+	msgBytes[20] = 0
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrInvalidUsername, err, "Incorrect error.")
+
+	// the password is binary data, so the same bytes are fine
+	msgBytes[20] = 's'
+
+	msg := NewConnectMessage()
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "user", string(msg.Username()), "Incorrect username.")
+
+	assert.Equal(t, true, []byte{0xff, 0}, msg.Password(), "Incorrect password.")
+}
+
+// test that the will message and password are binary data, while the will topic and
+// user name must be valid UTF-8
+func TestConnectMessageBinaryFields(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		32,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		196, // connect flags 11000100, username = 1, password = 1, will flag = 1
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		3,   // Client ID LSB (3)
+		'c', 'i', 'd',
+		0, // Will Topic MSB (0)
+		3, // Will Topic LSB (3)
+		'a', '/', 'b',
+		0, // Will Message MSB (0)
+		3, // Will Message LSB (3)
+		0xff, 0, 0xfe,
+		0, // Username MSB (0)
+		1, // Username LSB (1)
+		'u',
+		0, // Password MSB (0)
+		2, // Password LSB (2)
+		0xc0, 0xff,
+	}
+
+	msg := NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetClientId([]byte("cid"))
+	msg.SetKeepAlive(10)
+	msg.SetWillTopic([]byte("a/b"))
+	msg.SetWillMessage([]byte{0xff, 0, 0xfe})
+	msg.SetUsername([]byte("u"))
+	msg.SetPassword([]byte{0xc0, 0xff})
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewConnectMessage()
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []byte{0xff, 0, 0xfe}, msg.WillMessage(), "Incorrect will message.")
+
+	assert.Equal(t, true, []byte{0xc0, 0xff}, msg.Password(), "Incorrect password.")
+
+	// invalid UTF-8 in the will topic
+	msgBytes[20] = 0xff
+
+	_, err = NewConnectMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg.willTopic = []byte{'a', 0xff}
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+}
+
+func TestConnectMessageAccept(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(0x4)
+
+	ack := msg.Accept(true)
+	assert.Equal(t, true, byte(0x4), ack.Version(), "Incorrect version.")
+	assert.Equal(t, true, ConnectionAccepted, ack.ReturnCode(), "Incorrect return code.")
+	assert.True(t, true, ack.SessionPresent(), "Session present should be set.")
+
+	dst, _, err := ack.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 1, 0}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// clean session
+	msg.SetCleanSession(true)
+
+	ack = msg.Accept(true)
+	assert.False(t, true, ack.SessionPresent(), "Session present should be cleared with clean session.")
+
+	// version 3 has no session present flag
+	msg.SetCleanSession(false)
+	msg.SetVersion(0x3)
+
+	ack = msg.Accept(true)
+	assert.Equal(t, true, byte(0x3), ack.Version(), "Incorrect version.")
+	assert.False(t, true, ack.SessionPresent(), "Session present should be cleared for version 3.")
+
+	// version 5
+	msg.SetVersion(0x5)
+
+	ack = msg.Accept(true)
+	assert.Equal(t, true, byte(0x5), ack.Version(), "Incorrect version.")
+
+	dst, _, err = ack.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 3, 1, 0, 0}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+}
+
+func TestConnectMessageRefuse(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(0x4)
+
+	ack := msg.Refuse(NotAuthorized)
+	assert.Equal(t, true, byte(0x4), ack.Version(), "Incorrect version.")
+	assert.Equal(t, true, NotAuthorized, ack.ReturnCode(), "Incorrect return code.")
+	assert.False(t, true, ack.SessionPresent(), "Session present should not be set.")
+	assert.Equal(t, true, ErrNotAuthorized, ack.AsError(), "Incorrect error.")
+
+	dst, _, err := ack.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 0, 5}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// version 5 uses the reason code
+	msg.SetVersion(0x5)
+
+	ack = msg.Refuse(NotAuthorized)
+	assert.Equal(t, true, ConnackCode(ReasonNotAuthorized), ack.ReturnCode(), "Incorrect return code.")
+	assert.Equal(t, true, ErrNotAuthorized, ack.AsError(), "Incorrect error.")
+
+	dst, _, err = ack.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 3, 0, byte(ReasonNotAuthorized), 0}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+}
+
+func TestConnectMessageWillMessageString(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetWillTopic([]byte("will"))
+	msg.SetWillMessageString("send me home")
+
+	assert.True(t, true, msg.WillFlag(), "Will flag not set.")
+
+	assert.Equal(t, true, []byte("send me home"), msg.WillMessage(), "Incorrect will message.")
+
+	src, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	msg2 := NewConnectMessage()
+
+	_, err = msg2.Decode(src)
+	assert.NoError(t, true, err, "Error decoding message.")
 
-	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
+	assert.Equal(t, true, "send me home", msg2.WillMessageString(), "Incorrect will message.")
 }
@@ -0,0 +1,706 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrByteBudgetExceeded is returned by LimitedDecoder when reading the next message
+	// would take the total number of bytes read past the budget.
+	ErrByteBudgetExceeded = errors.New("Byte budget exceeded")
+
+	// ErrInvalidDirection is returned by Decoder when the message type is not one the
+	// peer is allowed to send, e.g., a CONNACK sent by a Client. See
+	// Decoder.FromClient and Decoder.FromServer.
+	ErrInvalidDirection = errors.New("Message type not allowed in this direction")
+)
+
+// DecodeError is returned when a message cannot be decoded because a field is
+// truncated or malformed. It records where in the packet the failure occurred,
+// which helps when debugging interoperability problems.
+type DecodeError struct {
+	// Offset is the byte offset, relative to the start of the packet, where decoding
+	// failed.
+	Offset int
+
+	// Err is the underlying error.
+	Err error
+
+	// remaining is the number of bytes from where decoding failed to the end of the
+	// packet. It's used to calculate Offset once the length of the fixed header is
+	// known, and is -1 once Offset is set.
+	remaining int
+}
+
+// Error returns the underlying error message, including the offset.
+func (this *DecodeError) Error() string {
+	return fmt.Sprintf("%v (offset %d)", this.Err, this.Offset)
+}
+
+// LengthError is returned when the remaining length in the fixed header of a
+// message doesn't match the number of bytes used by its fields, which usually
+// means the packet was corrupted or cut short.
+type LengthError struct {
+	// Type is the type of the message.
+	Type MessageType
+
+	// Declared is the remaining length in the fixed header.
+	Declared int
+
+	// Consumed is the number of bytes of the remaining length used by the fields of
+	// the message.
+	Consumed int
+}
+
+// Error returns both lengths, e.g., "CONNECT message remaining length mismatch:
+// declared 60, consumed 58".
+func (this *LengthError) Error() string {
+	return fmt.Sprintf("%s message remaining length mismatch: declared %d, consumed %d", this.Type.Name(), this.Declared, this.Consumed)
+}
+
+// newDecodeError returns a DecodeError for a failure at the current read position
+// of buf.
+func newDecodeError(buf *bytes.Buffer, err error) error {
+	return &DecodeError{Err: err, remaining: buf.Len()}
+}
+
+// shiftDecodeError adjusts a DecodeError returned while decoding a part of the
+// message that's followed by n more bytes.
+func shiftDecodeError(err error, n int) error {
+	if de, ok := err.(*DecodeError); ok && de.remaining >= 0 {
+		de.remaining += n
+	}
+
+	return err
+}
+
+// ProtocolError is returned when a message is well-formed, but breaks a rule of the
+// MQTT spec, e.g., a SUBSCRIBE message with a packet ID of 0. DisconnectReason maps
+// it to ReasonProtocolError.
+type ProtocolError struct {
+	// Msg is the error message, which starts with the function that returned it.
+	Msg string
+}
+
+// Error returns the error message.
+func (this *ProtocolError) Error() string {
+	return this.Msg
+}
+
+// protocolError returns a ProtocolError for the violation described by format and
+// args, e.g., protocolError("subscribe/Decode", "Empty topic list").
+func protocolError(fn, format string, args ...interface{}) error {
+	return &ProtocolError{Msg: fn + ": Protocol violation: " + fmt.Sprintf(format, args...)}
+}
+
+// Decoder reads and decodes messages from an input stream, such as a network
+// connection.
+type Decoder struct {
+	src io.Reader
+
+	// Version is the protocol version of the messages other than CONNECT, which
+	// carries its own. It's set to the version of every CONNECT message decoded, so a
+	// Server decoding the messages of a Client doesn't need to set it. A Client sets
+	// it to the version of the CONNECT message it sent. If it's 0, the messages are
+	// decoded as version 0x4, i.e., without properties.
+	Version byte
+
+	// Strict causes Decode to return a LengthError if a message has bytes left over
+	// after its last field, i.e., the remaining length in the fixed header is larger
+	// than the number of bytes used by the message. CONNECT messages are always
+	// checked, and messages of types registered with RegisterMessageType never are.
+	Strict bool
+
+	// Lenient causes Decode to normalize CONNECT messages that set the Will QoS or
+	// Will Retain bits without the Will Flag, instead of returning an error. See
+	// ConnectMessage.SetLenient.
+	Lenient bool
+
+	// LenientWillRetain causes Decode to clear the Will Retain bit of CONNECT messages
+	// that set it without the Will Flag, instead of returning an error. See
+	// ConnectMessage.SetLenientWillRetain.
+	LenientWillRetain bool
+
+	// MaxTopics is the maximum number of topic filters in SUBSCRIBE and UNSUBSCRIBE
+	// messages. See SubscribeMessage.SetMaxTopics. 0 means there's no limit.
+	MaxTopics int
+
+	// MaxUserProperties is the maximum number of user properties in each properties
+	// section of version 5 messages. See Properties.SetMaxUserProperties. 0 means
+	// there's no limit.
+	MaxUserProperties int
+
+	// AcceptedVersions is the list of protocol versions accepted in CONNECT messages.
+	// See ConnectMessage.SetAcceptedVersions. If it's empty, all the versions in
+	// SupportedVersions are accepted.
+	AcceptedVersions []byte
+
+	// MaxQoS is the maximum QoS accepted in PUBLISH messages if LimitQoS is set. See
+	// PublishMessage.SetMaxQoS.
+	MaxQoS byte
+
+	// LimitQoS causes Decode to return ErrQosNotSupported for PUBLISH messages with a
+	// QoS larger than MaxQoS. It's a separate option as the zero value of MaxQoS is
+	// QosAtMostOnce, which is a valid limit.
+	LimitQoS bool
+
+	// FromClient causes Decode to return ErrInvalidDirection for the message types a
+	// Client never sends, see ValidFromClient. It's meant for a Server, which can then
+	// drop a misbehaving Client as soon as it reads the first byte of the message.
+	FromClient bool
+
+	// FromServer causes Decode to return ErrInvalidDirection for the message types a
+	// Server never sends, see ValidFromServer. It's meant for a Client.
+	FromServer bool
+}
+
+// NewDecoder creates a new Decoder that reads from src. The Decoder reads exactly
+// one message at a time, so it's safe to switch between the Decoder and reading
+// from src directly in between messages.
+func NewDecoder(src io.Reader) *Decoder {
+	return &Decoder{src: src}
+}
+
+// configure sets the options of the Decoder on a new message before it's decoded.
+// The receiver may be nil, in which case the defaults of the message are used.
+func (this *Decoder) configure(msg Message) {
+	if this == nil {
+		return
+	}
+
+	if _, ok := msg.(*ConnectMessage); !ok && this.Version != 0 {
+		if msg, ok := msg.(interface {
+			SetVersion(byte) error
+		}); ok {
+			msg.SetVersion(this.Version)
+		}
+	}
+
+	switch msg := msg.(type) {
+	case *ConnectMessage:
+		msg.SetLenient(this.Lenient)
+		msg.SetLenientWillRetain(this.LenientWillRetain)
+		msg.SetAcceptedVersions(this.AcceptedVersions)
+	case *SubscribeMessage:
+		msg.SetMaxTopics(this.MaxTopics)
+	case *UnsubscribeMessage:
+		msg.SetMaxTopics(this.MaxTopics)
+	case *PublishMessage:
+		if this.LimitQoS {
+			msg.SetMaxQoS(this.MaxQoS)
+		}
+	}
+
+	if msg, ok := msg.(interface {
+		Properties() *Properties
+	}); ok {
+		msg.Properties().SetMaxUserProperties(this.MaxUserProperties)
+	}
+
+	if msg, ok := msg.(*ConnectMessage); ok {
+		msg.WillProperties().SetMaxUserProperties(this.MaxUserProperties)
+	}
+}
+
+// checkDirection returns ErrInvalidDirection if the peer is not allowed to send
+// messages of the type. The receiver may be nil, in which case all types are allowed.
+func (this *Decoder) checkDirection(mtype MessageType) error {
+	if this == nil {
+		return nil
+	}
+
+	// AUTH is sent in both directions
+	if mtype.IsReserved() && !mtype.IsReservedFor(this.Version) {
+		return nil
+	}
+
+	if (this.FromClient && !ValidFromClient(mtype)) || (this.FromServer && !ValidFromServer(mtype)) {
+		return ErrInvalidDirection
+	}
+
+	return nil
+}
+
+// newMessage creates a new message of the type, the same as MessageType.New, except
+// that ErrAuthNotSupported is returned for the AUTH message of version 5, instead of
+// ErrReservedType. The receiver may be nil, in which case the version is unknown.
+func (this *Decoder) newMessage(mtype MessageType) (Message, error) {
+	msg, err := mtype.New()
+	if err == ErrReservedType && this != nil && !mtype.IsReservedFor(this.Version) {
+		return nil, ErrAuthNotSupported
+	}
+
+	return msg, err
+}
+
+// Decode reads and decodes the next message from the input stream. The second
+// return value is the number of bytes read. If an error is returned, then the
+// message should be considered invalid, and is only returned so the caller can tell
+// its type, the same as for DecodeMessage.
+func (this *Decoder) Decode() (Message, int, error) {
+	msg, n, err := decodeMessage(this.src, this)
+	if err != nil {
+		return msg, n, err
+	}
+
+	if err = this.checkStrict(msg); err != nil {
+		return msg, n, err
+	}
+
+	this.setVersion(msg)
+
+	return msg, n, nil
+}
+
+// setVersion sets the version of the messages that follow msg, if it's a CONNECT
+// message.
+func (this *Decoder) setVersion(msg Message) {
+	if msg, ok := msg.(*ConnectMessage); ok {
+		this.Version = msg.Version()
+	}
+}
+
+// checkStrict returns a LengthError if Strict is set and msg has bytes left over
+// after its last field. Messages of types registered with RegisterMessageType decode
+// their own fixed header, so they're not checked.
+func (this *Decoder) checkStrict(msg Message) error {
+	if !this.Strict {
+		return nil
+	}
+
+	if msg, ok := msg.(interface {
+		lengthError() error
+	}); ok {
+		return msg.lengthError()
+	}
+
+	return nil
+}
+
+// StreamDecoder is a push-based Decoder. Instead of reading from an input stream,
+// it's fed bytes as they are received with Write, and calls a function for every
+// message that's complete, buffering partial messages in between calls. This suits
+// event loops that don't have a goroutine blocked reading each connection.
+//
+// The options of the embedded Decoder apply to every message decoded.
+type StreamDecoder struct {
+	Decoder
+
+	// MaxPacketSize is the maximum size in bytes of a message, including the fixed
+	// header. Write returns ErrPacketTooLarge as soon as the fixed header of a larger
+	// message is complete, so the rest of it is never buffered. 0 means there's no
+	// limit, which lets a single fixed header make the StreamDecoder buffer up to 256
+	// MB.
+	MaxPacketSize uint32
+
+	fn  func(Message) error
+	buf []byte
+	err error
+}
+
+// NewStreamDecoder creates a new StreamDecoder that calls fn for every message
+// decoded.
+func NewStreamDecoder(fn func(Message) error) *StreamDecoder {
+	return &StreamDecoder{fn: fn}
+}
+
+// Write decodes the messages completed by p, and calls fn for each of them in
+// order. Bytes of a trailing partial message are kept until the next call to Write.
+// Write stops at the first error returned by either decoding or fn, and returns that
+// error. The rest of the stream can't be decoded after an error, as there is no way
+// to tell where the next message starts, so every subsequent call to Write returns
+// the same error. Write always reports len(p) bytes written if the error is nil,
+// which means StreamDecoder can be used as an io.Writer, e.g., with io.Copy.
+func (this *StreamDecoder) Write(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	b := p
+	if len(this.buf) > 0 {
+		this.buf = append(this.buf, p...)
+		b = this.buf
+	}
+
+	packets, off, err := FramePackets(b)
+
+	for _, pkt := range packets {
+		if err := this.decode(pkt); err != nil {
+			this.err = err
+			return 0, err
+		}
+	}
+
+	if err == nil {
+		err = this.checkSize(b[off:])
+	}
+
+	if err != nil {
+		this.err = err
+		return 0, err
+	}
+
+	// Keep the partial message, reusing the buffer once it's been decoded
+	this.buf = append(this.buf[:0], b[off:]...)
+
+	return len(p), nil
+}
+
+// Buffered returns the number of bytes of a partial message waiting for the rest of
+// the message.
+func (this *StreamDecoder) Buffered() int {
+	return len(this.buf)
+}
+
+// checkSize returns ErrPacketTooLarge if the message starting at b is larger than
+// MaxPacketSize. The message may be partial, in which case it's only checked once
+// its fixed header is complete.
+func (this *StreamDecoder) checkSize(b []byte) error {
+	if this.MaxPacketSize == 0 || len(b) < 2 {
+		return nil
+	}
+
+	// A malformed remaining length is returned by FramePackets instead
+	remlen, m, err := sliceVarint32(b[1:])
+	if err != nil {
+		return nil
+	}
+
+	if int64(1+m)+int64(remlen) > int64(this.MaxPacketSize) {
+		return ErrPacketTooLarge
+	}
+
+	return nil
+}
+
+func (this *StreamDecoder) decode(b []byte) error {
+	if err := this.checkSize(b); err != nil {
+		return err
+	}
+
+	if err := this.checkDirection(MessageType(b[0] >> 4)); err != nil {
+		return err
+	}
+
+	msg, err := this.newMessage(MessageType(b[0] >> 4))
+	if err != nil {
+		return err
+	}
+
+	this.configure(msg)
+
+	if _, err = msg.Decode(&sliceReader{b: b}); err != nil {
+		return err
+	}
+
+	if err = this.checkStrict(msg); err != nil {
+		return err
+	}
+
+	this.setVersion(msg)
+
+	return this.fn(msg)
+}
+
+// ScanPackets decodes the messages in src one after another until EOF, and calls fn
+// for each message. It stops at the first error returned by either decoding or fn,
+// and returns that error. Reaching EOF in between messages is not an error, whereas
+// reaching EOF in the middle of a message returns io.ErrUnexpectedEOF.
+func ScanPackets(src io.Reader, fn func(Message) error) error {
+	d := NewDecoder(src)
+
+	for {
+		msg, n, err := d.Decode()
+		if err == io.EOF {
+			if n == 0 {
+				return nil
+			}
+
+			return io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// LimitedDecoder is a Decoder that stops reading from the input stream once the
+// total number of bytes read reaches a budget. This bounds the bytes read over the
+// whole connection, e.g., to detect clients that keep a connection open by sending
+// a slow trickle of messages, as opposed to limiting the size of each message.
+type LimitedDecoder struct {
+	Decoder
+
+	r budgetReader
+}
+
+// NewLimitedDecoder creates a new LimitedDecoder that reads at most budget bytes
+// from src. Once the budget is used up, Decode returns ErrByteBudgetExceeded,
+// including for a message that is only partially read before reaching the budget.
+func NewLimitedDecoder(src io.Reader, budget int64) *LimitedDecoder {
+	d := &LimitedDecoder{r: budgetReader{src: src, n: budget}}
+	d.src = &d.r
+
+	return d
+}
+
+// Total returns the number of bytes read from the input stream so far.
+func (this *LimitedDecoder) Total() int64 {
+	return this.r.total
+}
+
+// Remaining returns the number of bytes that can still be read before the budget
+// is exceeded.
+func (this *LimitedDecoder) Remaining() int64 {
+	return this.r.n
+}
+
+// budgetReader reads from src until n bytes are left, then returns
+// ErrByteBudgetExceeded.
+type budgetReader struct {
+	src   io.Reader
+	n     int64
+	total int64
+}
+
+func (this *budgetReader) Read(p []byte) (int, error) {
+	if this.n <= 0 {
+		return 0, ErrByteBudgetExceeded
+	}
+
+	if int64(len(p)) > this.n {
+		p = p[:this.n]
+	}
+
+	n, err := this.src.Read(p)
+	this.n -= int64(n)
+	this.total += int64(n)
+
+	return n, err
+}
+
+// DecodeMessage reads a single message from the io.Reader, without the caller having
+// to know the message type in advance. The type is determined from the first byte of
+// the fixed header, and a new message of that type is created and decoded. The second
+// return value is the number of bytes read from io.Reader. If an error is returned,
+// then the message should be considered invalid. However, if the error occurs after
+// the message type is read, e.g., the body of the message is malformed, the message
+// is still returned, so the caller can tell which type of message failed to decode,
+// e.g., for logging. Otherwise the message is nil.
+//
+// If src is a *bufio.Reader, the fixed header is peeked at and the whole message is
+// read from the buffer at once, instead of reading the header one byte at a time.
+// Bytes after the message are left in the bufio.Reader, so it can be shared with
+// other readers in between messages.
+func DecodeMessage(src io.Reader) (Message, int, error) {
+	return decodeMessage(src, nil)
+}
+
+func decodeMessage(src io.Reader, d *Decoder) (Message, int, error) {
+	if br, ok := src.(*bufio.Reader); ok {
+		return decodeBuffered(br, d)
+	}
+
+	var b [1]byte
+
+	if _, err := io.ReadFull(src, b[:]); err != nil {
+		return nil, 0, err
+	}
+
+	if err := d.checkDirection(MessageType(b[0] >> 4)); err != nil {
+		return nil, 1, err
+	}
+
+	msg, err := d.newMessage(MessageType(b[0] >> 4))
+	if err != nil {
+		return nil, 1, err
+	}
+
+	d.configure(msg)
+
+	n, err := msg.Decode(io.MultiReader(bytes.NewReader(b[:]), src))
+
+	return msg, n, err
+}
+
+// DecodeInto reads a single message from the io.Reader into an existing message,
+// such as one that's reused for every message of a type the caller expects, which
+// avoids allocating a new message every time. An error is returned if the type of
+// the message read does not match the type of msg. The first byte of the fixed header
+// is read from io.Reader even if the types don't match. The first return value is
+// the number of bytes read from io.Reader.
+func DecodeInto(msg Message, src io.Reader) (int, error) {
+	var b [1]byte
+
+	if _, err := io.ReadFull(src, b[:]); err != nil {
+		return 0, err
+	}
+
+	if mtype := MessageType(b[0] >> 4); mtype != msg.Type() {
+		return 1, fmt.Errorf("decoder/DecodeInto: Invalid message type %s. Expecting %s.", mtype.Name(), msg.Name())
+	}
+
+	return msg.Decode(io.MultiReader(bytes.NewReader(b[:]), src))
+}
+
+// decodeBuffered decodes a message from the bufio.Reader without consuming any bytes
+// until the whole message is available in the buffer. Messages larger than the
+// buffer, and malformed fixed headers, are decoded by reading from br directly, so
+// the errors are the same as for any other io.Reader.
+func decodeBuffered(br *bufio.Reader, d *Decoder) (Message, int, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err = d.checkDirection(MessageType(b[0] >> 4)); err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := d.newMessage(MessageType(b[0] >> 4))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	d.configure(msg)
+
+	// Peek at the remaining length, which is at most 4 bytes after the first byte
+	var remlen, i int
+
+	for i = 1; i <= 4; i++ {
+		if b, err = br.Peek(i + 1); err != nil {
+			break
+		}
+
+		remlen |= int(b[i]&0x7f) << (7 * uint(i-1))
+
+		if b[i] < 0x80 {
+			break
+		}
+	}
+
+	total := i + 1 + remlen
+
+	if err == nil && i <= 4 && total <= br.Size() {
+		b, err = br.Peek(total)
+	}
+
+	if err != nil || i > 4 || total > br.Size() {
+		n, err := msg.Decode(br)
+
+		return msg, n, err
+	}
+
+	// The whole message has been read from the buffer either way, as Decode copies
+	// the whole message before decoding it.
+	_, err = msg.Decode(bytes.NewReader(b))
+	n, _ := br.Discard(total)
+
+	return msg, n, err
+}
+
+// DecodeBytes decodes a single message from the beginning of the byte slice. The
+// second return value is the number of bytes consumed, so the caller can slice off
+// the decoded message and continue with the next one. If an error is returned,
+// then the message should be considered invalid, as for DecodeMessage. The message
+// is copied, so b can be reused once DecodeBytes returns. It's the same as
+// DecodeBuffer(b, false).
+func DecodeBytes(b []byte) (Message, int, error) {
+	return DecodeBuffer(b, false)
+}
+
+// DecodeBuffer is like DecodeBytes, except that if alias is true, the message is not
+// copied. Instead, the byte slices returned by the message, such as the topic or the
+// payload, point into b, which avoids copying the message at all for a broker that
+// reads whole packets into a buffer first. In this case, b MUST NOT be modified or
+// reused as long as the message is in use, and Release does not return b to the pool.
+func DecodeBuffer(b []byte, alias bool) (Message, int, error) {
+	if len(b) == 0 {
+		return nil, 0, io.EOF
+	}
+
+	msg, err := MessageType(b[0] >> 4).New()
+	if err != nil {
+		return nil, 1, err
+	}
+
+	src := &sliceReader{b: b, alias: alias}
+
+	_, err = msg.Decode(src)
+
+	return msg, src.off, err
+}
+
+// FramePackets splits b into the packets it contains, using the remaining length in
+// the fixed header of each packet to find where the next one starts, without decoding
+// the packets. The slices returned point into b. The second return value is the
+// offset of the first byte after the last complete packet, which is where a trailing
+// partial packet starts, or len(b) if there is none. The transport can keep the bytes
+// from that offset on, and call FramePackets again once more bytes are received. An
+// error is returned if a remaining length is malformed, in which case the offset is
+// where the malformed packet starts.
+func FramePackets(b []byte) ([][]byte, int, error) {
+	var packets [][]byte
+	off := 0
+
+	for off < len(b) {
+		remlen, m, err := sliceVarint32(b[off+1:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return packets, off, err
+		}
+
+		n := 1 + m + int(remlen)
+		if off+n > len(b) {
+			break
+		}
+
+		packets = append(packets, b[off:off+n:off+n])
+		off += n
+	}
+
+	return packets, off, nil
+}
+
+// sliceReader is an io.Reader that reads from a byte slice. The fixed header decodes
+// the message from the slice directly, without reading it through the io.Reader.
+type sliceReader struct {
+	b     []byte
+	off   int
+	alias bool
+}
+
+func (this *sliceReader) Read(p []byte) (int, error) {
+	if this.off >= len(this.b) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, this.b[this.off:])
+	this.off += n
+
+	return n, nil
+}
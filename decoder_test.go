@@ -0,0 +1,1192 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestDecodeBytes(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		23,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	msg, n, err := DecodeBytes(msgBytes)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 25, n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, PUBLISH, msg.Type(), "Incorrect message type.")
+
+	assert.Equal(t, true, "surgemq", string(msg.(*PublishMessage).Topic()), "Incorrect topic name.")
+
+	msg, n, err = DecodeBytes(msgBytes[n:])
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 4, n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, PUBACK, msg.Type(), "Incorrect message type.")
+
+	assert.Equal(t, true, 7, msg.(*PubackMessage).PacketId(), "Incorrect packet ID.")
+}
+
+// test truncated and invalid buffers
+func TestDecodeBytes2(t *testing.T) {
+	_, n, err := DecodeBytes([]byte{})
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 0, n, "Incorrect bytes decoded.")
+
+	_, _, err = DecodeBytes([]byte{byte(PUBACK << 4), 2, 0})
+	assert.Error(t, true, err)
+
+	_, n, err = DecodeBytes([]byte{byte(RESERVED << 4), 0})
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 1, n, "Incorrect bytes decoded.")
+}
+
+// test that the decoded message aliases the input only if asked to
+func TestDecodeBuffer(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		21,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	poisonOnRelease = true
+	defer func() { poisonOnRelease = false }()
+
+	b := append([]byte{}, msgBytes...)
+
+	msg, n, err := DecodeBuffer(b, false)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	b[4] = 'S'
+
+	assert.Equal(t, true, "surgemq", string(msg.(*PublishMessage).Topic()), "Topic should be copied.")
+
+	b = append([]byte{}, msgBytes...)
+
+	msg, n, err = DecodeBuffer(b, true)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	b[4] = 'S'
+
+	assert.Equal(t, true, "Surgemq", string(msg.(*PublishMessage).Topic()), "Topic should alias the input.")
+
+	// the input is not poisoned or written to by Release, Encode or another Decode
+	msg.Release()
+
+	assert.Equal(t, true, "Surgemq", string(b[4:11]), "Input should not change on Release.")
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, "Surgemq", string(b[4:11]), "Input should not change on Decode.")
+
+	// the same errors and bytes consumed as DecodeMessage
+	tests := [][]byte{
+		{byte(PUBACK << 4), 2, 0},
+		{byte(PUBACK << 4), 0x80},
+		{byte(PUBACK<<4) | 1, 2, 0, 1},
+		{byte(PUBACK << 4), 0xff, 0xff, 0xff, 0xff, 0},
+	}
+
+	for _, test := range tests {
+		_, n, err := DecodeBuffer(test, true)
+		assert.Error(t, true, err)
+
+		src := bytes.NewReader(test)
+
+		_, _, err2 := DecodeMessage(src)
+		assert.Equal(t, true, err2.Error(), err.Error(), "Incorrect error.")
+
+		assert.Equal(t, true, len(test)-src.Len(), n, "Incorrect bytes decoded.")
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		3,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // extra byte
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 7, msg.(*PubackMessage).PacketId(), "Incorrect packet ID.")
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Strict = true
+
+	_, _, err = d.Decode()
+	assert.Error(t, true, err)
+
+	le, ok := err.(*LengthError)
+	assert.True(t, true, ok, "Incorrect error type.")
+	assert.Equal(t, true, 3, le.Declared, "Incorrect declared length.")
+	assert.Equal(t, true, 2, le.Consumed, "Incorrect consumed length.")
+}
+
+func TestDecoderStrict2(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		4,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		1, // return code 1
+		2, // return code 2
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Strict = true
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []byte{1, 2}, msg.(*SubackMessage).ReturnCodes(), "Incorrect return codes.")
+
+	// Every byte after the packet ID of a SUBACK is a return code, so an extra byte
+	// can only be caught as an invalid return code.
+	msgBytes = []byte{
+		byte(SUBACK << 4),
+		5,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		1,    // return code 1
+		2,    // return code 2
+		0xff, // extra byte
+	}
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Strict = true
+
+	_, _, err = d.Decode()
+	assert.Error(t, true, err)
+}
+
+// test multiple messages in the same stream
+func TestDecoderDecode(t *testing.T) {
+	msgBytes := []byte{
+		byte(PINGREQ << 4),
+		0,
+		byte(PUBREL<<4) | 2,
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		byte(DISCONNECT << 4),
+		0,
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Strict = true
+
+	for _, mtype := range []MessageType{PINGREQ, PUBREL, DISCONNECT} {
+		msg, _, err := d.Decode()
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		assert.Equal(t, true, mtype, msg.Type(), "Incorrect message type.")
+	}
+
+	_, _, err := d.Decode()
+	assert.Equal(t, true, io.EOF, err, "Expecting EOF.")
+}
+
+// test the maximum number of user properties in version 5 messages
+func TestDecoderMaxUserProperties(t *testing.T) {
+	publishBytes := []byte{
+		byte(PUBLISH << 4),
+		22,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u', 'r',
+		14,                         // properties length (14)
+		0x26, 0, 1, 'a', 0, 1, '1', // a=1
+		0x26, 0, 1, 'b', 0, 1, '2', // b=2
+		'h', 'i',
+	}
+
+	subscribeBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		23,
+		0,                          // packet ID MSB (0)
+		7,                          // packet ID LSB (7)
+		14,                         // properties length (14)
+		0x26, 0, 1, 'a', 0, 1, '1', // a=1
+		0x26, 0, 1, 'b', 0, 1, '2', // b=2
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		's', 'u', 'r',
+		1, // subscription options, QoS 1
+	}
+
+	for _, msgBytes := range [][]byte{publishBytes, subscribeBytes} {
+		d := NewDecoder(bytes.NewBuffer(msgBytes))
+		d.Version = 0x5
+		d.MaxUserProperties = 1
+
+		_, _, err := d.Decode()
+		assert.Equal(t, true, ErrTooManyUserProperties, err, "Incorrect error.")
+
+		d = NewDecoder(bytes.NewBuffer(msgBytes))
+		d.Version = 0x5
+		d.MaxUserProperties = 2
+
+		msg, _, err := d.Decode()
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		assert.Equal(t, true, 2, len(msg.(interface {
+			Properties() *Properties
+		}).Properties().UserProperties()), "Incorrect number of user properties.")
+	}
+}
+
+// test taking the version from the CONNECT message
+func TestDecoderVersion(t *testing.T) {
+	connectBytes := []byte{
+		byte(CONNECT << 4),
+		14,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		5,  // Protocol level 5
+		2,  // connect flags 00000010, clean session
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // properties length (0)
+		0,  // Client ID MSB (0)
+		1,  // Client ID LSB (1)
+		'c',
+	}
+
+	publishBytes := []byte{
+		byte(PUBLISH << 4),
+		8,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u', 'r',
+		0, // properties length (0)
+		'h', 'i',
+	}
+
+	var msgs []Message
+
+	err := ScanPackets(bytes.NewBuffer(append(connectBytes, publishBytes...)), func(msg Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	assert.NoError(t, true, err, "Error decoding messages.")
+
+	assert.Equal(t, true, 2, len(msgs), "Incorrect number of messages.")
+
+	assert.Equal(t, true, 0x5, msgs[1].(*PublishMessage).Version(), "Incorrect version.")
+
+	assert.Equal(t, true, "hi", string(msgs[1].(*PublishMessage).Payload()), "Incorrect payload.")
+
+	msgs = nil
+
+	sd := NewStreamDecoder(func(msg Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+
+	_, err = sd.Write(append(connectBytes, publishBytes...))
+	assert.NoError(t, true, err, "Error decoding messages.")
+
+	assert.Equal(t, true, 2, len(msgs), "Incorrect number of messages.")
+
+	assert.Equal(t, true, "hi", string(msgs[1].(*PublishMessage).Payload()), "Incorrect payload.")
+}
+
+func TestDecoderLenient(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		15,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		34, // connect flags 00100010, will retain = 1, will flag = 0
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		3,  // Client ID LSB (3)
+		'c', 'i', 'd',
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+
+	_, _, err := d.Decode()
+	assert.Error(t, true, err)
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Lenient = true
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.False(t, true, msg.(*ConnectMessage).WillRetain(), "Incorrect will retain.")
+}
+
+// test the offset reported for malformed remaining length and properties
+func TestDecodeError(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		0xff, 0xff, 0xff, 0xff, // remaining length with continuation bit in 4th byte
+	}
+
+	_, _, err := DecodeBytes(msgBytes)
+
+	de, ok := err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, 4, de.Offset, "Incorrect offset.")
+
+	msgBytes = []byte{
+		byte(CONNACK << 4),
+		7,
+		0,    // session present
+		0,    // return code
+		4,    // properties length
+		0x21, // receive maximum
+		0, 1, // receive maximum (1)
+		0x22, // topic alias maximum, missing value
+	}
+
+	msg := NewConnackMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+
+	de, ok = err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, 9, de.Offset, "Incorrect offset.")
+}
+
+// test decoding from a bufio.Reader, including a message larger than the buffer
+func TestDecodeMessageBufio(t *testing.T) {
+	var src bytes.Buffer
+
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetPayload(bytes.Repeat([]byte{'a'}, 100))
+
+	r, _, err := pub.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	src.Write([]byte{byte(PUBREL<<4) | 2, 2, 0, 7})
+	io.Copy(&src, r)
+	src.Write([]byte{byte(PINGREQ << 4), 0, 'x'})
+
+	br := bufio.NewReaderSize(&src, 16)
+
+	msg, n, err := DecodeMessage(br)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 4, n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, 7, msg.(*PubrelMessage).PacketId(), "Incorrect packet ID.")
+
+	msg, _, err = DecodeMessage(br)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, pub.Payload(), msg.(*PublishMessage).Payload(), "Incorrect payload.")
+
+	msg, n, err = DecodeMessage(br)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, PINGREQ, msg.Type(), "Incorrect message type.")
+
+	assert.Equal(t, true, 2, n, "Incorrect bytes decoded.")
+
+	b, err := br.ReadByte()
+	assert.NoError(t, true, err, "Error reading byte.")
+
+	assert.Equal(t, true, 'x', b, "Incorrect byte left in buffer.")
+
+	// truncated message
+	br = bufio.NewReader(bytes.NewBuffer([]byte{byte(PUBREL<<4) | 2, 2, 0}))
+
+	_, _, err = DecodeMessage(br)
+	assert.Error(t, true, err)
+}
+
+func benchmarkDecodeMessage(b *testing.B, buffered bool) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/benchmark"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(bytes.Repeat([]byte{'a'}, 256))
+
+	r, _, err := msg.Encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	msgBytes := r.(*bytes.Buffer).Bytes()
+	src := bytes.NewReader(bytes.Repeat(msgBytes, 1000))
+
+	var br *bufio.Reader
+	if buffered {
+		br = bufio.NewReader(src)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msgBytes)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			src.Seek(0, 0)
+			if buffered {
+				br.Reset(src)
+			}
+		}
+
+		var err error
+		if buffered {
+			_, _, err = DecodeMessage(br)
+		} else {
+			_, _, err = DecodeMessage(src)
+		}
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	benchmarkDecodeMessage(b, false)
+}
+
+func BenchmarkDecodeMessageBufio(b *testing.B) {
+	benchmarkDecodeMessage(b, true)
+}
+
+func benchmarkDecodeBuffer(b *testing.B, alias bool) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/benchmark"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(bytes.Repeat([]byte{'a'}, 256))
+
+	msgBytes, err := msg.AppendTo(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	src := bytes.Repeat(msgBytes, 1000)
+	off := 0
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msgBytes)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			off = 0
+		}
+
+		_, n, err := DecodeBuffer(src[off:], alias)
+		if err != nil {
+			b.Fatal(err)
+		}
+		off += n
+	}
+}
+
+func BenchmarkDecodeBuffer(b *testing.B) {
+	benchmarkDecodeBuffer(b, false)
+}
+
+func BenchmarkDecodeBufferAlias(b *testing.B) {
+	benchmarkDecodeBuffer(b, true)
+}
+
+// test decoding into a reused message
+func TestDecodeInto(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		13,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		'h', 'i',
+		byte(PUBLISH << 4),
+		8,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		'y', 'o', 'u',
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	src := bytes.NewBuffer(msgBytes)
+	msg := NewPublishMessage()
+
+	n, err := DecodeInto(msg, src)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 15, n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, 7, msg.PacketId(), "Incorrect packet ID.")
+
+	assert.Equal(t, true, "hi", string(msg.Payload()), "Incorrect payload.")
+
+	_, err = DecodeInto(msg, src)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "a/b", string(msg.Topic()), "Incorrect topic.")
+
+	assert.Equal(t, true, 0, msg.PacketId(), "Incorrect packet ID.")
+
+	assert.Equal(t, true, "you", string(msg.Payload()), "Incorrect payload.")
+
+	n, err = DecodeInto(msg, src)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 1, n, "Incorrect bytes read.")
+}
+
+func TestLimitedDecoder(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		8, // packet ID LSB (8)
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		9, // packet ID LSB (9)
+	}
+
+	d := NewLimitedDecoder(bytes.NewBuffer(msgBytes), 10)
+
+	for _, id := range []uint16{7, 8} {
+		msg, _, err := d.Decode()
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		assert.Equal(t, true, id, msg.(*PubackMessage).PacketId(), "Incorrect packet ID.")
+	}
+
+	assert.Equal(t, true, 8, d.Total(), "Incorrect total bytes read.")
+
+	assert.Equal(t, true, 2, d.Remaining(), "Incorrect remaining bytes.")
+
+	// the third message is only partially read
+	_, _, err := d.Decode()
+	assert.Equal(t, true, ErrByteBudgetExceeded, err, "Incorrect error.")
+
+	assert.Equal(t, true, 10, d.Total(), "Incorrect total bytes read.")
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrByteBudgetExceeded, err, "Incorrect error.")
+}
+
+func TestScanPackets(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNACK << 4),
+		2,
+		0, // session present
+		0, // return code
+		byte(PUBLISH << 4),
+		8,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		'y', 'o', 'u',
+		byte(SUBACK << 4),
+		3,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		1, // return code 1
+		byte(PINGRESP << 4),
+		0,
+	}
+
+	var mtypes []MessageType
+
+	err := ScanPackets(bytes.NewBuffer(msgBytes), func(msg Message) error {
+		mtypes = append(mtypes, msg.Type())
+		return nil
+	})
+	assert.NoError(t, true, err, "Error scanning packets.")
+
+	assert.Equal(t, true, []MessageType{CONNACK, PUBLISH, SUBACK, PINGRESP}, mtypes, "Incorrect message types.")
+
+	// stop on callback error
+	errStop := errors.New("stop")
+	count := 0
+
+	err = ScanPackets(bytes.NewBuffer(msgBytes), func(msg Message) error {
+		count++
+		if msg.Type() == PUBLISH {
+			return errStop
+		}
+		return nil
+	})
+	assert.Equal(t, true, errStop, err, "Incorrect error.")
+
+	assert.Equal(t, true, 2, count, "Incorrect number of messages.")
+
+	// truncated last message
+	err = ScanPackets(bytes.NewBuffer(msgBytes[:15]), func(msg Message) error {
+		return nil
+	})
+	assert.Error(t, true, err)
+
+	// invalid message type
+	err = ScanPackets(bytes.NewBuffer([]byte{byte(RESERVED << 4), 0}), func(msg Message) error {
+		return nil
+	})
+	assert.Error(t, true, err)
+}
+
+// test that the message is returned with its type when the body fails to decode
+func TestDecodeMessageBodyError(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		7,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		7, // topic name LSB (7), but only 3 bytes follow
+		's', 'u', 'r',
+	}
+
+	msg, n, err := DecodeMessage(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	assert.True(t, true, msg != nil, "Expecting message.")
+
+	assert.Equal(t, true, SUBSCRIBE, msg.Type(), "Incorrect message type.")
+
+	msg, _, err = DecodeMessage(bufio.NewReader(bytes.NewBuffer(msgBytes)))
+	assert.Error(t, true, err)
+
+	assert.True(t, true, msg != nil, "Expecting message.")
+
+	assert.Equal(t, true, SUBSCRIBE, msg.Type(), "Incorrect message type.")
+
+	msg, _, err = NewDecoder(bytes.NewBuffer(msgBytes)).Decode()
+	assert.Error(t, true, err)
+
+	assert.True(t, true, msg != nil, "Expecting message.")
+
+	assert.Equal(t, true, SUBSCRIBE, msg.Type(), "Incorrect message type.")
+
+	// the type can't be determined
+	msg, _, err = DecodeMessage(bytes.NewBuffer([]byte{byte(RESERVED << 4), 0}))
+	assert.Error(t, true, err)
+
+	assert.True(t, true, msg == nil, "Expecting no message.")
+}
+
+// stubMessage is a message of the reserved type RESERVED2, which carries a payload
+// of opaque bytes.
+type stubMessage struct {
+	payload []byte
+}
+
+func (this *stubMessage) Name() string      { return "STUB" }
+func (this *stubMessage) Desc() string      { return "Stub message" }
+func (this *stubMessage) Type() MessageType { return RESERVED2 }
+func (this *stubMessage) Release()          {}
+
+func (this *stubMessage) Respond() (Message, bool) { return nil, false }
+
+func (this *stubMessage) SizeParts() (int, int) {
+	return FixedHeaderLen(int32(len(this.payload))), len(this.payload)
+}
+
+func (this *stubMessage) Encode() (io.Reader, int, error) {
+	b, err := this.AppendTo(nil)
+	return bytes.NewBuffer(b), len(b), err
+}
+
+func (this *stubMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	buf.WriteByte(byte(RESERVED2 << 4))
+	writeVarint32(buf, int32(len(this.payload)))
+	buf.Write(this.payload)
+
+	return buf.Bytes(), nil
+}
+
+func (this *stubMessage) Decode(src io.Reader) (int, error) {
+	var b [1]byte
+
+	if _, err := io.ReadFull(src, b[:]); err != nil {
+		return 0, err
+	}
+
+	remlen, m, err := readVarint32(nil, src)
+	if err != nil {
+		return 1 + m, err
+	}
+
+	this.payload = make([]byte, remlen)
+	n, err := io.ReadFull(src, this.payload)
+
+	return 1 + m + n, err
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	err := RegisterMessageType(RESERVED2, func() Message { return &stubMessage{} })
+	assert.NoError(t, true, err, "Error registering message type.")
+
+	defer RegisterMessageType(RESERVED2, nil)
+
+	msgBytes := []byte{
+		byte(RESERVED2 << 4),
+		3,
+		's', 'u', 'r',
+	}
+
+	msg, n, err := DecodeMessage(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, RESERVED2, msg.Type(), "Incorrect message type.")
+
+	assert.Equal(t, true, []byte("sur"), msg.(*stubMessage).payload, "Incorrect payload.")
+
+	msg, _, err = DecodeMessage(bufio.NewReader(bytes.NewBuffer(msgBytes)))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []byte("sur"), msg.(*stubMessage).payload, "Incorrect payload.")
+
+	// registered types aren't checked for trailing bytes
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Strict = true
+
+	msg, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []byte("sur"), msg.(*stubMessage).payload, "Incorrect payload.")
+
+	sd := NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+	sd.Strict = true
+
+	_, err = sd.Write(msgBytes)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// standard types can't be overridden
+	err = RegisterMessageType(PUBLISH, func() Message { return &stubMessage{} })
+	assert.Error(t, true, err)
+
+	err = RegisterMessageType(RESERVED2+1, func() Message { return &stubMessage{} })
+	assert.Error(t, true, err)
+
+	// removing the registration
+	RegisterMessageType(RESERVED2, nil)
+
+	_, err = RESERVED2.New()
+	assert.Error(t, true, err)
+}
+
+func TestFramePackets(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+
+		byte(PINGREQ << 4),
+		0,
+
+		byte(PUBLISH << 4),
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u', 'r',
+		's', 'e', 'n', 'd', ' ',
+
+		byte(PUBLISH << 4),
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u',
+	}
+
+	packets, off, err := FramePackets(msgBytes)
+	assert.NoError(t, true, err, "Error framing packets.")
+
+	assert.Equal(t, true, 3, len(packets), "Incorrect number of packets.")
+
+	assert.Equal(t, true, msgBytes[0:4], packets[0], "Incorrect packet.")
+
+	assert.Equal(t, true, msgBytes[4:6], packets[1], "Incorrect packet.")
+
+	assert.Equal(t, true, msgBytes[6:18], packets[2], "Incorrect packet.")
+
+	assert.Equal(t, true, 18, off, "Incorrect offset.")
+
+	// every packet is complete
+	packets, off, err = FramePackets(msgBytes[:18])
+	assert.NoError(t, true, err, "Error framing packets.")
+
+	assert.Equal(t, true, 3, len(packets), "Incorrect number of packets.")
+
+	assert.Equal(t, true, 18, off, "Incorrect offset.")
+
+	// truncated remaining length
+	packets, off, err = FramePackets([]byte{byte(PUBLISH << 4), 0x80})
+	assert.NoError(t, true, err, "Error framing packets.")
+
+	assert.Equal(t, true, 0, len(packets), "Incorrect number of packets.")
+
+	assert.Equal(t, true, 0, off, "Incorrect offset.")
+
+	// malformed remaining length
+	_, off, err = FramePackets(append(msgBytes[:6:6], byte(PUBLISH<<4), 0xff, 0xff, 0xff, 0xff))
+	assert.Equal(t, true, ErrMalformedRemainingLength, err, "Incorrect error.")
+
+	assert.Equal(t, true, 6, off, "Incorrect offset.")
+}
+
+// test the AUTH message of version 5, which uses the reserved type 15
+func TestDecoderAuth(t *testing.T) {
+	msgBytes := []byte{
+		byte(RESERVED2 << 4),
+		0,
+	}
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Version = 0x5
+	d.FromClient = true
+
+	_, _, err := d.Decode()
+	assert.Equal(t, true, ErrAuthNotSupported, err, "Incorrect error.")
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Version = 0x4
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrReservedType, err, "Incorrect error.")
+
+	// RESERVED is reserved in version 5 as well
+	d = NewDecoder(bytes.NewBuffer([]byte{byte(RESERVED << 4), 0}))
+	d.Version = 0x5
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrReservedType, err, "Incorrect error.")
+
+	sd := NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+	sd.Version = 0x5
+
+	_, err = sd.Write(msgBytes)
+	assert.Equal(t, true, ErrAuthNotSupported, err, "Incorrect error.")
+}
+
+func TestStreamDecoder(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		12,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		'h', 'e', 'y',
+		byte(PINGRESP << 4),
+		0,
+	}
+
+	var msgs []Message
+
+	d := NewStreamDecoder(func(msg Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+
+	// the PUBLISH message split across three writes, the last one also carrying the
+	// PINGRESP message
+	n, err := d.Write(msgBytes[:1])
+	assert.NoError(t, true, err, "Error writing first part.")
+	assert.Equal(t, true, 1, n, "Incorrect number of bytes written.")
+	assert.Equal(t, true, 0, len(msgs), "Message decoded too early.")
+	assert.Equal(t, true, 1, d.Buffered(), "Incorrect number of bytes buffered.")
+
+	_, err = d.Write(msgBytes[1:8])
+	assert.NoError(t, true, err, "Error writing second part.")
+	assert.Equal(t, true, 0, len(msgs), "Message decoded too early.")
+	assert.Equal(t, true, 8, d.Buffered(), "Incorrect number of bytes buffered.")
+
+	n, err = d.Write(msgBytes[8:])
+	assert.NoError(t, true, err, "Error writing third part.")
+	assert.Equal(t, true, len(msgBytes)-8, n, "Incorrect number of bytes written.")
+	assert.Equal(t, true, 0, d.Buffered(), "Incorrect number of bytes buffered.")
+
+	assert.Equal(t, true, 2, len(msgs), "Incorrect number of messages.")
+	assert.Equal(t, true, []byte("surgemq"), msgs[0].(*PublishMessage).Topic(), "Incorrect topic.")
+	assert.Equal(t, true, []byte("hey"), msgs[0].(*PublishMessage).Payload(), "Incorrect payload.")
+	assert.Equal(t, true, PINGRESP, msgs[1].Type(), "Incorrect message type.")
+
+	// the decoded messages don't point into the bytes written
+	msgBytes[11] = 'x'
+	assert.Equal(t, true, []byte("hey"), msgs[0].(*PublishMessage).Payload(), "Payload changed with the input.")
+}
+
+func TestStreamDecoderMaxPacketSize(t *testing.T) {
+	count := 0
+
+	d := NewStreamDecoder(func(msg Message) error {
+		count++
+		return nil
+	})
+	d.MaxPacketSize = 14
+
+	// the PUBLISH message is exactly 14 bytes
+	_, err := d.Write([]byte{
+		byte(PUBLISH << 4),
+		12,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		'h', 'e', 'y',
+	})
+	assert.NoError(t, true, err, "Error writing message.")
+	assert.Equal(t, true, 1, count, "Incorrect number of messages.")
+
+	// the fixed header is incomplete, so the size isn't known yet
+	_, err = d.Write([]byte{byte(PUBLISH << 4), 0xff})
+	assert.NoError(t, true, err, "Error writing first part.")
+
+	// a remaining length of 268435455 is rejected before the body is buffered
+	_, err = d.Write([]byte{0xff, 0xff, 0x7f})
+	assert.Equal(t, true, ErrPacketTooLarge, err, "Incorrect error.")
+	// only the fixed header is buffered
+	assert.Equal(t, true, 5, d.Buffered(), "Incorrect number of bytes buffered.")
+
+	// a complete message one byte too large
+	d = NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+	d.MaxPacketSize = 13
+
+	_, err = d.Write([]byte{
+		byte(PUBLISH << 4),
+		12,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		'h', 'e', 'y',
+	})
+	assert.Equal(t, true, ErrPacketTooLarge, err, "Incorrect error.")
+}
+
+func TestStreamDecoderError(t *testing.T) {
+	// invalid message type
+	d := NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+
+	_, err := d.Write([]byte{byte(RESERVED << 4), 0})
+	assert.Error(t, true, err)
+
+	// the error is sticky
+	_, err2 := d.Write([]byte{byte(PINGRESP << 4), 0})
+	assert.Equal(t, true, err, err2, "Incorrect error.")
+
+	// callback error
+	errStop := errors.New("stop")
+	count := 0
+
+	d = NewStreamDecoder(func(msg Message) error {
+		count++
+		return errStop
+	})
+
+	_, err = d.Write([]byte{byte(PINGRESP << 4), 0, byte(PINGRESP << 4), 0})
+	assert.Equal(t, true, errStop, err, "Incorrect error.")
+	assert.Equal(t, true, 1, count, "Incorrect number of messages.")
+
+	// strict
+	d = NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+	d.Strict = true
+
+	_, err = d.Write([]byte{
+		byte(PUBACK << 4),
+		3,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // extra byte
+	})
+	assert.Error(t, true, err)
+}
+
+func TestDecoderDirection(t *testing.T) {
+	connack := []byte{
+		byte(CONNACK << 4),
+		2,
+		0, // session present
+		0, // return code
+	}
+
+	pingreq := []byte{
+		byte(PINGREQ << 4),
+		0,
+	}
+
+	// from a Client
+	d := NewDecoder(bytes.NewBuffer(connack))
+	d.FromClient = true
+
+	_, n, err := d.Decode()
+	assert.Equal(t, true, ErrInvalidDirection, err, "Incorrect error.")
+	assert.Equal(t, true, 1, n, "Incorrect bytes read.")
+
+	d = NewDecoder(bytes.NewBuffer(pingreq))
+	d.FromClient = true
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+	assert.Equal(t, true, PINGREQ, msg.Type(), "Incorrect message type.")
+
+	// from a Server, with the buffered reader
+	d = NewDecoder(bufio.NewReader(bytes.NewBuffer(pingreq)))
+	d.FromServer = true
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrInvalidDirection, err, "Incorrect error.")
+
+	d = NewDecoder(bufio.NewReader(bytes.NewBuffer(connack)))
+	d.FromServer = true
+
+	msg, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+	assert.Equal(t, true, CONNACK, msg.Type(), "Incorrect message type.")
+
+	// stream decoder
+	sd := NewStreamDecoder(func(msg Message) error {
+		return nil
+	})
+	sd.FromClient = true
+
+	_, err = sd.Write(connack)
+	assert.Equal(t, true, ErrInvalidDirection, err, "Incorrect error.")
+
+	// any direction by default
+	d = NewDecoder(bytes.NewBuffer(append(connack, pingreq...)))
+
+	_, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	_, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+// test that EOF in between messages is io.EOF, and in the middle of a message is
+// io.ErrUnexpectedEOF
+func TestDecodeMessageEOF(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		8,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		'y', 'o', 'u',
+	}
+
+	// nothing to read
+	_, n, err := DecodeMessage(io.LimitReader(bytes.NewBuffer(msgBytes), 0))
+	assert.Equal(t, true, io.EOF, err, "Incorrect error.")
+	assert.Equal(t, true, 0, n, "Incorrect bytes read.")
+
+	_, _, err = DecodeMessage(bufio.NewReader(io.LimitReader(bytes.NewBuffer(msgBytes), 0)))
+	assert.Equal(t, true, io.EOF, err, "Incorrect error.")
+
+	_, _, err = DecodeBytes(msgBytes[:0])
+	assert.Equal(t, true, io.EOF, err, "Incorrect error.")
+
+	// truncated after the first byte, in the remaining length, and in the body
+	for _, l := range []int{1, 2, 5, len(msgBytes) - 1} {
+		_, _, err = DecodeMessage(io.LimitReader(bytes.NewBuffer(msgBytes), int64(l)))
+		assert.Equal(t, true, io.ErrUnexpectedEOF, err, "Incorrect error.")
+
+		_, _, err = DecodeMessage(bufio.NewReader(io.LimitReader(bytes.NewBuffer(msgBytes), int64(l))))
+		assert.Equal(t, true, io.ErrUnexpectedEOF, err, "Incorrect error.")
+
+		// the payload is not read by DecodeStream
+		if l < 7 {
+			_, err = NewPublishMessage().DecodeStream(io.LimitReader(bytes.NewBuffer(msgBytes), int64(l)))
+			assert.Equal(t, true, io.ErrUnexpectedEOF, err, "Incorrect error.")
+		}
+
+		_, _, err = DecodeBytes(msgBytes[:l])
+		assert.Equal(t, true, io.ErrUnexpectedEOF, err, "Incorrect error.")
+	}
+
+	// a whole message followed by EOF
+	d := NewDecoder(io.LimitReader(bytes.NewBuffer(msgBytes), int64(len(msgBytes))))
+
+	_, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, io.EOF, err, "Incorrect error.")
+}
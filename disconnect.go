@@ -14,10 +14,24 @@
 
 package mqtt
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
 // The DISCONNECT Packet is the final Control Packet sent from the Client to the Server.
-// It indicates that the Client is disconnecting cleanly.
+// It indicates that the Client is disconnecting cleanly. In version 5 (MQTT 5.0) the
+// DISCONNECT Packet can also be sent by the Server, and includes a reason code that
+// indicates why the Network Connection is being closed.
 type DisconnectMessage struct {
 	fixedHeader
+
+	version byte
+
+	// Only encoded and decoded when version is 5
+	reasonCode ReasonCode
+	properties Properties
 }
 
 var _ Message = (*DisconnectMessage)(nil)
@@ -29,3 +43,184 @@ func NewDisconnectMessage() *DisconnectMessage {
 
 	return msg
 }
+
+// NewDisconnectWithReason creates a new version 5 DISCONNECT message with the reason
+// code, e.g., ReasonMalformedPacket when a Server drops a Client for sending a packet
+// it can't decode. See DisconnectReason to get the reason code for an error. An error
+// is returned if the reason code is not one defined for DISCONNECT, see
+// ReasonCode.ValidForDisconnect.
+func NewDisconnectWithReason(code ReasonCode) (*DisconnectMessage, error) {
+	if !code.ValidForDisconnect() {
+		return nil, fmt.Errorf("disconnect/NewDisconnectWithReason: Invalid reason code 0x%02x", byte(code))
+	}
+
+	msg := NewDisconnectMessage()
+	msg.version = 0x5
+	msg.reasonCode = code
+
+	return msg, nil
+}
+
+// Version returns the protocol version of the connection this message is sent over.
+// The DISCONNECT packet does not carry the version itself, but for version 5 (MQTT
+// 5.0) the variable header includes a reason code and a properties section.
+func (this *DisconnectMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *DisconnectMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("disconnect/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// ReasonCode returns the reason the Network Connection is being closed. It's only
+// encoded and decoded when version is 5.
+func (this *DisconnectMessage) ReasonCode() ReasonCode {
+	return this.reasonCode
+}
+
+// SetReasonCode sets the reason the Network Connection is being closed.
+func (this *DisconnectMessage) SetReasonCode(code ReasonCode) {
+	this.reasonCode = code
+}
+
+// Properties returns the DISCONNECT properties, which are only encoded and decoded
+// when version is 5.
+func (this *DisconnectMessage) Properties() *Properties {
+	return &this.properties
+}
+
+// ServerReference returns the Server Reference, which identifies another Server the
+// Client can use, e.g., with the reason code ReasonUseAnotherServer or
+// ReasonServerMoved. The second return value is false if the property is not
+// present.
+func (this *DisconnectMessage) ServerReference() ([]byte, bool) {
+	return this.properties.Bytes(PropServerReference)
+}
+
+// SetServerReference sets the Server Reference. An error is returned if v is not
+// valid UTF-8.
+func (this *DisconnectMessage) SetServerReference(v []byte) error {
+	return this.properties.SetBytes(PropServerReference, v)
+}
+
+// ReasonString returns the Reason String, a human readable string describing why
+// the Network Connection is being closed, which is designed for diagnostics. The
+// second return value is false if the property is not present.
+func (this *DisconnectMessage) ReasonString() ([]byte, bool) {
+	return this.properties.Bytes(PropReasonString)
+}
+
+// SetReasonString sets the Reason String. An error is returned if v is not valid
+// UTF-8.
+func (this *DisconnectMessage) SetReasonString(v []byte) error {
+	return this.properties.SetBytes(PropReasonString, v)
+}
+
+// Decode reads from the io.Reader parameter until a full message is decoded, or
+// when io.Reader returns EOF or error. The first return value is the number of
+// bytes read from io.Reader. The second is error if Decode encounters any problems.
+func (this *DisconnectMessage) Decode(src io.Reader) (int, error) {
+	total, err := this.fixedHeader.Decode(src)
+	if err != nil {
+		return total, err
+	}
+
+	this.reasonCode = ReasonNormalDisconnection
+	this.properties = Properties{}
+
+	if this.version != 0x5 {
+		return total, nil
+	}
+
+	// The reason code and the properties can be omitted if the reason code is 0x00
+	// and there are no properties.
+	if this.buf.Len() > 0 {
+		b, _ := this.buf.ReadByte()
+
+		this.reasonCode = ReasonCode(b)
+		if !this.reasonCode.ValidForDisconnect() {
+			// The offset is that of the reason code, which has already been read
+			err = newDecodeError(this.buf, fmt.Errorf("disconnect/Decode: Invalid reason code 0x%02x", b))
+			return total, this.decodeError(shiftDecodeError(err, 1))
+		}
+	}
+
+	if this.buf.Len() > 0 {
+		if _, err = this.properties.decode(this.buf, disconnectPropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
+	}
+
+	return total, nil
+}
+
+// Encode returns an io.Reader in which the encoded bytes can be read. The second
+// return value is the number of bytes encoded, so the caller knows how many bytes
+// there will be. If Encode returns an error, then the first two return values
+// should be considered invalid.
+// Any changes to the message after Encode() is called will invalidate the io.Reader.
+func (this *DisconnectMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *DisconnectMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *DisconnectMessage) encode(buf *bytes.Buffer) (int, error) {
+	encodeReason := this.version == 0x5 && (this.reasonCode != ReasonNormalDisconnection || this.properties.Len() > 0)
+
+	if encodeReason {
+		if err := this.setEncodedLength(1 + int64(this.properties.size())); err != nil {
+			return 0, err
+		}
+	} else {
+		this.SetRemainingLength(0)
+	}
+
+	total, err := this.fixedHeader.encode(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if !encodeReason {
+		return total, nil
+	}
+
+	if err = buf.WriteByte(this.reasonCode.Value()); err != nil {
+		return 0, err
+	}
+	total += 1
+
+	n, err := this.properties.encode(buf, disconnectPropertySet)
+	if err != nil {
+		return 0, err
+	}
+	total += n
+
+	return total, nil
+}
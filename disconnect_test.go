@@ -53,3 +53,160 @@ func TestDisconnectMessageEncode(t *testing.T) {
 
 	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
 }
+
+func TestDisconnectMessageReason(t *testing.T) {
+	msgBytes := []byte{
+		byte(DISCONNECT << 4),
+		2,
+		0x81, // reason code, malformed packet
+		0,    // properties length
+	}
+
+	msg, _ := NewDisconnectWithReason(ReasonMalformedPacket)
+
+	assert.Equal(t, true, 0x5, msg.Version(), "Incorrect version.")
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewDisconnectMessage()
+	msg.SetVersion(0x5)
+
+	n, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, ReasonMalformedPacket, msg.ReasonCode(), "Incorrect reason code.")
+
+	// normal disconnection without properties is encoded without the reason code
+	msg, _ = NewDisconnectWithReason(ReasonNormalDisconnection)
+
+	dst, n, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(DISCONNECT << 4), 0}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// granted QoS 1 is not a DISCONNECT reason code
+	_, err = NewDisconnectWithReason(ReasonGrantedQos1)
+	assert.Error(t, true, err, "Error expected for invalid reason code.")
+}
+
+func TestDisconnectMessageServerReference(t *testing.T) {
+	msgBytes := []byte{
+		byte(DISCONNECT << 4),
+		16,
+		0x9C, // reason code (use another server)
+		14,   // properties length
+		0x1C, // server reference
+		0, 5, // string length (5)
+		'h', 'o', 's', 't', '2',
+		0x1F, // reason string
+		0, 3, // string length (3)
+		'b', 'y', 'e',
+	}
+
+	msg, _ := NewDisconnectWithReason(ReasonUseAnotherServer)
+
+	_, ok := msg.ServerReference()
+	assert.False(t, true, ok, "Unexpected server reference.")
+
+	_, ok = msg.ReasonString()
+	assert.False(t, true, ok, "Unexpected reason string.")
+
+	err := msg.SetServerReference([]byte("host2"))
+	assert.NoError(t, true, err, "Error setting server reference.")
+
+	err = msg.SetReasonString([]byte("bye"))
+	assert.NoError(t, true, err, "Error setting reason string.")
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewDisconnectMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, ReasonUseAnotherServer, msg.ReasonCode(), "Incorrect reason code.")
+
+	v, ok := msg.ServerReference()
+	assert.True(t, true, ok, "Expecting server reference.")
+	assert.Equal(t, true, "host2", string(v), "Incorrect server reference.")
+
+	v, ok = msg.ReasonString()
+	assert.True(t, true, ok, "Expecting reason string.")
+	assert.Equal(t, true, "bye", string(v), "Incorrect reason string.")
+
+	// invalid UTF-8
+	err = msg.SetServerReference([]byte{'h', 0xff})
+	assert.Error(t, true, err)
+
+	err = msg.SetReasonString([]byte{0})
+	assert.Error(t, true, err)
+}
+
+// test a version 5 message with a reason code and no properties, which still has the
+// properties length
+func TestDisconnectMessageEmptyProperties(t *testing.T) {
+	msgBytes := []byte{
+		byte(DISCONNECT << 4),
+		2,
+		0x04, // reason code (disconnect with will message)
+		0,    // properties length (0)
+	}
+
+	msg, _ := NewDisconnectWithReason(ReasonDisconnectWithWillMessage)
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// decoding a message that had properties clears them
+	msg.SetReasonString([]byte("bye"))
+
+	n, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, ReasonDisconnectWithWillMessage, msg.ReasonCode(), "Incorrect reason code.")
+
+	_, ok := msg.ReasonString()
+	assert.False(t, true, ok, "Unexpected reason string.")
+}
+
+// test reason codes that are defined, but not for DISCONNECT
+func TestDisconnectMessageDecodeInvalidReason(t *testing.T) {
+	for _, code := range []byte{0x01, 0x02, 0x10, 0x03} {
+		msgBytes := []byte{
+			byte(DISCONNECT << 4),
+			2,
+			code, // reason code
+			0,    // properties length (0)
+		}
+
+		msg := NewDisconnectMessage()
+		msg.SetVersion(0x5)
+
+		_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+		assert.Error(t, true, err)
+
+		de, ok := err.(*DecodeError)
+		assert.True(t, true, ok, "Incorrect error type.")
+		assert.Equal(t, true, 2, de.Offset, "Incorrect offset.")
+	}
+
+	assert.True(t, true, ReasonDisconnectWithWillMessage.ValidForDisconnect(), "Expecting valid reason code.")
+	assert.False(t, true, ReasonGrantedQos1.ValidForDisconnect(), "Not expecting valid reason code.")
+}
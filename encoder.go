@@ -0,0 +1,120 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrPacketTooLarge is returned when an encoded message is larger than the maximum
+	// packet size the peer is willing to accept.
+	ErrPacketTooLarge = errors.New("Packet exceeds the maximum packet size")
+)
+
+// Encoder encodes and writes messages to an output stream, such as a network
+// connection.
+type Encoder struct {
+	dst io.Writer
+
+	// MaxPacketSize is the maximum size in bytes of a message, including the fixed
+	// header, that the peer is willing to accept. For version 5 this is negotiated
+	// using the Maximum Packet Size property in CONNECT and CONNACK. 0 means there's
+	// no limit.
+	MaxPacketSize uint32
+
+	// Trusted causes Encode to encode PUBLISH messages with EncodeTrusted, skipping
+	// the validation of messages known to be well-formed, e.g., when forwarding
+	// messages that were decoded and validated already.
+	Trusted bool
+}
+
+// NewEncoder creates a new Encoder that writes to dst.
+func NewEncoder(dst io.Writer) *Encoder {
+	return &Encoder{dst: dst}
+}
+
+// Encode encodes the message and writes it to the output stream. It returns the
+// number of bytes written. ErrPacketTooLarge is returned, and nothing is written, if
+// the encoded message is larger than MaxPacketSize.
+func (this *Encoder) Encode(msg Message) (int, error) {
+	var (
+		r   io.Reader
+		n   int
+		err error
+	)
+
+	if pm, ok := msg.(*PublishMessage); ok && this.Trusted {
+		r, n, err = pm.EncodeTrusted()
+	} else {
+		r, n, err = msg.Encode()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if this.MaxPacketSize > 0 && uint32(n) > this.MaxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+
+	m, err := io.CopyN(this.dst, r, int64(n))
+	return int(m), err
+}
+
+// EncodeBatch encodes the messages in turn and writes them to w, e.g., a burst of
+// queued PUBLISH messages followed by a PINGRESP. The messages are encoded into a
+// shared scratch buffer and written through a bufio.Writer, which is flushed once at
+// the end, so the batch is written using as few writes to w as possible. Encoding
+// stops at the first error, in which case the messages encoded before the error are
+// still written. It returns the number of bytes written to w.
+func EncodeBatch(w io.Writer, msgs []Message) (int, error) {
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	var (
+		scratch []byte
+		err     error
+	)
+
+	for _, msg := range msgs {
+		if scratch, err = msg.AppendTo(scratch[:0]); err != nil {
+			break
+		}
+
+		if _, err = bw.Write(scratch); err != nil {
+			break
+		}
+	}
+
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+
+	return cw.n, err
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (this *countWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += n
+	return n, err
+}
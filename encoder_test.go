@@ -0,0 +1,263 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestEncoderEncode(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	msg := NewPubackMessage()
+	msg.SetPacketId(7)
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.MaxPacketSize = 4
+
+	n, err := e.Encode(msg)
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, buf.Bytes(), "Error encoding message.")
+}
+
+// test message larger than maximum packet size
+func TestEncoderEncode2(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetPayload([]byte("send me home"))
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.MaxPacketSize = 20
+
+	n, err := e.Encode(msg)
+	assert.Equal(t, true, ErrPacketTooLarge, err, "Expecting packet too large error.")
+
+	assert.Equal(t, true, 0, n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, 0, buf.Len(), "Nothing should have been written.")
+
+	e.MaxPacketSize = 23
+
+	n, err = e.Encode(msg)
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, 23, n, "Incorrect bytes encoded.")
+}
+
+// test that AppendTo produces the same bytes as Encode
+func TestAppendTo(t *testing.T) {
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetQoS(QosAtLeastOnce)
+	pub.SetPacketId(7)
+	pub.SetPayload([]byte("send me home"))
+
+	sub := NewSubscribeMessage()
+	sub.SetPacketId(7)
+	sub.AddTopic([]byte("a/b"), 1)
+
+	conn := NewConnectMessage()
+	conn.SetVersion(0x4)
+	conn.SetClientId([]byte("cid"))
+
+	rel := NewPubrelMessage()
+	rel.SetPacketId(7)
+
+	for _, msg := range []Message{pub, sub, conn, rel, NewPingreqMessage(), NewDisconnectMessage()} {
+		r, n, err := msg.Encode()
+		assert.NoError(t, true, err, "Error encoding message.")
+
+		expected := r.(*bytes.Buffer).Bytes()
+
+		dst := make([]byte, 3, 3+n)
+		dst[0], dst[1], dst[2] = 'a', 'b', 'c'
+
+		b, err := msg.AppendTo(dst)
+		assert.NoError(t, true, err, "Error appending message.")
+
+		assert.Equal(t, true, "abc", string(b[:3]), "Incorrect prefix.")
+
+		assert.Equal(t, true, expected, b[3:], "Incorrect appended bytes.")
+
+		// dst has enough capacity, so no new array is allocated
+		assert.True(t, true, &b[0] == &dst[0], "Expecting dst to be reused.")
+
+		b, err = msg.AppendTo(nil)
+		assert.NoError(t, true, err, "Error appending message.")
+
+		assert.Equal(t, true, expected, b, "Incorrect appended bytes.")
+	}
+
+	// dst is returned unchanged on error
+	dst := []byte{'a'}
+
+	b, err := NewPublishMessage().AppendTo(dst)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, dst, b, "Incorrect slice.")
+}
+
+func benchmarkPublish() *PublishMessage {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/benchmark"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(bytes.Repeat([]byte{'a'}, 256))
+
+	return msg
+}
+
+func BenchmarkEncode(b *testing.B) {
+	msg := benchmarkPublish()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := msg.Encode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	msg := benchmarkPublish()
+	dst := make([]byte, 0, 1024)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+		if dst, err = msg.AppendTo(dst[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncoderTrusted(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send me home"))
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	expected := append([]byte{}, dst.(*bytes.Buffer).Bytes()...)
+
+	var buf bytes.Buffer
+
+	enc := NewEncoder(&buf)
+	enc.Trusted = true
+
+	n, err := enc.Encode(msg)
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(expected), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, expected, buf.Bytes(), "Incorrect trusted encoding.")
+
+	// fields are not validated
+	msg.SetPayload(nil)
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	_, _, err = msg.EncodeTrusted()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+// benchmarkForward encodes the same PUBLISH message over and over, like a broker
+// forwarding it to many subscribers.
+func benchmarkForward(b *testing.B, trusted bool) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/benchmark/forwarding/sensors/building-7/floor-3/temperature"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(bytes.Repeat([]byte{'a'}, 64))
+
+	enc := NewEncoder(ioutil.Discard)
+	enc.Trusted = trusted
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := enc.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncoderForward(b *testing.B) {
+	benchmarkForward(b, false)
+}
+
+func BenchmarkEncoderForwardTrusted(b *testing.B) {
+	benchmarkForward(b, true)
+}
+
+func TestEncodeBatch(t *testing.T) {
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetQoS(QosAtLeastOnce)
+	pub.SetPacketId(7)
+	pub.SetPayload([]byte("send me home"))
+
+	ack := NewPubackMessage()
+	ack.SetPacketId(8)
+
+	var dst bytes.Buffer
+
+	n, err := EncodeBatch(&dst, []Message{pub, ack, NewPingrespMessage()})
+	assert.NoError(t, true, err, "Error encoding messages.")
+
+	assert.Equal(t, true, 25+4+2, n, "Incorrect bytes written.")
+
+	assert.Equal(t, true, n, dst.Len(), "Incorrect bytes written.")
+
+	var mtypes []MessageType
+
+	err = ScanPackets(&dst, func(msg Message) error {
+		mtypes = append(mtypes, msg.Type())
+		return nil
+	})
+	assert.NoError(t, true, err, "Error decoding messages.")
+
+	assert.Equal(t, true, []MessageType{PUBLISH, PUBACK, PINGRESP}, mtypes, "Incorrect message types.")
+
+	// the messages before the invalid one are written
+	dst.Reset()
+
+	n, err = EncodeBatch(&dst, []Message{ack, NewPublishMessage(), NewPingrespMessage()})
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 4, n, "Incorrect bytes written.")
+
+	assert.Equal(t, true, []byte{byte(PUBACK << 4), 2, 0, 8}, dst.Bytes(), "Incorrect bytes written.")
+}
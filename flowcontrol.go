@@ -0,0 +1,86 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrReceiveMaximumExceeded is returned when there is no room in the window of
+	// unacknowledged QoS 1 and QoS 2 PUBLISH packets.
+	ErrReceiveMaximumExceeded = errors.New("Receive Maximum exceeded")
+)
+
+// FlowController limits the number of QoS 1 and QoS 2 PUBLISH packets that are sent
+// but not yet acknowledged, as negotiated by the Receive Maximum property in MQTT 5.0.
+// The sender calls Acquire before sending a QoS 1 or QoS 2 PUBLISH, and Release once
+// the PUBACK or PUBCOMP (or a PUBREC with a failure reason code) is received. It is
+// safe to use from multiple goroutines.
+type FlowController struct {
+	window chan struct{}
+}
+
+// NewFlowController creates a new FlowController that allows up to capacity packets
+// in flight. A capacity of 0 is not allowed by the spec, so it's treated as the
+// default Receive Maximum of 65535.
+func NewFlowController(capacity uint16) *FlowController {
+	if capacity == 0 {
+		capacity = 65535
+	}
+
+	return &FlowController{
+		window: make(chan struct{}, capacity),
+	}
+}
+
+// Capacity returns the maximum number of packets allowed in flight.
+func (this *FlowController) Capacity() int {
+	return cap(this.window)
+}
+
+// InFlight returns the number of packets currently in flight.
+func (this *FlowController) InFlight() int {
+	return len(this.window)
+}
+
+// Acquire reserves a slot in the window for a packet, blocking until one is
+// available.
+func (this *FlowController) Acquire() {
+	this.window <- struct{}{}
+}
+
+// TryAcquire reserves a slot in the window for a packet without blocking. It returns
+// ErrReceiveMaximumExceeded if the window is full.
+func (this *FlowController) TryAcquire() error {
+	select {
+	case this.window <- struct{}{}:
+		return nil
+	default:
+		return ErrReceiveMaximumExceeded
+	}
+}
+
+// Release frees a slot in the window once a packet has been acknowledged. An error
+// is returned if there are no packets in flight.
+func (this *FlowController) Release() error {
+	select {
+	case <-this.window:
+		return nil
+	default:
+		return fmt.Errorf("flowcontrol/Release: No packets in flight")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestFlowControllerTryAcquire(t *testing.T) {
+	fc := NewFlowController(2)
+
+	assert.Equal(t, true, 2, fc.Capacity(), "Incorrect capacity.")
+
+	assert.NoError(t, true, fc.TryAcquire(), "Error acquiring.")
+
+	assert.NoError(t, true, fc.TryAcquire(), "Error acquiring.")
+
+	assert.Equal(t, true, 2, fc.InFlight(), "Incorrect packets in flight.")
+
+	assert.Equal(t, true, ErrReceiveMaximumExceeded, fc.TryAcquire(), "Expecting receive maximum exceeded.")
+
+	assert.NoError(t, true, fc.Release(), "Error releasing.")
+
+	assert.NoError(t, true, fc.TryAcquire(), "Error acquiring.")
+
+	assert.NoError(t, true, fc.Release(), "Error releasing.")
+
+	assert.NoError(t, true, fc.Release(), "Error releasing.")
+
+	assert.Error(t, true, fc.Release())
+
+	assert.Equal(t, true, 0, fc.InFlight(), "Incorrect packets in flight.")
+}
+
+func TestFlowControllerAcquire(t *testing.T) {
+	fc := NewFlowController(1)
+	fc.Acquire()
+
+	done := make(chan struct{})
+
+	go func() {
+		fc.Acquire()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Acquire should block when the window is full.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fc.Release()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire should return once the window reopens.")
+	}
+}
+
+func TestFlowControllerDefault(t *testing.T) {
+	fc := NewFlowController(0)
+
+	assert.Equal(t, true, 65535, fc.Capacity(), "Incorrect default capacity.")
+}
@@ -18,10 +18,21 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/dataence/glog"
 )
 
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// poisonOnRelease causes Release to overwrite the buffer before returning it to the
+// pool, so byte slices used after Release are easy to catch in tests.
+var poisonOnRelease = false
+
 // Fixed header
 // - 1 byte for control packet type (bits 7-4) and flags (bits 3-0)
 // - up to 4 byte for remaining length
@@ -30,6 +41,13 @@ type fixedHeader struct {
 	remlen int32
 	mtype  MessageType
 	flags  byte
+
+	// decoded is set when the message fields may point into buf
+	decoded bool
+
+	// aliased is set when buf points into the byte slice the message was decoded from,
+	// in which case buf is never written to or returned to the pool
+	aliased bool
 }
 
 // String returns a string representation of the message.
@@ -43,36 +61,91 @@ func (this fixedHeader) String() string {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *fixedHeader) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *fixedHeader) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the fixed header to buf and returns the number of bytes written.
+func (this *fixedHeader) encode(buf *bytes.Buffer) (int, error) {
 	total := 0
 
 	if this.remlen > maxRemainingLength {
-		return nil, 0, fmt.Errorf("header/Encode: remaining length (%d) too big", this.remlen)
+		return 0, fmt.Errorf("header/Encode: remaining length (%d) too big", this.remlen)
 	}
 
 	if !this.mtype.Valid() {
-		return nil, 0, fmt.Errorf("header/Encode: Invalid message type %d", this.mtype)
+		return 0, fmt.Errorf("header/Encode: Invalid message type %d", this.mtype)
 	}
 
-	this.resetBuf()
-
-	if err := this.buf.WriteByte(byte(this.mtype)<<4 | this.flags); err != nil {
-		return nil, 0, err
+	if err := buf.WriteByte(byte(this.mtype)<<4 | this.flags); err != nil {
+		return 0, err
 	}
 	total += 1
 
-	n, err := writeVarint32(this.buf, this.remlen)
+	n, err := writeVarint32(buf, this.remlen)
 	if err != nil {
-		return nil, total + n, err
+		return total + n, err
 	}
 	total += n
 
-	return this.buf, total, nil
+	return total, nil
+}
+
+// setEncodedLength sets the remaining length calculated by Encode. The length is an
+// int64, so adding up the lengths of the fields can't overflow before it's checked
+// against the maximum, even where int is 32 bits.
+func (this *fixedHeader) setEncodedLength(remlen int64) error {
+	if remlen < 0 || remlen > int64(maxRemainingLength) {
+		return fmt.Errorf("header/Encode: %s message too large. Remaining length %d is greater than %d bytes.", this.Name(), remlen, maxRemainingLength)
+	}
+
+	this.remlen = int32(remlen)
+	return nil
+}
+
+// encodeBuf returns the internal buffer, reset for Encode to write into.
+func (this *fixedHeader) encodeBuf() *bytes.Buffer {
+	// After Decode, the message fields point into the buffer, so writing into the same
+	// buffer would overwrite them while they are being encoded.
+	if this.decoded {
+		this.buf = nil
+		this.decoded = false
+	}
+
+	this.resetBuf()
+
+	return this.buf
 }
 
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
-// bytes read from io.Reader. The second is error if Decode encounters any problems.
+// bytes read from io.Reader, which is the whole message, including the fixed header,
+// unless reading from io.Reader fails. The second is error if Decode encounters any
+// problems.
 func (this *fixedHeader) Decode(src io.Reader) (int, error) {
+	if sr, ok := src.(*sliceReader); ok {
+		return this.decodeSlice(sr)
+	}
+
 	this.resetBuf()
 
 	total, err := this.copy(src)
@@ -109,8 +182,13 @@ func (this *fixedHeader) Type() MessageType {
 }
 
 // SetType sets the message type of this message. It also correctly sets the
-// default flags for the message type. It returns an error if the type is invalid.
+// default flags for the message type. It returns ErrReservedType if the type is
+// reserved, or an error if it's otherwise invalid.
 func (this *fixedHeader) SetType(mtype MessageType) error {
+	if mtype.IsReserved() {
+		return ErrReservedType
+	}
+
 	if !mtype.Valid() {
 		return fmt.Errorf("header/SetType: Invalid control packet type %d", mtype)
 	}
@@ -145,6 +223,23 @@ func (this *fixedHeader) SetRemainingLength(remlen int32) error {
 }
 
 func (this *fixedHeader) copy(src io.Reader) (int64, error) {
+	total, err := this.copyHeader(src)
+	if err != nil {
+		return total, err
+	}
+
+	n, err := io.CopyN(this.buf, src, int64(this.remlen))
+	if err != nil {
+		return total + n, unexpectedEOF(err)
+	}
+
+	return total + n, nil
+}
+
+// copyHeader reads the fixed header from src, leaving the rest of the message in src.
+func (this *fixedHeader) copyHeader(src io.Reader) (int64, error) {
+	this.decoded = true
+
 	total, err := io.CopyN(this.buf, src, 1)
 	if err != nil {
 		return 0, err
@@ -155,44 +250,196 @@ func (this *fixedHeader) copy(src io.Reader) (int64, error) {
 		return 0, err
 	}
 
+	if err = this.decodeFirstByte(b); err != nil {
+		return total, err
+	}
+
+	var m int
+	this.remlen, m, err = readVarint32(this.buf, src)
+	if err != nil {
+		// readVarint32 only reads all 4 bytes if the remaining length is malformed,
+		// otherwise it's an error reading from src
+		if m == 4 {
+			err = &DecodeError{Offset: int(total) + m - 1, Err: err, remaining: -1}
+		}
+
+		return total + int64(m), unexpectedEOF(err)
+	}
+	total += int64(m)
+	this.buf.Next(m)
+
+	return total, nil
+}
+
+// decodeFirstByte checks the message type and flags in the first byte of the fixed
+// header, and sets the flags.
+func (this *fixedHeader) decodeFirstByte(b byte) error {
 	mtype := MessageType(b >> 4)
+	if mtype.IsReserved() {
+		return ErrReservedType
+	}
+
 	if !mtype.Valid() {
-		return total, glog.NewError("Invalid message type %d.", mtype)
+		return glog.NewError("Invalid message type %d.", mtype)
 	}
 
 	if mtype != this.mtype {
-		return total, glog.NewError("Invalid message type %d. Expecting %d.", mtype, this.mtype)
+		return glog.NewError("Invalid message type %d. Expecting %d.", mtype, this.mtype)
 	}
 
+	// The flags of all messages except PUBLISH are reserved, and MUST be set to the
+	// default, which is 2 for PUBREL, SUBSCRIBE and UNSUBSCRIBE, and 0 for the rest
 	this.flags = b & 0x0f
 	if this.mtype != PUBLISH && this.flags != this.mtype.DefaultFlags() {
-		return total, glog.NewError("Invalid message (%d) flags. Expecting %d, got %d", this.mtype, this.mtype.DefaultFlags, this.flags)
+		return glog.NewError("Invalid %s message flags. Expecting %d, got %d", this.mtype.Name(), this.mtype.DefaultFlags(), this.flags)
 	}
 
 	if this.mtype == PUBLISH && !ValidQos((this.flags>>1)&0x3) {
-		return total, glog.NewError("Invalid QoS (%d) for PUBLISH message.", (this.flags>>1)&0x3)
+		return glog.NewError("Invalid QoS (%d) for PUBLISH message.", (this.flags>>1)&0x3)
 	}
 
-	var m int
-	this.remlen, m, err = readVarint32(this.buf, src)
-	if err != nil {
-		return total + int64(m), err
+	return nil
+}
+
+// decodeSlice is Decode for a message that's already in memory. The fixed header is
+// parsed from the slice directly, and the rest of the message is either copied into
+// the buffer, or used as the buffer if src is aliased. The bytes consumed from src,
+// and the errors returned, are the same as for any other io.Reader.
+func (this *fixedHeader) decodeSlice(src *sliceReader) (int, error) {
+	b := src.b[src.off:]
+
+	if len(b) == 0 {
+		return 0, io.EOF
 	}
-	total += int64(m)
-	this.buf.Next(m)
 
-	n, err := io.CopyN(this.buf, src, int64(this.remlen))
-	if err != nil {
-		return total + n, err
+	this.decoded = true
+	this.remlen = 0
+	src.off++
+
+	if err := this.decodeFirstByte(b[0]); err != nil {
+		return 1, err
 	}
 
-	return total, nil
+	remlen, m, err := sliceVarint32(b[1:])
+	src.off += m
+
+	if err == ErrMalformedRemainingLength {
+		return 1 + m, &DecodeError{Offset: m, Err: err, remaining: -1}
+	} else if err != nil {
+		return 1 + m, unexpectedEOF(err)
+	}
+
+	this.remlen = remlen
+	body := b[1+m:]
+
+	if int(remlen) > len(body) {
+		// Same as reading what's left from an io.Reader
+		this.resetBuf()
+		this.buf.Write(body)
+		src.off += len(body)
+
+		return len(b), io.ErrUnexpectedEOF
+	}
+
+	body = body[:remlen:remlen]
+	src.off += int(remlen)
+
+	if src.alias {
+		this.Release()
+		this.buf = bytes.NewBuffer(body)
+		this.aliased = true
+	} else {
+		this.resetBuf()
+		this.buf.Write(body)
+	}
+
+	this.decoded = true
+
+	return 1 + m + int(remlen), nil
+}
+
+// trailing returns the number of bytes of the remaining length that were not
+// consumed while decoding the message.
+func (this *fixedHeader) trailing() int {
+	if this.buf == nil {
+		return 0
+	}
+
+	return this.buf.Len()
+}
+
+// lengthError returns a LengthError if there are bytes of the remaining length that
+// were not consumed while decoding the message, and nil otherwise.
+func (this *fixedHeader) lengthError() error {
+	if m := this.trailing(); m > 0 {
+		return &LengthError{Type: this.mtype, Declared: int(this.remlen), Consumed: int(this.remlen) - m}
+	}
+
+	return nil
+}
+
+// Release returns the internal buffer to the shared pool. Any byte slice obtained
+// from the message MUST NOT be used after Release is called.
+func (this *fixedHeader) Release() {
+	if this.buf == nil {
+		return
+	}
+
+	if this.aliased {
+		this.buf = nil
+		this.aliased = false
+		this.decoded = false
+		return
+	}
+
+	this.buf.Reset()
+
+	if poisonOnRelease {
+		b := this.buf.Bytes()
+		b = b[:cap(b)]
+		for i := range b {
+			b[i] = 0xff
+		}
+	}
+
+	bufPool.Put(this.buf)
+	this.buf = nil
+	this.decoded = false
+}
+
+// SizeParts returns the size in bytes of the fixed header, and of the rest of the
+// message, which is the remaining length, as of the last time the message was encoded
+// or decoded. The sum is the size of the whole packet.
+func (this *fixedHeader) SizeParts() (int, int) {
+	return FixedHeaderLen(this.remlen), int(this.remlen)
+}
+
+// Respond returns nil and false, as most messages either need no reply, or a reply
+// that depends on the caller. Messages with a fixed reply override it.
+func (this *fixedHeader) Respond() (Message, bool) {
+	return nil, false
+}
+
+// decodeError sets the offset of a DecodeError returned while decoding the rest of
+// the message from the buffer.
+func (this *fixedHeader) decodeError(err error) error {
+	if de, ok := err.(*DecodeError); ok && de.remaining >= 0 {
+		de.Offset = 1 + varintLen(this.remlen) + int(this.remlen) - de.remaining
+		de.remaining = -1
+	}
+
+	return err
 }
 
 func (this *fixedHeader) resetBuf() {
+	if this.aliased {
+		this.buf = nil
+		this.aliased = false
+	}
+
 	if this.buf == nil {
-		this.buf = new(bytes.Buffer)
-	} else {
-		this.buf.Reset()
+		this.buf = bufPool.Get().(*bytes.Buffer)
 	}
+
+	this.buf.Reset()
 }
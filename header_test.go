@@ -16,6 +16,7 @@ package mqtt
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
 	"github.com/dataence/assert"
@@ -105,7 +106,35 @@ func TestMessageHeaderDecode4(t *testing.T) {
 
 	assert.Equal(t, true, maxRemainingLength, header.RemainingLength(), "Incorrect remaining length")
 
-	assert.Error(t, true, err)
+	// the remaining length is valid, but the message body is missing
+	assert.Equal(t, true, io.ErrUnexpectedEOF, err, "Incorrect error")
+}
+
+// test a remaining length with the continuation bit set in the 4th byte
+func TestMessageHeaderDecodeMalformed(t *testing.T) {
+	headerBytes := []byte{0x62, 0xff, 0xff, 0xff, 0xff}
+	buf := bytes.NewBuffer(headerBytes)
+	header := &fixedHeader{
+		mtype: 6,
+		flags: 2,
+	}
+
+	n, err := header.Decode(buf)
+	assert.Equal(t, true, 5, n, "Incorrect bytes decoded")
+
+	assert.Equal(t, true, 0, header.RemainingLength(), "Incorrect remaining length")
+
+	de, ok := err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, ErrMalformedRemainingLength, de.Err, "Incorrect error")
+
+	x, m, err := readVarint32(nil, bytes.NewBuffer(headerBytes[1:]))
+	assert.Equal(t, true, ErrMalformedRemainingLength, err, "Incorrect error")
+
+	assert.Equal(t, true, 0, x, "Incorrect value")
+
+	assert.Equal(t, true, 4, m, "Incorrect bytes read")
 }
 
 func TestMessageHeaderDecode5(t *testing.T) {
@@ -209,3 +238,126 @@ func TestMessageHeaderEncode5(t *testing.T) {
 		t.Errorf("Incorrect result. Expecting length of 2 bytes, got %d.", dst.(*bytes.Buffer).Len())
 	}
 }
+
+func TestMessageHeaderRelease(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		21,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	poisonOnRelease = true
+	defer func() { poisonOnRelease = false }()
+
+	msg := NewPublishMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	payload := msg.Payload()
+	assert.Equal(t, true, "send me home", string(payload), "Incorrect payload.")
+
+	msg.Release()
+
+	assert.Equal(t, true, bytes.Repeat([]byte{0xff}, len(payload)), payload, "Payload should be invalid after Release.")
+
+	// the message can be reused after Release
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "surgemq", string(msg.Topic()), "Incorrect topic.")
+
+	msg.Release()
+	msg.Release()
+}
+
+// test reserved flags that don't match the default flags of the message type
+func TestMessageHeaderReservedFlags(t *testing.T) {
+	tests := []struct {
+		mtype MessageType
+		flags byte
+	}{
+		{SUBACK, 2},
+		{SUBACK, 1},
+		{PINGREQ, 8},
+		{PINGREQ, 2},
+		{PUBREL, 0},
+		{PUBREL, 3},
+	}
+
+	for _, test := range tests {
+		msgBytes := []byte{
+			byte(test.mtype<<4) | test.flags,
+			0,
+		}
+
+		_, n, err := DecodeBytes(msgBytes)
+		assert.Error(t, true, err)
+
+		assert.Equal(t, true, 1, n, "Incorrect bytes decoded.")
+	}
+
+	for _, mtype := range []MessageType{PUBREL, SUBSCRIBE, UNSUBSCRIBE} {
+		assert.Equal(t, true, 2, mtype.DefaultFlags(), "Incorrect default flags.")
+	}
+
+	for _, mtype := range []MessageType{CONNECT, CONNACK, PUBACK, PUBREC, PUBCOMP, SUBACK, UNSUBACK, PINGREQ, PINGRESP, DISCONNECT} {
+		assert.Equal(t, true, 0, mtype.DefaultFlags(), "Incorrect default flags.")
+	}
+}
+
+// test the remaining length calculated by Encode, without allocating the fields
+func TestMessageHeaderEncodedLength(t *testing.T) {
+	header := &fixedHeader{mtype: PUBLISH}
+
+	err := header.setEncodedLength(int64(maxRemainingLength))
+	assert.NoError(t, true, err, "Error setting remaining length.")
+
+	assert.Equal(t, true, maxRemainingLength, header.RemainingLength(), "Incorrect remaining length.")
+
+	err = header.setEncodedLength(int64(maxRemainingLength) + 1)
+	assert.Error(t, true, err)
+
+	// would be 5 if converted to int32 before the check
+	err = header.setEncodedLength(1<<32 + 5)
+	assert.Error(t, true, err)
+
+	err = header.setEncodedLength(-1)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, maxRemainingLength, header.RemainingLength(), "Remaining length should not change on error.")
+}
+
+func TestMessageHeaderSizeParts(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	msg, _, err := DecodeBytes(msgBytes)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	header, body := msg.SizeParts()
+	assert.Equal(t, true, 2, header, "Incorrect header size.")
+
+	assert.Equal(t, true, 2, body, "Incorrect body size.")
+
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetPayload(bytes.Repeat([]byte{'a'}, 200))
+
+	_, n, err := pub.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	header, body = pub.SizeParts()
+	assert.Equal(t, true, 3, header, "Incorrect header size.")
+
+	assert.Equal(t, true, 209, body, "Incorrect body size.")
+
+	assert.Equal(t, true, n, header+body, "Incorrect total size.")
+}
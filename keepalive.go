@@ -0,0 +1,48 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import "time"
+
+// NoKeepAliveTimeout is returned by KeepAliveTimeout when the keep alive is 0, which
+// turns the mechanism off, so the Server must not disconnect the Client for being
+// idle. It's the zero Duration, and MUST NOT be used as a timeout as is, as that
+// would time the Client out immediately. Compare the timeout against it first, or
+// use DeadlineFromKeepAlive, which handles it.
+const NoKeepAliveTimeout time.Duration = 0
+
+// KeepAliveTimeout returns the time the Server waits for a Control Packet from the
+// Client before disconnecting it, which is one and a half times the keep alive value
+// in seconds [MQTT-3.1.2-24]. A keep alive value of 0 turns the mechanism off, in
+// which case NoKeepAliveTimeout is returned, meaning there's no timeout.
+func KeepAliveTimeout(keepAlive uint16) time.Duration {
+	if keepAlive == 0 {
+		return NoKeepAliveTimeout
+	}
+
+	return time.Duration(keepAlive) * 1500 * time.Millisecond
+}
+
+// DeadlineFromKeepAlive returns the time by which the next Control Packet must be
+// received from the Client, given the keep alive value and the time the last one
+// was received. If keep alive is 0, the zero time is returned, which means no
+// deadline when passed to net.Conn.SetReadDeadline.
+func DeadlineFromKeepAlive(keepAlive uint16, now time.Time) time.Time {
+	if keepAlive == 0 {
+		return time.Time{}
+	}
+
+	return now.Add(KeepAliveTimeout(keepAlive))
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestKeepAliveTimeout(t *testing.T) {
+	assert.Equal(t, true, time.Duration(0), KeepAliveTimeout(0), "Incorrect keep alive timeout.")
+
+	assert.Equal(t, true, 90*time.Second, KeepAliveTimeout(60), "Incorrect keep alive timeout.")
+
+	assert.Equal(t, true, 98302500*time.Millisecond, KeepAliveTimeout(65535), "Incorrect keep alive timeout.")
+}
+
+func TestDeadlineFromKeepAlive(t *testing.T) {
+	now := time.Date(2014, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.True(t, true, DeadlineFromKeepAlive(0, now).IsZero(), "Deadline should be zero when keep alive is disabled.")
+
+	assert.Equal(t, true, now.Add(90*time.Second), DeadlineFromKeepAlive(60, now), "Incorrect deadline.")
+
+	assert.Equal(t, true, now.Add(98302500*time.Millisecond), DeadlineFromKeepAlive(65535, now), "Incorrect deadline.")
+}
+
+// test that a keep alive of 0 means there's no timeout, as opposed to timing out
+// immediately
+func TestKeepAliveDisabled(t *testing.T) {
+	assert.Equal(t, true, NoKeepAliveTimeout, KeepAliveTimeout(0), "Keep alive timeout should be disabled.")
+
+	// the smallest keep alive still has a positive timeout
+	assert.True(t, true, KeepAliveTimeout(1) > NoKeepAliveTimeout, "Keep alive timeout should be enabled.")
+
+	// no deadline, as opposed to a deadline of now
+	now := time.Date(2014, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	deadline := DeadlineFromKeepAlive(0, now)
+	assert.True(t, true, deadline.IsZero(), "Deadline should be zero when keep alive is disabled.")
+	assert.False(t, true, deadline.Equal(now), "Deadline should not be now when keep alive is disabled.")
+}
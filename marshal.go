@@ -0,0 +1,191 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"io/ioutil"
+)
+
+// All messages implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, so
+// they can be embedded in other framed protocols. PUBREC, PUBREL, PUBCOMP and UNSUBACK
+// get the methods from PubackMessage.
+var (
+	_ encoding.BinaryMarshaler   = (*ConnectMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*ConnackMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PublishMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PubackMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PubrecMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PubrelMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PubcompMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*SubscribeMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*SubackMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*UnsubscribeMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*UnsubackMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PingreqMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*PingrespMessage)(nil)
+	_ encoding.BinaryMarshaler   = (*DisconnectMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*ConnectMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*ConnackMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PublishMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PubackMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PubrecMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PubrelMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PubcompMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*SubscribeMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*SubackMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*UnsubscribeMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*UnsubackMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PingreqMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*PingrespMessage)(nil)
+	_ encoding.BinaryUnmarshaler = (*DisconnectMessage)(nil)
+)
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *ConnectMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *ConnectMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *ConnackMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *ConnackMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *PublishMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *PublishMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *PubackMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *PubackMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *SubscribeMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *SubscribeMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *SubackMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *SubackMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *UnsubscribeMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *UnsubscribeMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *PingreqMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *PingreqMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *PingrespMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *PingrespMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// MarshalBinary encodes the message and returns the encoded bytes.
+func (this *DisconnectMessage) MarshalBinary() ([]byte, error) {
+	return marshalBinary(this)
+}
+
+// UnmarshalBinary decodes the message from b. An error is returned if b contains
+// more than one message.
+func (this *DisconnectMessage) UnmarshalBinary(b []byte) error {
+	return unmarshalBinary(this, b)
+}
+
+// marshalBinary returns a copy of the encoded bytes, as the reader returned by Encode
+// is only valid until the message is changed.
+func marshalBinary(msg Message) ([]byte, error) {
+	src, _, err := msg.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(src)
+}
+
+func unmarshalBinary(msg Message, b []byte) error {
+	src := bytes.NewReader(b)
+
+	if _, err := msg.Decode(src); err != nil {
+		return err
+	}
+
+	if src.Len() > 0 {
+		return fmt.Errorf("marshal/UnmarshalBinary: Invalid buffer size. Still has %d bytes after the %s message.", src.Len(), msg.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetQoS(QosAtLeastOnce)
+	pub.SetPacketId(7)
+	pub.SetPayload([]byte("send me home"))
+
+	b, err := pub.MarshalBinary()
+	assert.NoError(t, true, err, "Error marshaling message.")
+
+	pub2 := NewPublishMessage()
+
+	err = pub2.UnmarshalBinary(b)
+	assert.NoError(t, true, err, "Error unmarshaling message.")
+
+	assert.Equal(t, true, pub.Topic(), pub2.Topic(), "Incorrect topic.")
+
+	assert.Equal(t, true, pub.PacketId(), pub2.PacketId(), "Incorrect packet ID.")
+
+	assert.Equal(t, true, pub.Payload(), pub2.Payload(), "Incorrect payload.")
+
+	rel := NewPubrelMessage()
+	rel.SetPacketId(7)
+
+	b, err = rel.MarshalBinary()
+	assert.NoError(t, true, err, "Error marshaling message.")
+
+	assert.Equal(t, true, []byte{byte(PUBREL<<4) | 2, 2, 0, 7}, b, "Incorrect marshaled message.")
+
+	rel2 := NewPubrelMessage()
+
+	err = rel2.UnmarshalBinary(b)
+	assert.NoError(t, true, err, "Error unmarshaling message.")
+
+	assert.Equal(t, true, 7, rel2.PacketId(), "Incorrect packet ID.")
+
+	// the bytes must be a PUBREL message
+	err = NewPubackMessage().UnmarshalBinary(b)
+	assert.Error(t, true, err)
+
+	ping := NewPingreqMessage()
+
+	b, err = ping.MarshalBinary()
+	assert.NoError(t, true, err, "Error marshaling message.")
+
+	err = NewPingreqMessage().UnmarshalBinary(b)
+	assert.NoError(t, true, err, "Error unmarshaling message.")
+
+	// trailing bytes
+	err = NewPingreqMessage().UnmarshalBinary(append(b, 0))
+	assert.Error(t, true, err)
+}
@@ -15,14 +15,29 @@
 package mqtt
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // MessageType is the type representing the MQTT packet types. In the MQTT spec,
 // MQTT control packet type is represented as a 4-bit unsigned value.
 type MessageType byte
 
+var (
+	// ErrReservedType is returned when a message of a reserved type, i.e., RESERVED or
+	// RESERVED2, is created, decoded or set, unless the type has been registered with
+	// RegisterMessageType.
+	ErrReservedType = errors.New("Reserved message type")
+
+	// ErrAuthNotSupported is returned by Decoder when it reads an AUTH message, which
+	// uses the message type 15, i.e., RESERVED2, in version 5. AUTH isn't implemented,
+	// but unlike a reserved type it's part of the protocol, so the connection may be
+	// closed with a reason code instead of being treated as malformed.
+	ErrAuthNotSupported = errors.New("AUTH message not supported")
+)
+
 // Message is an interface defined for all MQTT message types.
 type Message interface {
 	// Name returns a string representation of the message type. Examples include
@@ -46,13 +61,77 @@ type Message interface {
 	// should be considered invalid.
 	Encode() (io.Reader, int, error)
 
+	// AppendTo appends the encoded message to dst and returns the extended slice,
+	// without using the internal buffer. This lets the caller encode into memory it
+	// manages, such as a ring buffer.
+	AppendTo(dst []byte) ([]byte, error)
+
 	// Decode reads from the io.Reader parameter until a full message is decoded, or
 	// when io.Reader returns EOF or error. The first return value is the number of
 	// bytes read from io.Reader. The second is error if Decode encounters any problems.
+	// The number of bytes read is accurate even if an error is returned, so the caller
+	// can tell where the next message starts. As the whole message is read before
+	// it's decoded, this is the full message length unless reading fails.
+	// If io.Reader ends before the first byte, io.EOF is returned, whereas if it ends
+	// in the middle of the message, io.ErrUnexpectedEOF is returned, so the caller can
+	// tell an orderly shutdown from a truncated message.
 	// For the CONNECT message, the error returned could be a ConnackReturnCode, so
 	// be sure to check that. Otherwise it's a generic error. If a generic error is
 	// returned, this Message should be considered invalid.
 	Decode(io.Reader) (int, error)
+
+	// Release returns the internal buffer used for encoding and decoding to a shared
+	// pool, so it can be reused by other messages. Any byte slice obtained from the
+	// message, such as the topic or payload, as well as the io.Reader returned by
+	// Encode, MUST NOT be used after Release is called. The message itself can be
+	// reused, e.g., to decode another message.
+	Release()
+
+	// Respond returns the message the receiver is required to reply with, without any
+	// further decision by the caller, such as PINGRESP for PINGREQ. The second return
+	// value is false if there's no such reply.
+	Respond() (Message, bool)
+
+	// SizeParts returns the size in bytes of the fixed header, and of the rest of the
+	// message, e.g., to report the protocol overhead separately from the payload. The
+	// sizes are as of the last time the message was encoded or decoded.
+	SizeParts() (header, body int)
+}
+
+// PacketIDer is implemented by the messages that carry a packet identifier, which
+// are PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE and
+// UNSUBACK. Callers can type-assert a Message to PacketIDer to get the packet
+// identifier without knowing the message type. Use PacketID to also take into
+// account that a PUBLISH message with QoS 0 has no packet identifier.
+type PacketIDer interface {
+	PacketId() uint16
+}
+
+var (
+	_ PacketIDer = (*PublishMessage)(nil)
+	_ PacketIDer = (*PubackMessage)(nil)
+	_ PacketIDer = (*PubrecMessage)(nil)
+	_ PacketIDer = (*PubrelMessage)(nil)
+	_ PacketIDer = (*PubcompMessage)(nil)
+	_ PacketIDer = (*SubscribeMessage)(nil)
+	_ PacketIDer = (*SubackMessage)(nil)
+	_ PacketIDer = (*UnsubscribeMessage)(nil)
+	_ PacketIDer = (*UnsubackMessage)(nil)
+)
+
+// PacketID returns the packet identifier of the message. The second return value is
+// false if the message does not carry a packet identifier, which is the case for
+// messages that don't implement PacketIDer and for PUBLISH messages with QoS 0.
+func PacketID(msg Message) (uint16, bool) {
+	if pm, ok := msg.(*PublishMessage); ok && pm.QoS() == QosAtMostOnce {
+		return 0, false
+	}
+
+	if p, ok := msg.(PacketIDer); ok {
+		return p.PacketId(), true
+	}
+
+	return 0, false
 }
 
 const (
@@ -268,10 +347,95 @@ func (this MessageType) New() (Message, error) {
 		return NewDisconnectMessage(), nil
 	}
 
+	registryMu.RLock()
+	ctor, ok := registry[this]
+	registryMu.RUnlock()
+
+	if ok {
+		return ctor(), nil
+	}
+
+	if this.IsReserved() {
+		return nil, ErrReservedType
+	}
+
 	return nil, fmt.Errorf("msgtype/NewMessage: Invalid message type %d", this)
 }
 
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[MessageType]func() Message)
+)
+
+// RegisterMessageType registers ctor to create messages of a reserved message type,
+// i.e., RESERVED or RESERVED2, which is useful for experimenting with protocol
+// extensions. Once registered, New and DecodeMessage create messages of that type by
+// calling ctor, instead of returning an error. The message returned by ctor is
+// responsible for decoding and encoding its own fixed header. An error is returned if
+// mtype is one of the message types defined by the MQTT spec, which can't be
+// overridden, or doesn't fit in 4 bits. If ctor is nil, the registration is removed.
+func RegisterMessageType(mtype MessageType, ctor func() Message) error {
+	if !mtype.IsReserved() {
+		return fmt.Errorf("msgtype/RegisterMessageType: Cannot register message type %d, only reserved types can be registered", mtype)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if ctor == nil {
+		delete(registry, mtype)
+	} else {
+		registry[mtype] = ctor
+	}
+
+	return nil
+}
+
+// ValidFromClient checks to see if a Client is allowed to send messages of the type,
+// i.e., the type is CONNECT, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE,
+// UNSUBSCRIBE, PINGREQ or DISCONNECT. A Server can drop a Client that sends any
+// other type, such as CONNACK.
+func ValidFromClient(mtype MessageType) bool {
+	switch mtype {
+	case CONNECT, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, UNSUBSCRIBE, PINGREQ, DISCONNECT:
+		return true
+	}
+
+	return false
+}
+
+// ValidFromServer checks to see if a Server is allowed to send messages of the type,
+// i.e., the type is CONNACK, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK,
+// UNSUBACK, PINGRESP or DISCONNECT. DISCONNECT is only sent by the Server from
+// version 5 on, but it's allowed regardless, as the type alone doesn't tell the
+// version.
+func ValidFromServer(mtype MessageType) bool {
+	switch mtype {
+	case CONNACK, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, PINGRESP, DISCONNECT:
+		return true
+	}
+
+	return false
+}
+
 // Valid returns a boolean indicating whether the message type is valid or not.
 func (this MessageType) Valid() bool {
 	return this > RESERVED && this < RESERVED2
 }
+
+// IsReserved returns a boolean indicating whether the message type is one of the
+// reserved values, RESERVED or RESERVED2, regardless of the protocol version, see
+// IsReservedFor. Values that don't fit in 4 bits are invalid, but not reserved.
+func (this MessageType) IsReserved() bool {
+	return this == RESERVED || this == RESERVED2
+}
+
+// IsReservedFor is like IsReserved, but for the given protocol version. Version 5
+// assigns RESERVED2 to the AUTH message, so only RESERVED is reserved.
+func (this MessageType) IsReservedFor(version byte) bool {
+	if this == RESERVED2 && version == 0x5 {
+		return false
+	}
+
+	return this.IsReserved()
+}
@@ -28,12 +28,19 @@ package mqtt
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"regexp"
 
 	"github.com/dataence/glog"
 )
 
+var (
+	// ErrMalformedRemainingLength is returned when a variable byte integer, such as the
+	// remaining length in the fixed header, has the continuation bit set in the 4th byte.
+	ErrMalformedRemainingLength = errors.New("Malformed remaining length. 4th byte has continuation bit set.")
+)
+
 var clientIdRegexp *regexp.Regexp
 
 func init() {
@@ -44,6 +51,7 @@ const (
 	maxLPString          uint16 = 65535
 	maxFixedHeaderLength int    = 5
 	maxRemainingLength   int32  = 268435455 // bytes, or 256 MB
+	maxClientIdLength3   int    = 23        // bytes, for version 0x3
 )
 
 const (
@@ -70,35 +78,70 @@ const (
 	QosFailure = 0x80
 )
 
-// SupportedVersions is a map of the version number (0x3 or 0x4) to the version string,
-// "MQIsdp" for 0x3, and "MQTT" for 0x4.
+// SupportedVersions is a map of the version number (0x3, 0x4 or 0x5) to the version
+// string, "MQIsdp" for 0x3, and "MQTT" for 0x4 and 0x5.
 var SupportedVersions map[byte]string = map[byte]string{
 	0x3: "MQIsdp",
 	0x4: "MQTT",
+	0x5: "MQTT",
+}
+
+// KnownVersions is a map of all the protocol levels defined by the MQTT specs to the
+// protocol name. ConnectMessage.Decode rejects a level that's not known with
+// ErrUnacceptableProtocolVersion, and a known level that's not supported, or not
+// accepted, see ConnectMessage.SetAcceptedVersions, with ErrUnsupportedProtocolVersion,
+// so a Server can tell a valid CONNECT it doesn't support from garbage.
+var KnownVersions map[byte]string = map[byte]string{
+	0x3: "MQIsdp",
+	0x4: "MQTT",
+	0x5: "MQTT",
 }
 
 // CopyMessage copies a single MQTT message from the io.Reader to the io.Writer. It returns
 // the number of bytes copied and an error indicator. If an error is returned, then the
 // bytes copied should be considered invalid.
 func CopyMessage(dst io.Writer, src io.Reader) (int64, error) {
-	// Copy the first byte. This is first byte of the control packet fixed header.
-	total, err := io.CopyN(dst, src, 1)
+	return CopyMessageLimit(dst, src, 0)
+}
+
+// CopyMessageLimit is like CopyMessage, except that it returns ErrPacketTooLarge
+// without copying anything if the message, including the fixed header, is larger
+// than maxPacketSize bytes. The size is checked as soon as the remaining length is
+// read, so a too large message is rejected before its body is read. If maxPacketSize
+// is 0, only the maximum remaining length of 268435455 bytes is enforced.
+func CopyMessageLimit(dst io.Writer, src io.Reader, maxPacketSize uint32) (int64, error) {
+	var header bytes.Buffer
+
+	// Read the first byte. This is first byte of the control packet fixed header.
+	total, err := io.CopyN(&header, src, 1)
 	if err != nil {
 		return 0, err
 	}
 
-	// Read the remaining length value from io.Reader, and copy the bytes into io.Writer
-	// at the same time.
-	remlen, m, err := readVarint32(dst, src)
+	// Read the remaining length value from io.Reader. The fixed header is only copied
+	// into io.Writer once we know the message is not too large.
+	remlen, m, err := readVarint32(&header, src)
 	if err != nil {
-		return total, err
+		return total + int64(m), unexpectedEOF(err)
 	}
 	total += int64(m)
 
+	if remlen < 0 || remlen > maxRemainingLength {
+		return total, glog.NewError("Remaining length (%d) out of bound (max %d, min 0).", remlen, maxRemainingLength)
+	}
+
+	if maxPacketSize > 0 && total+int64(remlen) > int64(maxPacketSize) {
+		return total, ErrPacketTooLarge
+	}
+
+	if _, err = header.WriteTo(dst); err != nil {
+		return total, err
+	}
+
 	// Copy N bytes from io.Reader to io.Writer now that we know the remaining length.
 	n, err := io.CopyN(dst, src, int64(remlen))
 	if err != nil {
-		return total, err
+		return total, unexpectedEOF(err)
 	}
 	total += n
 
@@ -107,9 +150,9 @@ func CopyMessage(dst io.Writer, src io.Reader) (int64, error) {
 
 // ValidTopic checks the topic, which is a slice of bytes, to see if it's valid. Topic is
 // considered valid if it's longer than 0 bytes, and doesn't contain any wildcard characters
-// such as * and #.
+// such as +, * and #.
 func ValidTopic(topic []byte) bool {
-	return len(topic) > 0 && bytes.IndexByte(topic, '#') == -1 && bytes.IndexByte(topic, '*') == -1
+	return len(topic) > 0 && bytes.IndexAny(topic, "+#*") == -1
 }
 
 // ValidQos checks the QoS value to see if it's valid. Valid QoS are QosAtMostOnce,
@@ -128,7 +171,19 @@ func ValidClientId(cid []byte) bool {
 	return clientIdRegexp.Match(cid)
 }
 
-// ValidVersion checks to see if the version is valid. Current supported versions include 0x3 and 0x4.
+// ValidClientIdVersion checks the client ID against the requirement of the protocol
+// version. Version 0x3 (MQTT 3.1) requires the ClientId to be between 1 and 23 bytes
+// in length, while later versions allow Servers to accept longer ClientIds, which
+// we do. In both cases only the characters accepted by ValidClientId are allowed.
+func ValidClientIdVersion(cid []byte, v byte) bool {
+	if v == 0x3 && (len(cid) < 1 || len(cid) > maxClientIdLength3) {
+		return false
+	}
+
+	return ValidClientId(cid)
+}
+
+// ValidVersion checks to see if the version is valid. Current supported versions include 0x3, 0x4 and 0x5.
 func ValidVersion(v byte) bool {
 	_, ok := SupportedVersions[v]
 	return ok
@@ -136,7 +191,7 @@ func ValidVersion(v byte) bool {
 
 // ValidConnackError checks to see if the error is a Connack Error or not
 func ValidConnackError(err error) bool {
-	return err == ErrUnacceptableProtocolVersion || err == ErrIdentifierRejected ||
+	return err == ErrUnacceptableProtocolVersion || err == ErrUnsupportedProtocolVersion || err == ErrProtocolNameMismatch || err == ErrIdentifierRejected ||
 		err == ErrServerUnavailable || err == ErrBadUsernameOrPassword || err == ErrNotAuthorized
 }
 
@@ -153,12 +208,21 @@ func writeByte(dst io.Writer, b byte) error {
 
 func readUint16(buf *bytes.Buffer) (uint16, error) {
 	if buf.Len() < 2 {
-		return 0, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", 2, buf.Len())
+		return 0, newDecodeError(buf, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", 2, buf.Len()))
 	}
 
 	return binary.BigEndian.Uint16(buf.Next(2)), nil
 }
 
+// copyBytes returns a copy of b, or nil if b is nil.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
 func writeUint16(buf *bytes.Buffer, n uint16) error {
 	var b [2]byte
 
@@ -178,7 +242,7 @@ func readLPBytes(buf *bytes.Buffer) ([]byte, int, error) {
 	}
 
 	if buf.Len() < int(n) {
-		return nil, total, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", n, buf.Len())
+		return nil, total, newDecodeError(buf, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", n, buf.Len()))
 	}
 
 	total += int(n)
@@ -208,6 +272,29 @@ func writeLPBytes(buf *bytes.Buffer, b []byte) (int, error) {
 	return total, nil
 }
 
+// writeUTF8 writes a length prefixed UTF-8 encoded string, such as a topic or client
+// ID, which the spec requires to be valid UTF-8 without the null character U+0000.
+// Binary data, such as the password, is written with writeLPBytes instead.
+func writeUTF8(buf *bytes.Buffer, b []byte) (int, error) {
+	if !validUTF8(b) {
+		return 0, glog.NewError("Invalid UTF-8 string %q.", b)
+	}
+
+	return writeLPBytes(buf, b)
+}
+
+// unexpectedEOF replaces io.EOF with io.ErrUnexpectedEOF, for when the input stream
+// ends after part of a message has been read. io.EOF is only returned when it ends
+// cleanly in between messages, so the caller can tell an orderly shutdown from a
+// truncated message.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
 // Modified from http://golang.org/src/pkg/encoding/binary/varint.go#106
 func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 	var x int32
@@ -216,9 +303,9 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 	var buf [4]byte
 
 	for i = 0; i < 4; i++ {
-		_, err := src.Read(buf[i : i+1])
+		_, err := io.ReadFull(src, buf[i:i+1])
 		if err != nil {
-			return 0, i + 1, err
+			return 0, i, err
 		}
 
 		if buf[i] < 0x80 {
@@ -230,8 +317,12 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 		s += 7
 	}
 
-	if i > 3 || (i == 3 && buf[3]&0x80 > 0) {
-		return x, i + 1, glog.NewError("Malformed remaining length. 4th byte has continuation bit set.")
+	// At most 7 bits are added for each of the 4 bytes, so x is never more than 28
+	// bits, i.e., it's always between 0 and maxRemainingLength, and can't be negative.
+	// The loop only ends without reading a byte less than 0x80 when all 4 bytes have
+	// the continuation bit set. The value is meaningless, so 0 is returned.
+	if i > 3 {
+		return 0, i, ErrMalformedRemainingLength
 	}
 
 	if dst != nil {
@@ -243,25 +334,70 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 	return x, i + 1, nil
 }
 
-func writeVarint32(dst io.Writer, x int32) (int, error) {
+// sliceVarint32 is readVarint32 for a variable byte integer at the start of b. The
+// second return value is the number of bytes read, and io.EOF is returned if b ends
+// before the last byte of the integer.
+func sliceVarint32(b []byte) (int32, int, error) {
+	var x int32
+
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, i, io.EOF
+		}
+
+		x |= int32(b[i]&0x7f) << (7 * uint(i))
+
+		if b[i] < 0x80 {
+			return x, i + 1, nil
+		}
+	}
+
+	return 0, 4, ErrMalformedRemainingLength
+}
+
+func writeVarint32(buf *bytes.Buffer, x int32) (int, error) {
 	if x > maxRemainingLength {
 		return 0, glog.NewError("Exceeded maximum of %d", maxRemainingLength)
 	}
 
-	var buf [4]byte
+	var b [4]byte
 	i := 0
 
 	for x >= 0x80 {
-		buf[i] = byte(x) | 0x80
+		b[i] = byte(x) | 0x80
 		x >>= 7
 		i++
 	}
-	buf[i] = byte(x)
+	b[i] = byte(x)
 
-	n, err := dst.Write(buf[:i+1])
+	n, err := buf.Write(b[:i+1])
 	if err != nil {
 		return n, glog.NewError("Error writing data: %v", err)
 	}
 
 	return n, nil
 }
+
+// FixedHeaderLen returns the length of the fixed header of a message with the given
+// remaining length, i.e., the number of bytes before the variable header, which is 1
+// byte for the message type and flags, and 1 to 4 bytes for the remaining length. 0
+// is returned if the remaining length is less than 0 or greater than 268435455.
+func FixedHeaderLen(remlen int32) int {
+	if remlen < 0 || remlen > maxRemainingLength {
+		return 0
+	}
+
+	return 1 + varintLen(remlen)
+}
+
+// varintLen returns the number of bytes needed to encode x as a variable byte integer.
+func varintLen(x int32) int {
+	n := 1
+
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+
+	return n
+}
@@ -16,6 +16,7 @@ package mqtt
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/dataence/assert"
@@ -174,6 +175,42 @@ func TestMessageTypes(t *testing.T) {
 	}
 }
 
+func TestMessageTypeReserved(t *testing.T) {
+	for mtype := RESERVED; mtype <= RESERVED2+1; mtype++ {
+		assert.Equal(t, true, mtype == RESERVED || mtype == RESERVED2, mtype.IsReserved(), "Incorrect reserved value for %s.", mtype.Name())
+	}
+
+	for _, mtype := range []MessageType{RESERVED, RESERVED2} {
+		_, err := mtype.New()
+		assert.Equal(t, true, ErrReservedType, err, "Incorrect error for %s.", mtype.Name())
+
+		_, _, err = DecodeMessage(bytes.NewBuffer([]byte{byte(mtype << 4), 0}))
+		assert.Equal(t, true, ErrReservedType, err, "Incorrect error for %s.", mtype.Name())
+
+		header := &fixedHeader{}
+		assert.Equal(t, true, ErrReservedType, header.SetType(mtype), "Incorrect error for %s.", mtype.Name())
+
+		// a message of the wrong type, which is caught while copying the fixed header
+		msg := NewPingreqMessage()
+		_, err = msg.Decode(bytes.NewBuffer([]byte{byte(mtype << 4), 0}))
+		assert.Equal(t, true, ErrReservedType, err, "Incorrect error for %s.", mtype.Name())
+	}
+
+	// version 5 assigns RESERVED2 to AUTH
+	for _, v := range []byte{0x3, 0x4} {
+		assert.True(t, true, RESERVED.IsReservedFor(v), "Expecting RESERVED to be reserved.")
+		assert.True(t, true, RESERVED2.IsReservedFor(v), "Expecting RESERVED2 to be reserved.")
+	}
+
+	assert.True(t, true, RESERVED.IsReservedFor(0x5), "Expecting RESERVED to be reserved.")
+	assert.False(t, true, RESERVED2.IsReservedFor(0x5), "Expecting RESERVED2 not to be reserved.")
+
+	// values that don't fit in 4 bits are invalid, but not reserved
+	_, err := (RESERVED2 + 1).New()
+	assert.Error(t, true, err)
+	assert.NotEqual(t, true, ErrReservedType, err, "Incorrect error.")
+}
+
 func TestQosCodes(t *testing.T) {
 	if QosAtMostOnce != 0 || QosAtLeastOnce != 1 || QosExactlyOnce != 2 {
 		t.Errorf("QOS codes invalid")
@@ -235,3 +272,264 @@ func TestSupportedVersions(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketID(t *testing.T) {
+	types := []MessageType{PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK}
+
+	for _, mtype := range types {
+		msg, err := mtype.New()
+		assert.NoError(t, true, err, "Error creating message.")
+
+		if pm, ok := msg.(*PublishMessage); ok {
+			pm.SetQoS(QosAtLeastOnce)
+		}
+
+		msg.(interface {
+			SetPacketId(uint16)
+		}).SetPacketId(100)
+
+		id, ok := PacketID(msg)
+		assert.True(t, true, ok, "Expecting packet ID for "+mtype.Name()+".")
+
+		assert.Equal(t, true, 100, id, "Incorrect packet ID for "+mtype.Name()+".")
+	}
+
+	for _, mtype := range []MessageType{CONNECT, CONNACK, PINGREQ, PINGRESP, DISCONNECT} {
+		msg, err := mtype.New()
+		assert.NoError(t, true, err, "Error creating message.")
+
+		_, ok := PacketID(msg)
+		assert.False(t, true, ok, "Not expecting packet ID for "+mtype.Name()+".")
+	}
+
+	msg := NewPublishMessage()
+	msg.SetPacketId(100)
+
+	_, ok := PacketID(msg)
+	assert.False(t, true, ok, "Not expecting packet ID for PUBLISH with QoS 0.")
+}
+
+func TestCopyMessageLimit(t *testing.T) {
+	src := bytes.NewBuffer([]byte{
+		byte(PUBLISH << 4),
+		0xff, 0xff, 0xff, 0x7f, // maximum remaining length (268435455)
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+	})
+	var dst bytes.Buffer
+
+	n, err := CopyMessageLimit(&dst, src, 1024)
+	assert.Equal(t, true, ErrPacketTooLarge, err, "Incorrect error.")
+
+	assert.Equal(t, true, 5, n, "Incorrect bytes read.")
+
+	assert.Equal(t, true, 0, dst.Len(), "Not expecting bytes copied.")
+
+	assert.Equal(t, true, 9, src.Len(), "Not expecting message body read.")
+
+	src = bytes.NewBuffer(msgBytes)
+	dst.Reset()
+
+	_, err = CopyMessageLimit(&dst, src, uint32(len(msgBytes)))
+	assert.NoError(t, true, err, "Error copying message.")
+
+	assert.Equal(t, true, msgBytes, dst.Bytes(), "Incorrect message copied.")
+
+	_, err = CopyMessageLimit(&dst, bytes.NewBuffer(msgBytes), uint32(len(msgBytes)-1))
+	assert.Equal(t, true, ErrPacketTooLarge, err, "Incorrect error.")
+}
+
+// testRoundTrip encodes msg and checks the bytes against wantBytes, then decodes
+// wantBytes into a new message of the same type and checks that its fields match
+// those of msg. This makes sure a field is encoded and decoded consistently.
+func testRoundTrip(t *testing.T, msg Message, wantBytes []byte) {
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(wantBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, wantBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded bytes.")
+
+	got, err := msg.Type().New()
+	assert.NoError(t, true, err, "Error creating message.")
+
+	// Messages other than CONNECT need to know the version before decoding
+	if v, ok := msg.(versioned); ok && v.Version() != 0 {
+		err = got.(versioned).SetVersion(v.Version())
+		assert.NoError(t, true, err, "Error setting version.")
+	}
+
+	n, err = got.Decode(bytes.NewBuffer(wantBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(wantBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, messageFields(msg), messageFields(got), "Incorrect decoded fields.")
+}
+
+type versioned interface {
+	Version() byte
+	SetVersion(byte) error
+}
+
+// messageFields returns the fields of msg that are encoded, for comparing messages.
+// Byte slices are converted to strings, so nil and empty slices compare equal.
+func messageFields(msg Message) []interface{} {
+	switch msg := msg.(type) {
+	case *ConnectMessage:
+		return []interface{}{
+			msg.Version(),
+			msg.connectFlags,
+			msg.KeepAlive(),
+			string(msg.ClientId()),
+			string(msg.WillTopic()),
+			string(msg.WillMessage()),
+			string(msg.Username()),
+			string(msg.Password()),
+			msg.Properties().String(),
+			msg.WillProperties().String(),
+		}
+
+	case *PublishMessage:
+		return []interface{}{
+			msg.Flags(),
+			string(msg.Topic()),
+			msg.PacketId(),
+			string(msg.Payload()),
+			msg.Properties().String(),
+		}
+
+	case *SubscribeMessage:
+		topics := make([]string, 0, len(msg.Topics()))
+		for _, t := range msg.Topics() {
+			topics = append(topics, string(t))
+		}
+
+		return []interface{}{
+			msg.PacketId(),
+			topics,
+			msg.Qos(),
+			msg.Properties().String(),
+		}
+
+	case *SubackMessage:
+		return []interface{}{
+			msg.PacketId(),
+			msg.ReturnCodes(),
+		}
+	}
+
+	return []interface{}{msg.Name(), msg.(fmt.Stringer).String()}
+}
+
+func TestWriteUTF8(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	n, err := writeUTF8(buf, []byte("surgemq"))
+	assert.NoError(t, true, err, "Error writing string.")
+
+	assert.Equal(t, true, 9, n, "Incorrect bytes written.")
+
+	_, err = writeUTF8(buf, []byte{'a', 0xc0})
+	assert.Error(t, true, err)
+
+	_, err = writeUTF8(buf, []byte{'a', 0})
+	assert.Error(t, true, err)
+
+	// binary data can contain anything
+	_, err = writeLPBytes(buf, []byte{'a', 0xc0, 0})
+	assert.NoError(t, true, err, "Error writing bytes.")
+}
+
+func TestFixedHeaderLen(t *testing.T) {
+	tests := []struct {
+		remlen int32
+		n      int
+	}{
+		{0, 2},
+		{127, 2},
+		{128, 3},
+		{16383, 3},
+		{16384, 4},
+		{2097151, 4},
+		{2097152, 5},
+		{maxRemainingLength, 5},
+		{maxRemainingLength + 1, 0},
+		{-1, 0},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, true, test.n, FixedHeaderLen(test.remlen), "Incorrect fixed header length.")
+	}
+
+	// check against the encoded fixed header
+	for _, remlen := range []int32{127, 128, 16384, 2097152} {
+		header := &fixedHeader{mtype: PUBLISH, remlen: remlen}
+
+		_, n, err := header.Encode()
+		assert.NoError(t, true, err, "Error encoding header.")
+
+		assert.Equal(t, true, n, FixedHeaderLen(remlen), "Incorrect fixed header length.")
+	}
+}
+
+// test that variable byte integers never decode to a negative or out of bound value
+func TestReadVarint32Bounds(t *testing.T) {
+	// the largest value that fits in 4 bytes
+	b := []byte{0xff, 0xff, 0xff, 0x7f}
+
+	x, n, err := readVarint32(nil, bytes.NewBuffer(b))
+	assert.NoError(t, true, err, "Error reading varint.")
+	assert.Equal(t, true, 4, n, "Incorrect bytes read.")
+	assert.Equal(t, true, maxRemainingLength, x, "Incorrect value.")
+
+	x, n, err = sliceVarint32(b)
+	assert.NoError(t, true, err, "Error reading varint.")
+	assert.Equal(t, true, 4, n, "Incorrect bytes read.")
+	assert.Equal(t, true, maxRemainingLength, x, "Incorrect value.")
+
+	// 5 bytes would set the sign bit of an int32 (0xffffffff)
+	b = []byte{0xff, 0xff, 0xff, 0xff, 0x0f}
+
+	x, _, err = readVarint32(nil, bytes.NewBuffer(b))
+	assert.Equal(t, true, ErrMalformedRemainingLength, err, "Incorrect error.")
+	assert.Equal(t, true, int32(0), x, "Incorrect value.")
+
+	x, _, err = sliceVarint32(b)
+	assert.Equal(t, true, ErrMalformedRemainingLength, err, "Incorrect error.")
+	assert.Equal(t, true, int32(0), x, "Incorrect value.")
+
+	// the same through the fixed header
+	msg := NewPublishMessage()
+	_, err = msg.Decode(bytes.NewBuffer(append([]byte{byte(PUBLISH << 4)}, b...)))
+	assert.Error(t, true, err)
+}
+
+func TestValidDirection(t *testing.T) {
+	tests := []struct {
+		mtype      MessageType
+		fromClient bool
+		fromServer bool
+	}{
+		{RESERVED, false, false},
+		{CONNECT, true, false},
+		{CONNACK, false, true},
+		{PUBLISH, true, true},
+		{PUBACK, true, true},
+		{PUBREC, true, true},
+		{PUBREL, true, true},
+		{PUBCOMP, true, true},
+		{SUBSCRIBE, true, false},
+		{SUBACK, false, true},
+		{UNSUBSCRIBE, true, false},
+		{UNSUBACK, false, true},
+		{PINGREQ, true, false},
+		{PINGRESP, false, true},
+		{DISCONNECT, true, true},
+		{RESERVED2, false, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, true, test.fromClient, ValidFromClient(test.mtype), "Incorrect direction for "+test.mtype.Name()+" from Client.")
+		assert.Equal(t, true, test.fromServer, ValidFromServer(test.mtype), "Incorrect direction for "+test.mtype.Name()+" from Server.")
+	}
+}
@@ -54,6 +54,21 @@ func TestPingreqMessageEncode(t *testing.T) {
 	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
 }
 
+func TestPingreqMessageRespond(t *testing.T) {
+	resp, ok := NewPingreqMessage().Respond()
+	assert.True(t, true, ok, "Expecting response.")
+
+	assert.Equal(t, true, PINGRESP, resp.Type(), "Incorrect response type.")
+
+	_, ok = NewPingrespMessage().Respond()
+	assert.False(t, true, ok, "Expecting no response.")
+
+	resp, ok = NewPublishMessage().Respond()
+	assert.False(t, true, ok, "Expecting no response.")
+
+	assert.True(t, true, resp == nil, "Expecting nil response.")
+}
+
 func TestPingrespMessageDecode(t *testing.T) {
 	msgBytes := []byte{
 		byte(PINGRESP << 4),
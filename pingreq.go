@@ -32,3 +32,9 @@ func NewPingreqMessage() *PingreqMessage {
 
 	return msg
 }
+
+// Respond returns a new PINGRESP message, which the Server MUST send in response to
+// a PINGREQ.
+func (this *PingreqMessage) Respond() (Message, bool) {
+	return NewPingrespMessage(), true
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import "sync"
+
+// MessagePool recycles whole messages, keyed by message type, so a broker that
+// decodes a message, dispatches it and is then done with it doesn't allocate a new
+// message for every packet. It is safe to use from multiple goroutines.
+//
+// A message MUST NOT be used after it's returned to the pool with Put, and neither can
+// any byte slice obtained from it, such as the topic or payload, as Put releases the
+// internal buffer the slices point into. Copy anything that outlives the message,
+// such as a payload kept for a retained message, before calling Put.
+type MessagePool struct {
+	pools [RESERVED2]sync.Pool
+}
+
+// NewMessagePool creates a new, empty MessagePool.
+func NewMessagePool() *MessagePool {
+	return &MessagePool{}
+}
+
+// Get returns a message of the given type, either taken from the pool or newly
+// created, with all its fields reset as if it was created with MessageType.New.
+// Messages of reserved types registered with RegisterMessageType are not pooled, so
+// a new one is created every time. nil is returned if the type is not valid.
+func (this *MessagePool) Get(mtype MessageType) Message {
+	if mtype.Valid() {
+		if msg, ok := this.pools[mtype].Get().(Message); ok {
+			return msg
+		}
+	}
+
+	msg, err := mtype.New()
+	if err != nil {
+		return nil
+	}
+
+	return msg
+}
+
+// Put resets the message and returns it to the pool. Its internal buffer is
+// released. Messages of reserved types are dropped.
+func (this *MessagePool) Put(msg Message) {
+	if msg == nil || !msg.Type().Valid() {
+		return
+	}
+
+	msg.Release()
+
+	if resetMessage(msg) {
+		this.pools[msg.Type()].Put(msg)
+	}
+}
+
+// resetMessage sets the fields of the message back to the values set by the New*Message
+// functions. It returns false if the message is not one of the message types defined
+// by the MQTT spec.
+func resetMessage(msg Message) bool {
+	mtype := msg.Type()
+
+	switch msg := msg.(type) {
+	case *ConnectMessage:
+		*msg = ConnectMessage{}
+	case *ConnackMessage:
+		*msg = ConnackMessage{}
+	case *PublishMessage:
+		*msg = PublishMessage{}
+	case *PubackMessage:
+		*msg = PubackMessage{}
+	case *PubrecMessage:
+		*msg = PubrecMessage{}
+	case *PubrelMessage:
+		*msg = PubrelMessage{}
+	case *PubcompMessage:
+		*msg = PubcompMessage{}
+	case *SubscribeMessage:
+		*msg = SubscribeMessage{}
+	case *SubackMessage:
+		*msg = SubackMessage{}
+	case *UnsubscribeMessage:
+		*msg = UnsubscribeMessage{}
+	case *UnsubackMessage:
+		*msg = UnsubackMessage{}
+	case *PingreqMessage:
+		*msg = PingreqMessage{}
+	case *PingrespMessage:
+		*msg = PingrespMessage{}
+	case *DisconnectMessage:
+		*msg = DisconnectMessage{}
+	default:
+		return false
+	}
+
+	msg.(interface {
+		SetType(MessageType) error
+	}).SetType(mtype)
+
+	return true
+}
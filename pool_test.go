@@ -0,0 +1,109 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestMessagePool(t *testing.T) {
+	pool := NewMessagePool()
+
+	for mtype := CONNECT; mtype < RESERVED2; mtype++ {
+		msg := pool.Get(mtype)
+		assert.Equal(t, true, mtype, msg.Type(), "Incorrect message type.")
+
+		pool.Put(msg)
+	}
+
+	assert.True(t, true, pool.Get(RESERVED) == nil, "Expecting nil message.")
+
+	msg := pool.Get(PUBLISH).(*PublishMessage)
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(2)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send me home"))
+
+	pool.Put(msg)
+
+	// the message returned may or may not be the same one, but it's always reset
+	msg = pool.Get(PUBLISH).(*PublishMessage)
+
+	assert.Equal(t, true, NewPublishMessage().flags, msg.flags, "Incorrect flags.")
+
+	assert.Equal(t, true, 0, len(msg.Topic()), "Topic should be reset.")
+
+	assert.Equal(t, true, uint16(0), msg.PacketId(), "Packet ID should be reset.")
+
+	assert.Equal(t, true, 0, len(msg.Payload()), "Payload should be reset.")
+}
+
+func BenchmarkMessagePool(b *testing.B) {
+	benchmarkDecodeRecycle(b, NewMessagePool())
+}
+
+func BenchmarkMessagePoolNone(b *testing.B) {
+	benchmarkDecodeRecycle(b, nil)
+}
+
+// benchmarkDecodeRecycle decodes a message, processes it and is done with it, either
+// returning it to the pool, or leaving it to the garbage collector if pool is nil.
+func benchmarkDecodeRecycle(b *testing.B, pool *MessagePool) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/benchmark"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(bytes.Repeat([]byte{'a'}, 256))
+
+	msgBytes, err := msg.AppendTo(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	src := bytes.NewReader(bytes.Repeat(msgBytes, 1000))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msgBytes)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			src.Seek(0, 0)
+		}
+
+		var msg Message
+
+		if pool != nil {
+			msg = pool.Get(PUBLISH)
+		} else {
+			msg = NewPublishMessage()
+		}
+
+		if _, err := DecodeInto(msg, src); err != nil {
+			b.Fatal(err)
+		}
+
+		if len(msg.(*PublishMessage).Payload()) != 256 {
+			b.Fatal("Incorrect payload.")
+		}
+
+		if pool != nil {
+			pool.Put(msg)
+		}
+	}
+}
@@ -0,0 +1,795 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var (
+	// ErrTooManyUserProperties is returned when decoding properties with more user
+	// properties than the limit set with SetMaxUserProperties.
+	ErrTooManyUserProperties = errors.New("Too many user properties")
+)
+
+// PropertyId is the type representing the identifier of a property in the
+// properties section of an MQTT 5.0 message. In the MQTT spec, the property
+// identifier is encoded as a variable byte integer, but all the currently
+// defined identifiers fit in a single byte.
+type PropertyId byte
+
+const (
+	// Payload Format Indicator: byte, 0 for unspecified bytes, 1 for UTF-8 encoded
+	// character data.
+	PropPayloadFormatIndicator PropertyId = 0x01
+
+	// Message Expiry Interval: four byte integer representing the lifetime of the
+	// application message in seconds.
+	PropMessageExpiryInterval PropertyId = 0x02
+
+	// Content Type: UTF-8 encoded string describing the content of the application
+	// message.
+	PropContentType PropertyId = 0x03
+
+	// Response Topic: UTF-8 encoded string which is used as the topic name for a
+	// response message.
+	PropResponseTopic PropertyId = 0x08
+
+	// Correlation Data: binary data used by the sender of the request message to
+	// identify which request the response message is for when it is received.
+	PropCorrelationData PropertyId = 0x09
+
+	// Subscription Identifier: variable byte integer representing the identifier of
+	// the subscription. It may appear multiple times in a PUBLISH packet.
+	PropSubscriptionIdentifier PropertyId = 0x0B
+
+	// Session Expiry Interval: four byte integer representing the session expiry
+	// interval in seconds.
+	PropSessionExpiryInterval PropertyId = 0x11
+
+	// Assigned Client Identifier: UTF-8 encoded string containing the client
+	// identifier assigned by the Server.
+	PropAssignedClientIdentifier PropertyId = 0x12
+
+	// Server Keep Alive: two byte integer containing the keep alive time assigned by
+	// the Server.
+	PropServerKeepAlive PropertyId = 0x13
+
+	// Authentication Method: UTF-8 encoded string containing the name of the
+	// authentication method used for extended authentication.
+	PropAuthenticationMethod PropertyId = 0x15
+
+	// Authentication Data: binary data containing authentication data.
+	PropAuthenticationData PropertyId = 0x16
+
+	// Request Problem Information: byte, 0 or 1, indicating whether the Reason String
+	// or User Properties are sent in the case of failures.
+	PropRequestProblemInformation PropertyId = 0x17
+
+	// Will Delay Interval: four byte integer representing the will delay interval in
+	// seconds.
+	PropWillDelayInterval PropertyId = 0x18
+
+	// Request Response Information: byte, 0 or 1, requesting the Server to return
+	// Response Information in the CONNACK.
+	PropRequestResponseInformation PropertyId = 0x19
+
+	// Response Information: UTF-8 encoded string used as the basis for creating a
+	// response topic.
+	PropResponseInformation PropertyId = 0x1A
+
+	// Server Reference: UTF-8 encoded string which can be used by the Client to
+	// identify another Server to use.
+	PropServerReference PropertyId = 0x1C
+
+	// Reason String: UTF-8 encoded string representing the reason associated with a
+	// response. It is a human readable string designed for diagnostics.
+	PropReasonString PropertyId = 0x1F
+
+	// Receive Maximum: two byte integer limiting the number of QoS 1 and QoS 2
+	// publications that can be processed concurrently.
+	PropReceiveMaximum PropertyId = 0x21
+
+	// Topic Alias Maximum: two byte integer representing the highest value accepted
+	// as a Topic Alias.
+	PropTopicAliasMaximum PropertyId = 0x22
+
+	// Topic Alias: two byte integer used to identify the topic instead of using the
+	// topic name.
+	PropTopicAlias PropertyId = 0x23
+
+	// Maximum QoS: byte, 0 or 1, the maximum QoS supported by the Server.
+	PropMaximumQos PropertyId = 0x24
+
+	// Retain Available: byte, 0 or 1, declaring whether the Server supports retained
+	// messages.
+	PropRetainAvailable PropertyId = 0x25
+
+	// User Property: UTF-8 string pair. It may appear multiple times to represent
+	// multiple name, value pairs.
+	PropUserProperty PropertyId = 0x26
+
+	// Maximum Packet Size: four byte integer representing the maximum packet size
+	// the sender is willing to accept.
+	PropMaximumPacketSize PropertyId = 0x27
+
+	// Wildcard Subscription Available: byte, 0 or 1, declaring whether the Server
+	// supports wildcard subscriptions.
+	PropWildcardSubscriptionAvailable PropertyId = 0x28
+
+	// Subscription Identifier Available: byte, 0 or 1, declaring whether the Server
+	// supports subscription identifiers.
+	PropSubscriptionIdentifierAvailable PropertyId = 0x29
+
+	// Shared Subscription Available: byte, 0 or 1, declaring whether the Server
+	// supports shared subscriptions.
+	PropSharedSubscriptionAvailable PropertyId = 0x2A
+)
+
+type propertyType byte
+
+const (
+	propByte propertyType = iota
+	propUint16
+	propUint32
+	propVarint
+	propString
+	propBinary
+	propStringPair
+)
+
+var propertyTypes map[PropertyId]propertyType = map[PropertyId]propertyType{
+	PropPayloadFormatIndicator:          propByte,
+	PropMessageExpiryInterval:           propUint32,
+	PropContentType:                     propString,
+	PropResponseTopic:                   propString,
+	PropCorrelationData:                 propBinary,
+	PropSubscriptionIdentifier:          propVarint,
+	PropSessionExpiryInterval:           propUint32,
+	PropAssignedClientIdentifier:        propString,
+	PropServerKeepAlive:                 propUint16,
+	PropAuthenticationMethod:            propString,
+	PropAuthenticationData:              propBinary,
+	PropRequestProblemInformation:       propByte,
+	PropWillDelayInterval:               propUint32,
+	PropRequestResponseInformation:      propByte,
+	PropResponseInformation:             propString,
+	PropServerReference:                 propString,
+	PropReasonString:                    propString,
+	PropReceiveMaximum:                  propUint16,
+	PropTopicAliasMaximum:               propUint16,
+	PropTopicAlias:                      propUint16,
+	PropMaximumQos:                      propByte,
+	PropRetainAvailable:                 propByte,
+	PropUserProperty:                    propStringPair,
+	PropMaximumPacketSize:               propUint32,
+	PropWildcardSubscriptionAvailable:   propByte,
+	PropSubscriptionIdentifierAvailable: propByte,
+	PropSharedSubscriptionAvailable:     propByte,
+}
+
+// Valid checks to see if the property identifier is one defined by the MQTT spec.
+func (this PropertyId) Valid() bool {
+	_, ok := propertyTypes[this]
+	return ok
+}
+
+// Repeatable returns true if the property is allowed to appear more than once in
+// the same properties section. Only User Property and Subscription Identifier are.
+func (this PropertyId) Repeatable() bool {
+	return this == PropUserProperty || this == PropSubscriptionIdentifier
+}
+
+// propertySet is the set of properties allowed in the properties section of a
+// message, other than the User Property, which is allowed in all of them.
+type propertySet map[PropertyId]bool
+
+// The properties allowed in each message, see section 2.2.2.2 of the MQTT 5.0 spec.
+var (
+	connectPropertySet = propertySet{
+		PropSessionExpiryInterval:      true,
+		PropAuthenticationMethod:       true,
+		PropAuthenticationData:         true,
+		PropRequestProblemInformation:  true,
+		PropRequestResponseInformation: true,
+		PropReceiveMaximum:             true,
+		PropTopicAliasMaximum:          true,
+		PropMaximumPacketSize:          true,
+	}
+
+	willPropertySet = propertySet{
+		PropPayloadFormatIndicator: true,
+		PropMessageExpiryInterval:  true,
+		PropContentType:            true,
+		PropResponseTopic:          true,
+		PropCorrelationData:        true,
+		PropWillDelayInterval:      true,
+	}
+
+	connackPropertySet = propertySet{
+		PropSessionExpiryInterval:           true,
+		PropAssignedClientIdentifier:        true,
+		PropServerKeepAlive:                 true,
+		PropAuthenticationMethod:            true,
+		PropAuthenticationData:              true,
+		PropResponseInformation:             true,
+		PropServerReference:                 true,
+		PropReasonString:                    true,
+		PropReceiveMaximum:                  true,
+		PropTopicAliasMaximum:               true,
+		PropMaximumQos:                      true,
+		PropRetainAvailable:                 true,
+		PropMaximumPacketSize:               true,
+		PropWildcardSubscriptionAvailable:   true,
+		PropSubscriptionIdentifierAvailable: true,
+		PropSharedSubscriptionAvailable:     true,
+	}
+
+	publishPropertySet = propertySet{
+		PropPayloadFormatIndicator: true,
+		PropMessageExpiryInterval:  true,
+		PropContentType:            true,
+		PropResponseTopic:          true,
+		PropCorrelationData:        true,
+		PropSubscriptionIdentifier: true,
+		PropTopicAlias:             true,
+	}
+
+	subscribePropertySet = propertySet{
+		PropSubscriptionIdentifier: true,
+	}
+
+	subackPropertySet = propertySet{
+		PropReasonString: true,
+	}
+
+	ackPropertySet = propertySet{
+		PropReasonString: true,
+	}
+
+	unsubscribePropertySet = propertySet{}
+
+	disconnectPropertySet = propertySet{
+		PropSessionExpiryInterval: true,
+		PropServerReference:       true,
+		PropReasonString:          true,
+	}
+)
+
+type property struct {
+	id   PropertyId
+	num  uint32
+	data []byte
+}
+
+// UserProperty is a name, value pair of UTF-8 strings carried in the User Property
+// property. The meaning of user properties is not defined by the MQTT spec.
+type UserProperty struct {
+	Key, Value []byte
+}
+
+// Properties is the properties section of the variable header of an MQTT 5.0
+// message. It is encoded as a variable byte integer length followed by a list of
+// properties, each made up of an identifier and a value. Properties keep the order
+// in which they are set or decoded. User properties are kept in a separate list,
+// encoded after all other properties, so their relative order is always preserved.
+type Properties struct {
+	props        []property
+	userProps    []UserProperty
+	maxUserProps int
+}
+
+// String returns a string representation of the properties.
+func (this Properties) String() string {
+	var buf bytes.Buffer
+
+	for _, p := range this.props {
+		switch propertyTypes[p.id] {
+		case propString:
+			fmt.Fprintf(&buf, "0x%02x: %s\n", byte(p.id), p.data)
+		case propBinary:
+			fmt.Fprintf(&buf, "0x%02x: %v\n", byte(p.id), p.data)
+		default:
+			fmt.Fprintf(&buf, "0x%02x: %d\n", byte(p.id), p.num)
+		}
+	}
+
+	for _, p := range this.userProps {
+		fmt.Fprintf(&buf, "0x%02x: %s=%s\n", byte(PropUserProperty), p.Key, p.Value)
+	}
+
+	return buf.String()
+}
+
+// Has checks to see if the property is present.
+func (this *Properties) Has(id PropertyId) bool {
+	if id == PropUserProperty {
+		return len(this.userProps) > 0
+	}
+
+	return this.index(id) >= 0
+}
+
+// Uint returns the value of an integer property, whether it's a byte, two byte
+// integer, four byte integer or variable byte integer. The second return value is
+// false if the property is not present.
+func (this *Properties) Uint(id PropertyId) (uint32, bool) {
+	if i := this.index(id); i >= 0 {
+		return this.props[i].num, true
+	}
+
+	return 0, false
+}
+
+// SetUint sets the value of an integer property, replacing the existing values if
+// there are any. An error is returned if the property is not an integer property,
+// or if the value is out of range for the property.
+func (this *Properties) SetUint(id PropertyId, v uint32) error {
+	if err := validPropertyUint(id, v); err != nil {
+		return fmt.Errorf("properties/SetUint: %v", err)
+	}
+
+	if i := this.index(id); i >= 0 {
+		this.props[i].num = v
+		this.deleteFrom(i+1, id)
+		return nil
+	}
+
+	this.props = append(this.props, property{id: id, num: v})
+	return nil
+}
+
+// Uints returns all the values of an integer property, in the order they are set
+// or decoded. It's meant for Subscription Identifier, which may appear more than
+// once. It returns nil if the property is not present.
+func (this *Properties) Uints(id PropertyId) []uint32 {
+	var vals []uint32
+
+	for _, p := range this.props {
+		if p.id == id {
+			vals = append(vals, p.num)
+		}
+	}
+
+	return vals
+}
+
+// AddUint adds a value to an integer property that may appear more than once,
+// keeping the existing values. An error is returned if the property is not a
+// repeatable integer property, or if the value is out of range for the property.
+func (this *Properties) AddUint(id PropertyId, v uint32) error {
+	if !id.Repeatable() || propertyTypes[id] == propStringPair {
+		return fmt.Errorf("properties/AddUint: Property 0x%02x can't have more than one integer value", byte(id))
+	}
+
+	if err := validPropertyUint(id, v); err != nil {
+		return fmt.Errorf("properties/AddUint: %v", err)
+	}
+
+	this.props = append(this.props, property{id: id, num: v})
+	return nil
+}
+
+// Bytes returns the value of a UTF-8 string or binary data property. The second
+// return value is false if the property is not present.
+func (this *Properties) Bytes(id PropertyId) ([]byte, bool) {
+	if i := this.index(id); i >= 0 {
+		return this.props[i].data, true
+	}
+
+	return nil, false
+}
+
+// SetBytes sets the value of a UTF-8 string or binary data property, replacing
+// the existing value if there's one. An error is returned if the property is not
+// a string or binary property, or if a string property is not valid UTF-8.
+func (this *Properties) SetBytes(id PropertyId, v []byte) error {
+	if t := propertyTypes[id]; t == propStringPair {
+		return fmt.Errorf("properties/SetBytes: Invalid property 0x%02x for string or binary value", byte(id))
+	}
+
+	if err := validPropertyBytes(id, v); err != nil {
+		return fmt.Errorf("properties/SetBytes: %v", err)
+	}
+
+	if len(v) > int(maxLPString) {
+		return fmt.Errorf("properties/SetBytes: Length greater than %d bytes.", maxLPString)
+	}
+
+	if i := this.index(id); i >= 0 {
+		this.props[i].data = v
+		return nil
+	}
+
+	this.props = append(this.props, property{id: id, data: v})
+	return nil
+}
+
+// MaxUserProperties returns the maximum number of user properties accepted by decode.
+func (this *Properties) MaxUserProperties() int {
+	return this.maxUserProps
+}
+
+// SetMaxUserProperties sets the maximum number of user properties accepted when the
+// properties are decoded as part of a message, which returns ErrTooManyUserProperties
+// as soon as it reads a user property beyond the limit, bounding the memory used by a
+// message with a very large number of user properties. 0 means there's no limit,
+// which is the default. The limit does not apply to AddUserProperty.
+func (this *Properties) SetMaxUserProperties(v int) {
+	this.maxUserProps = v
+}
+
+// UserProperties returns the list of user properties, in the order they were added
+// or decoded.
+func (this *Properties) UserProperties() []UserProperty {
+	return this.userProps
+}
+
+// AddUserProperty adds a name, value pair to the end of the list of user properties.
+// The same name is allowed to appear more than once. An error is returned if the
+// key or value is not a valid UTF-8 string.
+func (this *Properties) AddUserProperty(key, value []byte) error {
+	if err := validPropertyBytes(PropUserProperty, key, value); err != nil {
+		return fmt.Errorf("properties/AddUserProperty: %v", err)
+	}
+
+	if len(key) > int(maxLPString) || len(value) > int(maxLPString) {
+		return fmt.Errorf("properties/AddUserProperty: Length greater than %d bytes.", maxLPString)
+	}
+
+	this.userProps = append(this.userProps, UserProperty{Key: key, Value: value})
+	return nil
+}
+
+// Delete removes all the values of the property. If the property does not exist it
+// just does nothing.
+func (this *Properties) Delete(id PropertyId) {
+	if id == PropUserProperty {
+		this.userProps = nil
+		return
+	}
+
+	this.deleteFrom(0, id)
+}
+
+// Len returns the number of property values, counting each repeated property.
+func (this *Properties) Len() int {
+	return len(this.props) + len(this.userProps)
+}
+
+// deleteFrom removes all the values of the property starting at index i.
+func (this *Properties) deleteFrom(i int, id PropertyId) {
+	props := this.props[:i]
+
+	for _, p := range this.props[i:] {
+		if p.id != id {
+			props = append(props, p)
+		}
+	}
+
+	this.props = props
+}
+
+func (this *Properties) index(id PropertyId) int {
+	for i, p := range this.props {
+		if p.id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// size returns the number of bytes needed to encode the properties, including
+// the length prefix.
+func (this *Properties) size() int {
+	n := this.bodySize()
+	return varintLen(int32(n)) + n
+}
+
+func (this *Properties) bodySize() int {
+	total := 0
+
+	for _, p := range this.props {
+		// 1 byte property identifier
+		total += 1
+
+		switch propertyTypes[p.id] {
+		case propByte:
+			total += 1
+		case propUint16:
+			total += 2
+		case propUint32:
+			total += 4
+		case propVarint:
+			total += varintLen(int32(p.num))
+		case propString, propBinary:
+			total += 2 + len(p.data)
+		}
+	}
+
+	for _, p := range this.userProps {
+		// 1 byte property identifier, 2 bytes length prefix for each of the strings
+		total += 1 + 2 + len(p.Key) + 2 + len(p.Value)
+	}
+
+	return total
+}
+
+// encode writes the properties to buf, prefixed by their length. The length is
+// written even if there are no properties, in which case it's the single byte 0x00.
+// An error is returned, before anything is written, for a property that isn't in
+// allowed, unless allowed is nil, in which case all the properties are.
+func (this *Properties) encode(buf *bytes.Buffer, allowed propertySet) (int, error) {
+	if allowed != nil {
+		for _, p := range this.props {
+			if !allowed[p.id] {
+				return 0, fmt.Errorf("properties/encode: Property 0x%02x not allowed in this message", byte(p.id))
+			}
+		}
+	}
+
+	total := 0
+
+	n, err := writeVarint32(buf, int32(this.bodySize()))
+	if err != nil {
+		return n, err
+	}
+	total += n
+
+	for _, p := range this.props {
+		buf.WriteByte(byte(p.id))
+		total += 1
+
+		switch propertyTypes[p.id] {
+		case propByte:
+			buf.WriteByte(byte(p.num))
+			total += 1
+
+		case propUint16:
+			writeUint16(buf, uint16(p.num))
+			total += 2
+
+		case propUint32:
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], p.num)
+			buf.Write(b[:])
+			total += 4
+
+		case propVarint:
+			if n, err = writeVarint32(buf, int32(p.num)); err != nil {
+				return total + n, err
+			}
+			total += n
+
+		case propString, propBinary:
+			if n, err = writeLPBytes(buf, p.data); err != nil {
+				return total + n, err
+			}
+			total += n
+		}
+	}
+
+	for _, p := range this.userProps {
+		buf.WriteByte(byte(PropUserProperty))
+		total += 1
+
+		if n, err = writeLPBytes(buf, p.Key); err != nil {
+			return total + n, err
+		}
+		total += n
+
+		if n, err = writeLPBytes(buf, p.Value); err != nil {
+			return total + n, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// decode reads the properties from buf, starting with their length, which is always
+// present, even if it's 0. An error is returned for a property that isn't in allowed,
+// unless allowed is nil, in which case all the properties are.
+func (this *Properties) decode(buf *bytes.Buffer, allowed propertySet) (int, error) {
+	this.props = this.props[:0]
+	this.userProps = this.userProps[:0]
+
+	l, total, err := readVarint32(nil, buf)
+	if err != nil {
+		return total, newDecodeError(buf, err)
+	}
+
+	if int(l) > buf.Len() {
+		return total, newDecodeError(buf, fmt.Errorf("properties/decode: Insufficient buffer size. Expecting %d, got %d.", l, buf.Len()))
+	}
+
+	src := bytes.NewBuffer(buf.Next(int(l)))
+	total += int(l)
+
+	for src.Len() > 0 {
+		b, _ := src.ReadByte()
+		id := PropertyId(b)
+
+		t, ok := propertyTypes[id]
+		if !ok {
+			return total, fmt.Errorf("properties/decode: Invalid property identifier 0x%02x", b)
+		}
+
+		if allowed != nil && id != PropUserProperty && !allowed[id] {
+			return total, protocolError("properties/decode", "Property 0x%02x not allowed in this message", b)
+		}
+
+		if !id.Repeatable() && this.Has(id) {
+			return total, protocolError("properties/decode", "Property 0x%02x included more than once", b)
+		}
+
+		p := property{id: id}
+
+		switch t {
+		case propByte:
+			if b, err = src.ReadByte(); err != nil {
+				return total, shiftDecodeError(newDecodeError(src, fmt.Errorf("properties/decode: Insufficient buffer size. Expecting %d, got %d.", 1, 0)), buf.Len())
+			}
+			p.num = uint32(b)
+
+		case propUint16:
+			var v uint16
+			if v, err = readUint16(src); err != nil {
+				return total, shiftDecodeError(err, buf.Len())
+			}
+			p.num = uint32(v)
+
+		case propUint32:
+			if src.Len() < 4 {
+				return total, shiftDecodeError(newDecodeError(src, fmt.Errorf("properties/decode: Insufficient buffer size. Expecting %d, got %d.", 4, src.Len())), buf.Len())
+			}
+			p.num = binary.BigEndian.Uint32(src.Next(4))
+
+		case propVarint:
+			var v int32
+			if v, _, err = readVarint32(nil, src); err != nil {
+				return total, shiftDecodeError(newDecodeError(src, err), buf.Len())
+			}
+			p.num = uint32(v)
+
+		case propString, propBinary:
+			if p.data, _, err = readLPBytes(src); err != nil {
+				return total, shiftDecodeError(err, buf.Len())
+			}
+
+		case propStringPair:
+			if this.maxUserProps > 0 && len(this.userProps) >= this.maxUserProps {
+				return total, ErrTooManyUserProperties
+			}
+
+			var up UserProperty
+
+			if up.Key, _, err = readLPBytes(src); err != nil {
+				return total, shiftDecodeError(err, buf.Len())
+			}
+
+			if up.Value, _, err = readLPBytes(src); err != nil {
+				return total, shiftDecodeError(err, buf.Len())
+			}
+
+			if err = validPropertyBytes(id, up.Key, up.Value); err != nil {
+				return total, fmt.Errorf("properties/decode: %v", err)
+			}
+
+			this.userProps = append(this.userProps, up)
+			continue
+		}
+
+		switch t {
+		case propString, propBinary:
+			err = validPropertyBytes(id, p.data)
+		default:
+			err = validPropertyUint(id, p.num)
+		}
+
+		if err != nil {
+			return total, fmt.Errorf("properties/decode: %v", err)
+		}
+
+		this.props = append(this.props, p)
+	}
+
+	return total, nil
+}
+
+// validPropertyUint checks that the property is an integer property and that the
+// value is within the range allowed by the MQTT spec.
+func validPropertyUint(id PropertyId, v uint32) error {
+	t, ok := propertyTypes[id]
+	if !ok {
+		return fmt.Errorf("Invalid property identifier 0x%02x", byte(id))
+	}
+
+	switch t {
+	case propByte:
+		if v > 0xff {
+			return fmt.Errorf("Value (%d) of property 0x%02x out of bound (max %d)", v, byte(id), 0xff)
+		}
+
+		switch id {
+		case PropPayloadFormatIndicator, PropRequestProblemInformation, PropRequestResponseInformation,
+			PropMaximumQos, PropRetainAvailable, PropWildcardSubscriptionAvailable,
+			PropSubscriptionIdentifierAvailable, PropSharedSubscriptionAvailable:
+			if v > 1 {
+				return fmt.Errorf("Value (%d) of property 0x%02x must be 0 or 1", v, byte(id))
+			}
+		}
+
+	case propUint16:
+		if v > 0xffff {
+			return fmt.Errorf("Value (%d) of property 0x%02x out of bound (max %d)", v, byte(id), 0xffff)
+		}
+
+	case propUint32:
+
+	case propVarint:
+		if v > uint32(maxRemainingLength) {
+			return fmt.Errorf("Value (%d) of property 0x%02x out of bound (max %d)", v, byte(id), maxRemainingLength)
+		}
+
+	default:
+		return fmt.Errorf("Invalid property 0x%02x for integer value", byte(id))
+	}
+
+	switch id {
+	case PropSubscriptionIdentifier, PropReceiveMaximum, PropTopicAlias, PropMaximumPacketSize:
+		if v == 0 {
+			return fmt.Errorf("Value of property 0x%02x must not be 0", byte(id))
+		}
+	}
+
+	return nil
+}
+
+// validPropertyBytes checks that the property is a string, binary or string pair
+// property, and that the strings are valid UTF-8.
+func validPropertyBytes(id PropertyId, v ...[]byte) error {
+	t, ok := propertyTypes[id]
+	if !ok {
+		return fmt.Errorf("Invalid property identifier 0x%02x", byte(id))
+	}
+
+	switch t {
+	case propBinary:
+		return nil
+
+	case propString, propStringPair:
+		for _, s := range v {
+			if !validUTF8(s) {
+				return fmt.Errorf("Property 0x%02x is not a valid UTF-8 string", byte(id))
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Invalid property 0x%02x for string or binary value", byte(id))
+}
+
+// validUTF8 checks that b is well-formed UTF-8 and does not contain the null
+// character U+0000, as required for UTF-8 encoded strings by the MQTT spec.
+func validUTF8(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) == -1
+}
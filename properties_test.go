@@ -0,0 +1,465 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+var (
+	propertyBytes []byte = []byte{
+		40,      // properties length (40)
+		0x01, 1, // payload format indicator (1)
+		0x21, 0, 10, // receive maximum (10)
+		0x11, 0, 0, 0x0e, 0x10, // session expiry interval (3600)
+		0x0B, 0x80, 0x01, // subscription identifier (128)
+		0x03, 0, 4, 't', 'e', 'x', 't', // content type
+		0x09, 0, 2, 0xff, 0x00, // correlation data
+		0x0B, 2, // subscription identifier (2)
+		0x26, 0, 3, 'k', 'e', 'y', 0, 5, 'v', 'a', 'l', 'u', 'e', // user property
+	}
+)
+
+func TestPropertiesFields(t *testing.T) {
+	props := &Properties{}
+
+	err := props.SetUint(PropPayloadFormatIndicator, 1)
+	assert.NoError(t, true, err, "Error setting byte property.")
+
+	err = props.SetUint(PropPayloadFormatIndicator, 2)
+	assert.Error(t, true, err)
+
+	err = props.SetUint(PropReceiveMaximum, 65535)
+	assert.NoError(t, true, err, "Error setting two byte integer property.")
+
+	err = props.SetUint(PropReceiveMaximum, 65536)
+	assert.Error(t, true, err)
+
+	err = props.SetUint(PropReceiveMaximum, 0)
+	assert.Error(t, true, err)
+
+	err = props.SetUint(PropSessionExpiryInterval, 0xffffffff)
+	assert.NoError(t, true, err, "Error setting four byte integer property.")
+
+	err = props.SetUint(PropSubscriptionIdentifier, uint32(maxRemainingLength))
+	assert.NoError(t, true, err, "Error setting variable byte integer property.")
+
+	err = props.SetUint(PropSubscriptionIdentifier, uint32(maxRemainingLength)+1)
+	assert.Error(t, true, err)
+
+	err = props.SetUint(PropContentType, 1)
+	assert.Error(t, true, err)
+
+	err = props.SetUint(PropertyId(0x7f), 1)
+	assert.Error(t, true, err)
+
+	err = props.SetBytes(PropContentType, []byte("text"))
+	assert.NoError(t, true, err, "Error setting string property.")
+
+	err = props.SetBytes(PropContentType, []byte{'a', 0, 'b'})
+	assert.Error(t, true, err)
+
+	err = props.SetBytes(PropContentType, []byte{0xff, 0xfe})
+	assert.Error(t, true, err)
+
+	err = props.SetBytes(PropCorrelationData, []byte{0xff, 0x00})
+	assert.NoError(t, true, err, "Error setting binary property.")
+
+	err = props.SetBytes(PropUserProperty, []byte("key"))
+	assert.Error(t, true, err)
+
+	err = props.SetBytes(PropMaximumQos, []byte("1"))
+	assert.Error(t, true, err)
+
+	v, ok := props.Uint(PropReceiveMaximum)
+	assert.True(t, true, ok, "Property should be present.")
+
+	assert.Equal(t, true, 65535, v, "Incorrect property value.")
+
+	b, ok := props.Bytes(PropContentType)
+	assert.True(t, true, ok, "Property should be present.")
+
+	assert.Equal(t, true, "text", string(b), "Incorrect property value.")
+
+	assert.Equal(t, true, 6, props.Len(), "Incorrect number of properties.")
+
+	props.Delete(PropContentType)
+	assert.False(t, true, props.Has(PropContentType), "Property should have been deleted.")
+
+	_, ok = props.Bytes(PropContentType)
+	assert.False(t, true, ok, "Property should not be present.")
+}
+
+func TestPropertyIds(t *testing.T) {
+	for id := 0; id < 0x80; id++ {
+		_, ok := propertyTypes[PropertyId(id)]
+		assert.Equal(t, true, ok, PropertyId(id).Valid(), "Incorrect property validity.")
+	}
+
+	assert.Equal(t, true, 27, len(propertyTypes), "Incorrect number of properties.")
+
+	assert.True(t, true, PropUserProperty.Repeatable(), "User property should be repeatable.")
+
+	assert.True(t, true, PropSubscriptionIdentifier.Repeatable(), "Subscription identifier should be repeatable.")
+
+	assert.False(t, true, PropResponseTopic.Repeatable(), "Response topic should not be repeatable.")
+}
+
+func TestPropertiesDecode(t *testing.T) {
+	buf := bytes.NewBuffer(propertyBytes)
+	props := &Properties{}
+
+	n, err := props.decode(buf, nil)
+	assert.NoError(t, true, err, "Error decoding properties.")
+
+	assert.Equal(t, true, len(propertyBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, 0, buf.Len(), "Incorrect bytes remaining.")
+
+	assert.Equal(t, true, 8, props.Len(), "Incorrect number of properties.")
+
+	v, _ := props.Uint(PropPayloadFormatIndicator)
+	assert.Equal(t, true, 1, v, "Incorrect payload format indicator.")
+
+	v, _ = props.Uint(PropReceiveMaximum)
+	assert.Equal(t, true, 10, v, "Incorrect receive maximum.")
+
+	v, _ = props.Uint(PropSessionExpiryInterval)
+	assert.Equal(t, true, 3600, v, "Incorrect session expiry interval.")
+
+	v, _ = props.Uint(PropSubscriptionIdentifier)
+	assert.Equal(t, true, 128, v, "Incorrect subscription identifier.")
+
+	b, _ := props.Bytes(PropContentType)
+	assert.Equal(t, true, "text", string(b), "Incorrect content type.")
+
+	b, _ = props.Bytes(PropCorrelationData)
+	assert.Equal(t, true, []byte{0xff, 0x00}, b, "Incorrect correlation data.")
+}
+
+func TestPropertiesUserProperties(t *testing.T) {
+	propBytes := []byte{
+		29,
+		0x26, 0, 1, 'b', 0, 1, '1', // user property b=1
+		0x26, 0, 1, 'a', 0, 1, '2', // user property a=2
+		0x01, 1, // payload format indicator
+		0x26, 0, 1, 'b', 0, 1, '3', // user property b=3
+		0x26, 0, 1, 'c', 0, 0, // user property c=
+	}
+
+	props := &Properties{}
+
+	_, err := props.decode(bytes.NewBuffer(propBytes), nil)
+	assert.NoError(t, true, err, "Error decoding properties.")
+
+	assert.True(t, true, props.Has(PropUserProperty), "User property should be present.")
+
+	assert.Equal(t, true, 5, props.Len(), "Incorrect number of properties.")
+
+	expected := []UserProperty{
+		{[]byte("b"), []byte("1")},
+		{[]byte("a"), []byte("2")},
+		{[]byte("b"), []byte("3")},
+		{[]byte("c"), []byte{}},
+	}
+
+	ups := props.UserProperties()
+	assert.Equal(t, true, len(expected), len(ups), "Incorrect number of user properties.")
+
+	for i, up := range ups {
+		assert.Equal(t, true, string(expected[i].Key), string(up.Key), "Incorrect user property key.")
+
+		assert.Equal(t, true, string(expected[i].Value), string(up.Value), "Incorrect user property value.")
+	}
+
+	props.Delete(PropUserProperty)
+	assert.False(t, true, props.Has(PropUserProperty), "User property should have been deleted.")
+
+	err = props.AddUserProperty([]byte("k"), []byte{0xff})
+	assert.Error(t, true, err)
+}
+
+func TestPropertiesUserPropertiesEncode(t *testing.T) {
+	propBytes := []byte{
+		36,
+		0x26, 0, 4, 'z', 'o', 'n', 'e', 0, 4, 'e', 'a', 's', 't', // zone=east
+		0x26, 0, 4, 'r', 'a', 'c', 'k', 0, 1, '7', // rack=7
+		0x26, 0, 4, 'z', 'o', 'n', 'e', 0, 4, 'w', 'e', 's', 't', // zone=west
+	}
+
+	props := &Properties{}
+	props.AddUserProperty([]byte("zone"), []byte("east"))
+	props.AddUserProperty([]byte("rack"), []byte("7"))
+	props.AddUserProperty([]byte("zone"), []byte("west"))
+
+	var buf bytes.Buffer
+
+	n, err := props.encode(&buf, nil)
+	assert.NoError(t, true, err, "Error encoding properties.")
+
+	assert.Equal(t, true, len(propBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, propBytes, buf.Bytes(), "Error encoding properties.")
+
+	props2 := &Properties{}
+
+	_, err = props2.decode(&buf, nil)
+	assert.NoError(t, true, err, "Error decoding properties.")
+
+	assert.Equal(t, true, props.UserProperties(), props2.UserProperties(), "Incorrect user properties.")
+}
+
+// test duplicate properties
+func TestPropertiesDecode2(t *testing.T) {
+	propBytes := []byte{
+		10,
+		0x08, 0, 1, 'a', // response topic
+		0x01, 1, // payload format indicator
+		0x08, 0, 1, 'b', // response topic
+	}
+
+	props := &Properties{}
+
+	_, err := props.decode(bytes.NewBuffer(propBytes), nil)
+	assert.Error(t, true, err)
+}
+
+// test invalid property identifier
+func TestPropertiesDecode3(t *testing.T) {
+	propBytes := []byte{
+		2,
+		0x04, 1,
+	}
+
+	props := &Properties{}
+
+	_, err := props.decode(bytes.NewBuffer(propBytes), nil)
+	assert.Error(t, true, err)
+}
+
+// test insufficient bytes
+func TestPropertiesDecode4(t *testing.T) {
+	propBytes := [][]byte{
+		[]byte{5, 0x11, 0, 0},
+		[]byte{3, 0x11, 0, 0},
+		[]byte{2, 0x21, 0},
+		[]byte{1, 0x01},
+		[]byte{2, 0x0B, 0x80},
+		[]byte{4, 0x03, 0, 4, 't'},
+		[]byte{6, 0x26, 0, 1, 'k', 0, 1},
+	}
+
+	for _, b := range propBytes {
+		props := &Properties{}
+
+		_, err := props.decode(bytes.NewBuffer(b), nil)
+		assert.Error(t, true, err)
+	}
+}
+
+// test invalid values
+func TestPropertiesDecode5(t *testing.T) {
+	propBytes := [][]byte{
+		[]byte{2, 0x24, 2},                  // maximum QoS 2
+		[]byte{3, 0x21, 0, 0},               // receive maximum 0
+		[]byte{2, 0x0B, 0},                  // subscription identifier 0
+		[]byte{4, 0x1F, 0, 1, 0xff},         // reason string not UTF-8
+		[]byte{7, 0x26, 0, 1, 0, 0, 1, 'v'}, // user property key not UTF-8
+	}
+
+	for _, b := range propBytes {
+		props := &Properties{}
+
+		_, err := props.decode(bytes.NewBuffer(b), nil)
+		assert.Error(t, true, err)
+	}
+}
+
+func TestPropertiesEncode(t *testing.T) {
+	props := &Properties{}
+
+	_, err := props.decode(bytes.NewBuffer(propertyBytes), nil)
+	assert.NoError(t, true, err, "Error decoding properties.")
+
+	assert.Equal(t, true, len(propertyBytes), props.size(), "Incorrect properties size.")
+
+	var buf bytes.Buffer
+
+	n, err := props.encode(&buf, nil)
+	assert.NoError(t, true, err, "Error encoding properties.")
+
+	assert.Equal(t, true, len(propertyBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, propertyBytes, buf.Bytes(), "Error encoding properties.")
+}
+
+// test empty properties
+func TestPropertiesEncode2(t *testing.T) {
+	props := &Properties{}
+
+	var buf bytes.Buffer
+
+	n, err := props.encode(&buf, nil)
+	assert.NoError(t, true, err, "Error encoding properties.")
+
+	assert.Equal(t, true, 1, n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, []byte{0}, buf.Bytes(), "Error encoding properties.")
+}
+
+func TestPropertiesEncode3(t *testing.T) {
+	propBytes := []byte{
+		12,
+		0x24, 1, // maximum QoS
+		0x13, 0, 60, // server keep alive
+		0x0B, 0xff, 0xff, 0xff, 0x7f, // subscription identifier
+		0x25, 0, // retain available
+	}
+
+	props := &Properties{}
+	props.SetUint(PropMaximumQos, 1)
+	props.SetUint(PropServerKeepAlive, 30)
+	props.SetUint(PropSubscriptionIdentifier, uint32(maxRemainingLength))
+	props.SetUint(PropRetainAvailable, 0)
+	props.SetUint(PropServerKeepAlive, 60)
+
+	var buf bytes.Buffer
+
+	n, err := props.encode(&buf, nil)
+	assert.NoError(t, true, err, "Error encoding properties.")
+
+	assert.Equal(t, true, len(propBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, propBytes, buf.Bytes(), "Error encoding properties.")
+
+	props2 := &Properties{}
+
+	_, err = props2.decode(bytes.NewBuffer(buf.Bytes()), nil)
+	assert.NoError(t, true, err, "Error decoding properties.")
+
+	v, _ := props2.Uint(PropSubscriptionIdentifier)
+	assert.Equal(t, true, maxRemainingLength, v, "Incorrect subscription identifier.")
+}
+
+// test properties that are defined, but not allowed in the message
+func TestPropertiesDecodeNotAllowed(t *testing.T) {
+	publishBytes := []byte{
+		byte(PUBLISH << 4),
+		12,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u', 'r',
+		5,          // properties length (5)
+		0x11,       // session expiry interval
+		0, 0, 0, 1, // 1 second
+		'h', 'i',
+	}
+
+	subscribeBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		14,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		5,    // properties length (5)
+		0x12, // assigned client identifier
+		0, 2, // string length (2)
+		'i', 'd',
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		's', 'u', 'r',
+		1, // subscription options, QoS 1
+	}
+
+	unsubscribeBytes := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		10,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		2,    // properties length (2)
+		0x01, // payload format indicator
+		1,    // UTF-8
+		0,    // topic filter MSB (0)
+		3,    // topic filter LSB (3)
+		's', 'u', 'r',
+	}
+
+	for _, msgBytes := range [][]byte{publishBytes, subscribeBytes, unsubscribeBytes} {
+		d := NewDecoder(bytes.NewBuffer(msgBytes))
+		d.Version = 0x5
+
+		_, _, err := d.Decode()
+		assert.Error(t, true, err)
+	}
+
+	// user properties are allowed in every message
+	unsubscribeBytes = []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		15,
+		0,                          // packet ID MSB (0)
+		7,                          // packet ID LSB (7)
+		7,                          // properties length (7)
+		0x26, 0, 1, 'a', 0, 1, '1', // a=1
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		's', 'u', 'r',
+	}
+
+	d := NewDecoder(bytes.NewBuffer(unsubscribeBytes))
+	d.Version = 0x5
+
+	msg, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 1, len(msg.(*UnsubscribeMessage).Properties().UserProperties()), "Incorrect number of user properties.")
+}
+
+// test that properties not allowed in the message are not encoded
+func TestPropertiesEncodeNotAllowed(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("sur"))
+	msg.SetPayload([]byte("hi"))
+
+	err := msg.Properties().SetUint(PropSessionExpiryInterval, 1)
+	assert.NoError(t, true, err, "Error setting property.")
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	dst, err := msg.AppendTo([]byte{1, 2})
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, []byte{1, 2}, dst, "Incorrect appended bytes.")
+
+	unsub := NewUnsubscribeMessage()
+	unsub.SetVersion(0x5)
+	unsub.SetPacketId(7)
+	unsub.AddTopic([]byte("sur"))
+
+	err = unsub.Properties().SetUint(PropPayloadFormatIndicator, 1)
+	assert.NoError(t, true, err, "Error setting property.")
+
+	_, _, err = unsub.Encode()
+	assert.Error(t, true, err)
+
+	// the message is encoded once the property is removed
+	unsub.Properties().Delete(PropPayloadFormatIndicator)
+
+	_, _, err = unsub.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
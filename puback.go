@@ -14,15 +14,46 @@
 
 package mqtt
 
-import "io"
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
 
 // A PUBACK Packet is the response to a PUBLISH Packet with QoS level 1.
 type PubackMessage struct {
 	fixedHeader
 
+	version  byte
 	packetId uint16
+
+	// Only encoded and decoded when version is 5
+	reasonCode ReasonCode
+	properties Properties
 }
 
+// pubackReasonCodes is the set of reason codes allowed in a PUBACK or PUBREC, and
+// pubrelReasonCodes the set allowed in a PUBREL or PUBCOMP, see sections 3.4.2.1,
+// 3.5.2.1, 3.6.2.1 and 3.7.2.1 of the MQTT 5.0 spec.
+var (
+	pubackReasonCodes = map[ReasonCode]bool{
+		ReasonSuccess:                     true,
+		ReasonNoMatchingSubscribers:       true,
+		ReasonUnspecifiedError:            true,
+		ReasonImplementationSpecificError: true,
+		ReasonNotAuthorized:               true,
+		ReasonTopicNameInvalid:            true,
+		ReasonPacketIdentifierInUse:       true,
+		ReasonQuotaExceeded:               true,
+		ReasonPayloadFormatInvalid:        true,
+	}
+
+	pubrelReasonCodes = map[ReasonCode]bool{
+		ReasonSuccess:                  true,
+		ReasonPacketIdentifierNotFound: true,
+	}
+)
+
 var _ Message = (*PubackMessage)(nil)
 
 // NewPubackMessage creates a new PUBACK message.
@@ -33,6 +64,58 @@ func NewPubackMessage() *PubackMessage {
 	return msg
 }
 
+// Version returns the protocol version of the connection this message is sent over.
+// The packet does not carry the version itself, but for version 5 (MQTT 5.0) the
+// variable header includes a reason code and a properties section.
+func (this *PubackMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *PubackMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("puback/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// ReasonCode returns the result of the PUBLISH, or of the PUBREL for a PUBCOMP. It's
+// only encoded and decoded when version is 5.
+func (this *PubackMessage) ReasonCode() ReasonCode {
+	return this.reasonCode
+}
+
+// SetReasonCode sets the reason code. An error is returned if the reason code is not
+// one defined for the message type, e.g., ReasonPacketIdentifierNotFound is only
+// defined for PUBREL and PUBCOMP.
+func (this *PubackMessage) SetReasonCode(code ReasonCode) error {
+	if !this.validReasonCode(code) {
+		return fmt.Errorf("puback/SetReasonCode: Invalid reason code 0x%02x for %s", byte(code), this.Name())
+	}
+
+	this.reasonCode = code
+	return nil
+}
+
+// validReasonCode checks to see if the reason code is defined for the message type.
+func (this *PubackMessage) validReasonCode(code ReasonCode) bool {
+	if t := this.Type(); t == PUBREL || t == PUBCOMP {
+		return pubrelReasonCodes[code]
+	}
+
+	return pubackReasonCodes[code]
+}
+
+// Properties returns the properties of the message, which are only encoded and
+// decoded when version is 5. Reason String and User Property are the only
+// properties allowed.
+func (this *PubackMessage) Properties() *Properties {
+	return &this.properties
+}
+
 // PacketId returns the ID of the packet.
 func (this *PubackMessage) PacketId() uint16 {
 	return this.packetId
@@ -47,18 +130,40 @@ func (this *PubackMessage) SetPacketId(v uint16) {
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *PubackMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return total, this.decodeError(err)
+	}
+
+	this.reasonCode = ReasonSuccess
+	this.properties = Properties{}
+
+	if this.version != 0x5 {
+		return total, nil
+	}
+
+	// The reason code and the properties can be omitted if the reason code is 0x00
+	// and there are no properties.
+	if this.buf.Len() > 0 {
+		b, _ := this.buf.ReadByte()
+
+		this.reasonCode = ReasonCode(b)
+		if !this.validReasonCode(this.reasonCode) {
+			// The offset is that of the reason code, which has already been read
+			err = newDecodeError(this.buf, fmt.Errorf("puback/Decode: Invalid reason code 0x%02x for %s", b, this.Name()))
+			return total, this.decodeError(shiftDecodeError(err, 1))
+		}
+	}
+
+	if this.buf.Len() > 0 {
+		if _, err = this.properties.decode(this.buf, ackPropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
 	}
-	total += 2
 
 	return total, nil
 }
@@ -69,17 +174,65 @@ func (this *PubackMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *PubackMessage) Encode() (io.Reader, int, error) {
-	this.SetRemainingLength(2)
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *PubackMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *PubackMessage) encode(buf *bytes.Buffer) (int, error) {
+	encodeReason := this.version == 0x5 && (this.reasonCode != ReasonSuccess || this.properties.Len() > 0)
 
-	_, total, err := this.fixedHeader.Encode()
+	if encodeReason {
+		if err := this.setEncodedLength(3 + int64(this.properties.size())); err != nil {
+			return 0, err
+		}
+	} else {
+		this.SetRemainingLength(2)
+	}
+
+	total, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
 
-	if err = writeUint16(this.buf, this.packetId); err != nil {
-		return nil, 0, err
+	if err = writeUint16(buf, this.packetId); err != nil {
+		return 0, err
 	}
 	total += 2
 
-	return this.buf, total, nil
+	if !encodeReason {
+		return total, nil
+	}
+
+	if err = buf.WriteByte(this.reasonCode.Value()); err != nil {
+		return 0, err
+	}
+	total += 1
+
+	n, err := this.properties.encode(buf, ackPropertySet)
+	if err != nil {
+		return 0, err
+	}
+	total += n
+
+	return total, nil
 }
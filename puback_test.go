@@ -62,8 +62,31 @@ func TestPubackMessageDecode2(t *testing.T) {
 	src := bytes.NewBuffer(msgBytes)
 	msg := NewPubackMessage()
 
-	_, err := msg.Decode(src)
+	n, err := msg.Decode(src)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+}
+
+// test remaining length too short for the packet ID
+func TestPubackMessageDecode3(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		1,
+		0, // packet ID MSB (0)
+		byte(PINGREQ << 4),
+		0,
+	}
+
+	src := bytes.NewBuffer(msgBytes)
+	msg := NewPubackMessage()
+
+	n, err := msg.Decode(src)
 	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 3, n, "Incorrect bytes read.")
+
+	assert.Equal(t, true, 2, src.Len(), "Incorrect bytes remaining.")
 }
 
 func TestPubackMessageEncode(t *testing.T) {
@@ -15,8 +15,13 @@
 package mqtt
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 // A PUBLISH Control Packet is sent from a Client to a Server or from Server to a Client
@@ -24,13 +29,28 @@ import (
 type PublishMessage struct {
 	fixedHeader
 
-	packetId uint16
-	topic    []byte
-	payload  []byte
+	version    byte
+	packetId   uint16
+	topic      []byte
+	properties Properties
+	payload    []byte
+
+	// Only set when the message is decoded with DecodeStream
+	payloadReader io.Reader
+
+	// qosLimit is the maximum QoS accepted by SetQoS and Decode plus one, so the zero
+	// value means there's no limit
+	qosLimit byte
 }
 
 var _ Message = (*PublishMessage)(nil)
 
+var (
+	// ErrQosNotSupported is returned when setting or decoding a QoS larger than the
+	// maximum set with SetMaxQoS.
+	ErrQosNotSupported = errors.New("QoS not supported")
+)
+
 // NewPublishMessage creates a new PUBLISH message.
 func NewPublishMessage() *PublishMessage {
 	msg := &PublishMessage{}
@@ -39,9 +59,59 @@ func NewPublishMessage() *PublishMessage {
 	return msg
 }
 
+// maxPayloadString is the maximum number of payload bytes included by String.
+const maxPayloadString = 64
+
+// String returns a string representation of the PUBLISH message. Only the first 64
+// bytes of the payload are included, and non-printable bytes are hex-escaped, so
+// large or binary payloads can be logged safely.
 func (this PublishMessage) String() string {
 	return fmt.Sprintf("%v\nTopic: %s\nPacket ID: %d\nPayload: %s\n",
-		this.fixedHeader, this.topic, this.packetId, string(this.payload))
+		this.fixedHeader, this.topic, this.packetId, payloadString(this.payload))
+}
+
+func payloadString(payload []byte) string {
+	var buf bytes.Buffer
+
+	b := payload
+	if len(b) > maxPayloadString {
+		b = b[:maxPayloadString]
+	}
+
+	for _, c := range b {
+		switch {
+		case c == '\\':
+			buf.WriteString(`\\`)
+		case c >= 0x20 && c < 0x7f:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "\\x%02x", c)
+		}
+	}
+
+	if len(b) < len(payload) {
+		fmt.Fprintf(&buf, "... (%d bytes total)", len(payload))
+	}
+
+	return buf.String()
+}
+
+// Version returns the protocol version of the connection this message is sent over.
+// The PUBLISH packet does not carry the version itself, but for version 5 (MQTT 5.0)
+// the variable header includes a properties section.
+func (this *PublishMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *PublishMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("publish/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
 }
 
 // Dup returns the value specifying the duplicate delivery of a PUBLISH Control Packet.
@@ -54,12 +124,36 @@ func (this *PublishMessage) Dup() bool {
 }
 
 // SetDup sets the value specifying the duplicate delivery of a PUBLISH Control Packet.
-func (this *PublishMessage) SetDup(v bool) {
+// The DUP flag MUST be set to 0 for all QoS 0 messages [MQTT-3.3.1-2], so an error is
+// returned, and the flag is left unchanged, when setting it on a QoS 0 message. Set
+// the QoS before setting the DUP flag.
+func (this *PublishMessage) SetDup(v bool) error {
+	if v && this.QoS() == QosAtMostOnce {
+		return fmt.Errorf("publish/SetDup: DUP flag must not be set for QoS 0 messages.")
+	}
+
 	if v {
 		this.flags |= 0x8 // 00001000
 	} else {
 		this.flags &= 247 // 11110111
 	}
+
+	return nil
+}
+
+// MarkRetransmit sets the DUP flag and encodes the message, for retransmitting a QoS 1
+// or QoS 2 message that has not been acknowledged. The DUP flag MUST be set when a
+// message is retransmitted [MQTT-3.3.1-1], including when a Client resends the
+// unacknowledged messages of a Session after reconnecting [MQTT-4.4.0-1], in which
+// case the message is usually rebuilt from the stored Session state. The DUP flag
+// MUST be 0 the first time a message is sent, which is up to the caller. An error is
+// returned for QoS 0 messages. The return values are the same as Encode.
+func (this *PublishMessage) MarkRetransmit() (io.Reader, int, error) {
+	if err := this.SetDup(true); err != nil {
+		return nil, 0, err
+	}
+
+	return this.Encode()
 }
 
 // Retain returns the value of the RETAIN flag. This flag is only used on the PUBLISH
@@ -87,13 +181,88 @@ func (this *PublishMessage) QoS() byte {
 
 // SetQoS sets the field that indicates the level of assurance for delivery of an
 // Application Message. The values are QosAtMostOnce, QosAtLeastOnce and QosExactlyOnce.
-// An error is returned if the value is not one of these.
+// An error is returned if the value is not one of these, and ErrQosNotSupported if
+// it's larger than MaxQoS. Setting the QoS to QosAtMostOnce also clears the DUP flag.
 func (this *PublishMessage) SetQoS(v byte) error {
 	if v != 0x0 && v != 0x1 && v != 0x2 {
 		return fmt.Errorf("publish/SetQoS: Invalid QoS %d.", v)
 	}
 
+	if v > this.MaxQoS() {
+		return ErrQosNotSupported
+	}
+
 	this.flags = (this.flags & 249) | (v << 1) // 243 = 11111001
+
+	if v == QosAtMostOnce {
+		this.flags &= 247 // 11110111
+	}
+
+	return nil
+}
+
+// PublishFlags is the DUP flag, QoS and RETAIN flag of a PUBLISH message, which are
+// encoded in the flags of the fixed header.
+type PublishFlags struct {
+	Dup    bool
+	QoS    byte
+	Retain bool
+}
+
+// PublishFlags returns the DUP flag, QoS and RETAIN flag of the message, e.g., for
+// logging.
+func (this *PublishMessage) PublishFlags() PublishFlags {
+	return PublishFlags{
+		Dup:    this.Dup(),
+		QoS:    this.QoS(),
+		Retain: this.Retain(),
+	}
+}
+
+// SetPublishFlags sets the DUP flag, QoS and RETAIN flag of the message. An error is
+// returned, and the flags are left unchanged, if the QoS is invalid or larger than
+// MaxQoS, or if the DUP flag is set for QoS 0, the same as SetQoS and SetDup.
+func (this *PublishMessage) SetPublishFlags(f PublishFlags) error {
+	if !ValidQos(f.QoS) {
+		return fmt.Errorf("publish/SetPublishFlags: Invalid QoS %d.", f.QoS)
+	}
+
+	if f.QoS > this.MaxQoS() {
+		return ErrQosNotSupported
+	}
+
+	if f.Dup && f.QoS == QosAtMostOnce {
+		return fmt.Errorf("publish/SetPublishFlags: DUP flag must not be set for QoS 0 messages.")
+	}
+
+	this.SetQoS(f.QoS)
+	this.SetDup(f.Dup)
+	this.SetRetain(f.Retain)
+
+	return nil
+}
+
+// MaxQoS returns the maximum QoS accepted by SetQoS and Decode.
+func (this *PublishMessage) MaxQoS() byte {
+	if this.qosLimit == 0 {
+		return QosExactlyOnce
+	}
+
+	return this.qosLimit - 1
+}
+
+// SetMaxQoS sets the maximum QoS accepted by SetQoS and Decode, which return
+// ErrQosNotSupported for a larger QoS, e.g., for a Server that doesn't support QoS 2.
+// It's the same as the Maximum QoS a version 5 Server sends in the CONNACK, but
+// applies to every version. The default is QosExactlyOnce, i.e., there's no limit.
+// The QoS of the message is left unchanged. An error is returned if v is not a valid
+// QoS.
+func (this *PublishMessage) SetMaxQoS(v byte) error {
+	if !ValidQos(v) {
+		return fmt.Errorf("publish/SetMaxQoS: Invalid QoS %d.", v)
+	}
+
+	this.qosLimit = v + 1
 	return nil
 }
 
@@ -114,6 +283,22 @@ func (this *PublishMessage) SetTopic(v []byte) error {
 	return nil
 }
 
+// RewriteTopic replaces the topic name with a copy of v, e.g., for a proxy that maps
+// the topics of its Clients into a namespace of their own before forwarding the
+// message. Unlike SetTopic, which keeps v as is, the message owns the copy, so the
+// caller can reuse v. It's safe to call on a decoded message: the other fields still
+// point into the decode buffer, which Encode never writes to, and the remaining
+// length is calculated again when the message is encoded. ErrInvalidTopic is
+// returned if v is empty, contains wildcard characters, or is not valid UTF-8.
+func (this *PublishMessage) RewriteTopic(v []byte) error {
+	if !ValidTopic(v) || !validUTF8(v) {
+		return ErrInvalidTopic
+	}
+
+	this.topic = append([]byte(nil), v...)
+	return nil
+}
+
 // PacketId returns the ID of the packet. It is only present in PUBLISH Packets where
 // the QoS level is 1 or 2.
 func (this *PublishMessage) PacketId() uint16 {
@@ -125,6 +310,156 @@ func (this *PublishMessage) SetPacketId(v uint16) {
 	this.packetId = v
 }
 
+// Downgrade returns a copy of the message for sending over a connection with an
+// earlier protocol version, such as when bridging a version 5 publisher to a version
+// 3.1.1 subscriber. The topic, payload, packet ID, QoS, RETAIN and DUP flags are kept,
+// while the properties, which only exist in version 5, are dropped. An error is
+// returned if toVersion is not a supported version before 5, if the message has no
+// topic, e.g., a topic alias was used instead and not resolved by the caller, or if
+// the payload was not read into memory because the message was decoded with
+// DecodeStream.
+func (this *PublishMessage) Downgrade(toVersion byte) (*PublishMessage, error) {
+	if !ValidVersion(toVersion) || toVersion == 0x5 {
+		return nil, fmt.Errorf("publish/Downgrade: Invalid version number %d", toVersion)
+	}
+
+	if len(this.topic) == 0 {
+		return nil, fmt.Errorf("publish/Downgrade: Topic name is empty. Topic aliases must be resolved before downgrading.")
+	}
+
+	if this.payloadReader != nil {
+		return nil, fmt.Errorf("publish/Downgrade: Payload must be read into memory before downgrading.")
+	}
+
+	msg := NewPublishMessage()
+	msg.version = toVersion
+	msg.flags = this.flags
+	msg.packetId = this.packetId
+	msg.topic = copyBytes(this.topic)
+	msg.payload = copyBytes(this.payload)
+
+	return msg, nil
+}
+
+// Ack returns the message the receiver replies with to acknowledge the PUBLISH, which
+// is a PUBACK for QoS 1, and a PUBREC for QoS 2, with the same packet ID and version.
+// An error is returned for QoS 0, as those messages are not acknowledged.
+func (this *PublishMessage) Ack() (Message, error) {
+	switch this.QoS() {
+	case QosAtLeastOnce:
+		msg := NewPubackMessage()
+		msg.version = this.version
+		msg.SetPacketId(this.packetId)
+		return msg, nil
+
+	case QosExactlyOnce:
+		msg := NewPubrecMessage()
+		msg.version = this.version
+		msg.SetPacketId(this.packetId)
+		return msg, nil
+	}
+
+	return nil, fmt.Errorf("publish/Ack: QoS %d messages are not acknowledged", this.QoS())
+}
+
+// Properties returns the properties of the message. Properties are only encoded
+// and decoded when the message version is 5.
+func (this *PublishMessage) Properties() *Properties {
+	return &this.properties
+}
+
+// ResponseTopic returns the topic name for a response message. It is used in the
+// MQTT 5.0 request/response pattern, and is nil if not present.
+func (this *PublishMessage) ResponseTopic() []byte {
+	v, _ := this.properties.Bytes(PropResponseTopic)
+	return v
+}
+
+// SetResponseTopic sets the topic name for a response message. An error is returned
+// if ValidTopic() is false. Setting it to an empty value removes the property.
+func (this *PublishMessage) SetResponseTopic(v []byte) error {
+	if len(v) == 0 {
+		this.properties.Delete(PropResponseTopic)
+		return nil
+	}
+
+	if !ValidTopic(v) {
+		return fmt.Errorf("publish/SetResponseTopic: Invalid topic name (%s). Must not be empty or contain wildcard characters", string(v))
+	}
+
+	return this.properties.SetBytes(PropResponseTopic, v)
+}
+
+// CorrelationData returns the binary data used by the sender of a request message
+// to identify which request the response message is for. It is nil if not present.
+func (this *PublishMessage) CorrelationData() []byte {
+	v, _ := this.properties.Bytes(PropCorrelationData)
+	return v
+}
+
+// SetCorrelationData sets the correlation data of the message. Setting it to an
+// empty value removes the property.
+func (this *PublishMessage) SetCorrelationData(v []byte) {
+	if len(v) == 0 {
+		this.properties.Delete(PropCorrelationData)
+		return
+	}
+
+	this.properties.SetBytes(PropCorrelationData, v)
+}
+
+// MessageExpiryInterval returns the lifetime of the application message in seconds.
+// The second return value is false if the property is not present, in which case
+// the message does not expire.
+func (this *PublishMessage) MessageExpiryInterval() (uint32, bool) {
+	return this.properties.Uint(PropMessageExpiryInterval)
+}
+
+// SetMessageExpiryInterval sets the lifetime of the application message in seconds.
+func (this *PublishMessage) SetMessageExpiryInterval(v uint32) {
+	this.properties.SetUint(PropMessageExpiryInterval, v)
+}
+
+// DecrementMessageExpiryInterval reduces the message expiry interval by the time the
+// message has been held, rounded down to whole seconds. This is used by the Server
+// when forwarding a message, as the forwarded PUBLISH must carry the original
+// interval minus the time the message has been waiting. It returns false if the
+// message has expired and must not be forwarded. Messages without an expiry interval
+// never expire.
+func (this *PublishMessage) DecrementMessageExpiryInterval(held time.Duration) bool {
+	v, ok := this.MessageExpiryInterval()
+	if !ok {
+		return true
+	}
+
+	secs := held / time.Second
+	if secs < 0 {
+		secs = 0
+	}
+
+	if secs >= time.Duration(v) {
+		return false
+	}
+
+	this.SetMessageExpiryInterval(v - uint32(secs))
+	return true
+}
+
+// SubscriptionIdentifiers returns the identifiers of the subscriptions that matched
+// the message, which the Server includes when forwarding the message to a Client
+// that set them in its SUBSCRIBE messages. There may be more than one if the message
+// matched several subscriptions. It returns nil if there are none.
+func (this *PublishMessage) SubscriptionIdentifiers() []uint32 {
+	return this.properties.Uints(PropSubscriptionIdentifier)
+}
+
+// AddSubscriptionIdentifier adds the identifier of a subscription that matched the
+// message, keeping the ones already added. An error is returned if the identifier
+// is 0 or larger than 268435455.
+func (this *PublishMessage) AddSubscriptionIdentifier(v uint32) error {
+	return this.properties.AddUint(PropSubscriptionIdentifier, v)
+}
+
 // Payload returns the application message that's part of the PUBLISH message.
 func (this *PublishMessage) Payload() []byte {
 	return this.payload
@@ -133,19 +468,183 @@ func (this *PublishMessage) Payload() []byte {
 // SetPayload sets the application message that's part of the PUBLISH message.
 func (this *PublishMessage) SetPayload(v []byte) {
 	this.payload = v
+	this.payloadReader = nil
+}
+
+// PayloadString returns the application message as a string. Like Payload, it's
+// empty if the message was decoded with DecodeStream, which leaves the payload in
+// PayloadReader.
+func (this *PublishMessage) PayloadString() string {
+	return string(this.payload)
+}
+
+// SetPayloadString sets the application message to the bytes of v, which saves
+// converting text payloads.
+func (this *PublishMessage) SetPayloadString(v string) {
+	this.SetPayload([]byte(v))
+}
+
+// PayloadReader returns an io.Reader from which the application message can be read.
+// If the message is decoded with DecodeStream, the payload is read directly from the
+// source the message is decoded from. Otherwise the reader reads from Payload().
+func (this *PublishMessage) PayloadReader() io.Reader {
+	if this.payloadReader != nil {
+		return this.payloadReader
+	}
+
+	return bytes.NewReader(this.payload)
+}
+
+// ContentHash returns a SHA-256 hash of the topic, payload, QoS and retain flag of
+// the message, e.g., for a Server to key the retained messages it stores. The DUP
+// flag and the packet ID are deliberately left out, as they change from one
+// transmission of the same message to the next, and so are the properties. It
+// returns nil if the payload was not read into memory because the message was
+// decoded with DecodeStream.
+func (this *PublishMessage) ContentHash() []byte {
+	if this.payloadReader != nil {
+		return nil
+	}
+
+	h := sha256.New()
+
+	// The topic is length prefixed, so the topic and payload can't be shifted into
+	// each other
+	var hdr [4]byte
+	hdr[0] = this.QoS()
+	if this.Retain() {
+		hdr[1] = 1
+	}
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(this.topic)))
+
+	h.Write(hdr[:])
+	h.Write(this.topic)
+	h.Write(this.payload)
+
+	return h.Sum(nil)
+}
+
+// PayloadEqual checks to see if a and b are both PUBLISH messages with the same
+// application message, e.g., for a Server to skip storing a retained message that's
+// identical to the one it already has. Only the payloads are compared, and a nil
+// payload is equal to an empty one. It returns false if either message is not a
+// PUBLISH, or if its payload was not read into memory because the message was
+// decoded with DecodeStream.
+func PayloadEqual(a, b Message) bool {
+	pa, ok := a.(*PublishMessage)
+	if !ok || pa.payloadReader != nil {
+		return false
+	}
+
+	pb, ok := b.(*PublishMessage)
+	if !ok || pb.payloadReader != nil {
+		return false
+	}
+
+	return bytes.Equal(pa.payload, pb.payload)
 }
 
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *PublishMessage) Decode(src io.Reader) (int, error) {
-	total := 0
+	total, err := this.fixedHeader.Decode(src)
+	if err != nil {
+		return total, err
+	}
+
+	if _, err = this.decodeVariableHeader(); err != nil {
+		return total, this.decodeError(err)
+	}
+
+	this.payload = this.buf.Next(this.buf.Len())
+	this.payloadReader = nil
+
+	return total, nil
+}
 
-	n, err := this.fixedHeader.Decode(src)
+// DecodeStream is like Decode, except that only the fixed header and the variable
+// header are read from src. The payload is left in src, and must be read using
+// PayloadReader(), which is useful for messages too large to be kept in memory.
+// The first return value is the number of bytes read from io.Reader, excluding the
+// payload. Payload() returns nil for a message decoded this way.
+//
+// The reader returned by PayloadReader() MUST be drained before the next message is
+// read from src, otherwise the remaining payload bytes are read as the start of the
+// next message.
+func (this *PublishMessage) DecodeStream(src io.Reader) (int, error) {
+	this.resetBuf()
+	this.payload = nil
+	this.payloadReader = nil
+
+	m, err := this.copyHeader(src)
 	if err != nil {
+		return int(m), err
+	}
+	total := int(m)
+
+	// Topic length
+	if n, err := this.copyVariableHeader(src, 2); err != nil {
 		return total + n, err
 	}
-	total += n
+	total += 2
+
+	l := int(binary.BigEndian.Uint16(this.buf.Bytes()))
+	if this.QoS() != 0 {
+		l += 2
+	}
+
+	if n, err := this.copyVariableHeader(src, l); err != nil {
+		return total + n, err
+	}
+	total += l
+
+	if this.version == 0x5 {
+		pl, n, err := readVarint32(this.buf, src)
+		if err != nil {
+			return total + n, unexpectedEOF(err)
+		}
+		total += n
+
+		if n, err = this.copyVariableHeader(src, int(pl)); err != nil {
+			return total + n, err
+		}
+		total += int(pl)
+	}
+
+	// The variable header is fully buffered before decoding it, as the slices returned
+	// by readLPBytes would be invalidated if the buffer had to grow.
+	if _, err = this.decodeVariableHeader(); err != nil {
+		// The payload is not in the buffer, so it's not included in the remaining bytes
+		return total, this.decodeError(shiftDecodeError(err, int(this.remlen)-(total-int(m))))
+	}
+
+	this.payloadReader = io.LimitReader(src, int64(this.remlen)-int64(total-int(m)))
+
+	return total, nil
+}
+
+// copyVariableHeader copies n bytes of the variable header from src into the buffer,
+// making sure it does not go beyond the remaining length.
+func (this *PublishMessage) copyVariableHeader(src io.Reader, n int) (int, error) {
+	if this.buf.Len()+n > int(this.remlen) {
+		return 0, fmt.Errorf("publish/DecodeStream: Insufficient remaining length. Expecting at least %d bytes, got %d bytes.", this.buf.Len()+n, this.remlen)
+	}
+
+	m, err := io.CopyN(this.buf, src, int64(n))
+	return int(m), unexpectedEOF(err)
+}
+
+func (this *PublishMessage) decodeVariableHeader() (int, error) {
+	var (
+		n     int
+		total int
+		err   error
+	)
+
+	if this.QoS() > this.MaxQoS() {
+		return 0, ErrQosNotSupported
+	}
 
 	if this.topic, n, err = readLPBytes(this.buf); err != nil {
 		return total + n, err
@@ -158,6 +657,8 @@ func (this *PublishMessage) Decode(src io.Reader) (int, error) {
 
 	// The packet identifier field is only present in the PUBLISH packets where the
 	// QoS level is 1 or 2
+	this.packetId = 0
+
 	if this.QoS() != 0 {
 		if this.packetId, err = readUint16(this.buf); err != nil {
 			return 0, err
@@ -165,8 +666,16 @@ func (this *PublishMessage) Decode(src io.Reader) (int, error) {
 		total += 2
 	}
 
-	this.payload = this.buf.Next(this.buf.Len())
-	total += len(this.payload)
+	if this.version == 0x5 {
+		if n, err = this.properties.decode(this.buf, publishPropertySet); err != nil {
+			return total + n, err
+		}
+		total += n
+
+		if v, ok := this.properties.Bytes(PropResponseTopic); ok && !ValidTopic(v) {
+			return total, fmt.Errorf("publish/Decode: Invalid response topic (%s). Must not be empty or contain wildcard characters", string(v))
+		}
+	}
 
 	return total, nil
 }
@@ -177,45 +686,111 @@ func (this *PublishMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *PublishMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *PublishMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// EncodeTrusted is like Encode, except that the fields are not validated, which
+// saves the work for a message that's known to be well-formed, such as a PUBLISH a
+// broker decoded once and forwards to many subscribers. In particular the topic is
+// not checked to be valid UTF-8. Only the remaining length is still checked, so the
+// fixed header is always valid. Encoding an invalid message with EncodeTrusted
+// produces a packet the receiver may reject.
+func (this *PublishMessage) EncodeTrusted() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encodeFields(buf, false)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *PublishMessage) encode(buf *bytes.Buffer) (int, error) {
 	if len(this.topic) == 0 {
-		return nil, 0, fmt.Errorf("publish/Encode: Topic name is empty.")
+		return 0, fmt.Errorf("publish/Encode: Topic name is empty.")
 	}
 
 	if len(this.payload) == 0 {
-		return nil, 0, fmt.Errorf("publish/Encode: Payload is empty.")
+		return 0, fmt.Errorf("publish/Encode: Payload is empty.")
 	}
 
-	total := 2 + len(this.topic) + len(this.payload)
+	return this.encodeFields(buf, true)
+}
+
+// encodeFields writes the fields of the message to buf once they are validated by
+// encode, or not at all by EncodeTrusted. If validate is false, the topic is written
+// without checking it's valid UTF-8.
+func (this *PublishMessage) encodeFields(buf *bytes.Buffer, validate bool) (int, error) {
+	remlen := int64(2+len(this.topic)) + int64(len(this.payload))
 	if this.QoS() != 0 {
-		total += 2
+		remlen += 2
+	}
+	if this.version == 0x5 {
+		remlen += int64(this.properties.size())
+	}
+	if err := this.setEncodedLength(remlen); err != nil {
+		return 0, err
 	}
-	this.SetRemainingLength(int32(total))
 
-	total = 0
+	total := 0
 
-	_, n, err := this.fixedHeader.Encode()
+	n, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, total, err
+		return total, err
 	}
 	total += n
 
-	if n, err = writeLPBytes(this.buf, this.topic); err != nil {
-		return nil, total, err
+	if validate {
+		n, err = writeUTF8(buf, this.topic)
+	} else {
+		n, err = writeLPBytes(buf, this.topic)
+	}
+	if err != nil {
+		return total, err
 	}
 	total += n
 
 	// The packet identifier field is only present in the PUBLISH packets where the QoS level is 1 or 2
 	if this.QoS() != 0 {
-		if err = writeUint16(this.buf, this.packetId); err != nil {
-			return nil, total, err
+		if err = writeUint16(buf, this.packetId); err != nil {
+			return total, err
 		}
 		total += 2
 	}
 
-	if n, err = this.buf.Write(this.payload); err != nil {
-		return nil, total, err
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, publishPropertySet); err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	if n, err = buf.Write(this.payload); err != nil {
+		return total, err
 	}
 	total += n
 
-	return this.buf, total, nil
+	return total, nil
 }
@@ -16,7 +16,11 @@ package mqtt
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dataence/assert"
 )
@@ -50,9 +54,21 @@ func TestPublishMessageFixedHeaderFields(t *testing.T) {
 
 	assert.Equal(t, true, 0, msg.QoS(), "Incorrect QoS.")
 
-	msg.SetDup(true)
+	err = msg.SetDup(true)
+	assert.Error(t, true, err)
+
+	assert.False(t, true, msg.Dup(), "Incorrect DUP flag.")
+
+	msg.SetQoS(1)
+
+	err = msg.SetDup(true)
+	assert.NoError(t, true, err, "Error setting DUP flag.")
+
 	assert.True(t, true, msg.Dup(), "Incorrect DUP flag.")
 
+	msg.SetQoS(0)
+	assert.False(t, true, msg.Dup(), "DUP flag should be cleared for QoS 0.")
+
 	msg.SetRetain(true)
 	assert.True(t, true, msg.Retain(), "Incorrect RETAIN flag.")
 }
@@ -156,12 +172,7 @@ func TestPublishMessageEncode(t *testing.T) {
 	msg.SetPacketId(7)
 	msg.SetPayload([]byte{'s', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e'})
 
-	dst, n, err := msg.Encode()
-	assert.NoError(t, true, err, "Error decoding message.")
-
-	assert.Equal(t, true, len(msgBytes), n, "Error decoding message.")
-
-	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
+	testRoundTrip(t, msg, msgBytes)
 }
 
 // test empty topic name
@@ -191,10 +202,834 @@ func TestPublishMessageEncode3(t *testing.T) {
 	msg.SetQoS(0)
 	msg.SetPayload([]byte{'s', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e'})
 
+	testRoundTrip(t, msg, msgBytes)
+}
+
+// test request message with response topic and correlation data for version 5
+func TestPublishMessageRequestResponse(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		42,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		18,   // properties length (18)
+		0x08, // response topic
+		0,    // response topic MSB (0)
+		8,    // response topic LSB (8)
+		'r', 'e', 's', 'p', 'o', 'n', 's', 'e',
+		0x09, // correlation data
+		0,    // correlation data MSB (0)
+		4,    // correlation data LSB (4)
+		0xde, 0xad, 0xbe, 0xef,
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send me home"))
+
+	err := msg.SetResponseTopic([]byte("response/#"))
+	assert.Error(t, true, err)
+
+	err = msg.SetResponseTopic([]byte("response"))
+	assert.NoError(t, true, err, "Error setting response topic.")
+
+	msg.SetCorrelationData([]byte{0xde, 0xad, 0xbe, 0xef})
+
 	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding message.")
+
+	msg2 := NewPublishMessage()
+	msg2.SetVersion(0x5)
+
+	n, err = msg2.Decode(bytes.NewBuffer(msgBytes))
 	assert.NoError(t, true, err, "Error decoding message.")
 
 	assert.Equal(t, true, len(msgBytes), n, "Error decoding message.")
 
-	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
+	assert.Equal(t, true, "response", string(msg2.ResponseTopic()), "Error decoding response topic.")
+
+	assert.Equal(t, true, []byte{0xde, 0xad, 0xbe, 0xef}, msg2.CorrelationData(), "Error decoding correlation data.")
+
+	assert.Equal(t, true, "send me home", string(msg2.Payload()), "Error decoding payload.")
+}
+
+func TestPublishMessageExpiryInterval(t *testing.T) {
+	msg := NewPublishMessage()
+
+	_, ok := msg.MessageExpiryInterval()
+	assert.False(t, true, ok, "Message expiry interval should not be present.")
+
+	assert.True(t, true, msg.DecrementMessageExpiryInterval(time.Hour), "Message without expiry interval should not expire.")
+
+	msg.SetMessageExpiryInterval(60)
+	v, ok := msg.MessageExpiryInterval()
+	assert.True(t, true, ok, "Message expiry interval should be present.")
+
+	assert.Equal(t, true, 60, v, "Error setting message expiry interval.")
+
+	assert.True(t, true, msg.DecrementMessageExpiryInterval(20500*time.Millisecond), "Message should not have expired.")
+
+	v, _ = msg.MessageExpiryInterval()
+	assert.Equal(t, true, 40, v, "Error decrementing message expiry interval.")
+
+	assert.True(t, true, msg.DecrementMessageExpiryInterval(39*time.Second), "Message should not have expired.")
+
+	v, _ = msg.MessageExpiryInterval()
+	assert.Equal(t, true, 1, v, "Error decrementing message expiry interval.")
+
+	assert.False(t, true, msg.DecrementMessageExpiryInterval(time.Second), "Message should have expired.")
+
+	v, _ = msg.MessageExpiryInterval()
+	assert.Equal(t, true, 1, v, "Expired message should keep its expiry interval.")
+}
+
+func TestPublishMessageExpiryIntervalEncode(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		19,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		5,                // properties length (5)
+		0x02,             // message expiry interval
+		0, 0, 0x0e, 0x10, // 3600 seconds
+		'h', 'o', 'm', 'e',
+	}
+
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetPayload([]byte("home"))
+	msg.SetMessageExpiryInterval(3600)
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error encoding message.")
+
+	msg2 := NewPublishMessage()
+	msg2.SetVersion(0x5)
+
+	_, err = msg2.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	v, ok := msg2.MessageExpiryInterval()
+	assert.True(t, true, ok, "Error decoding message expiry interval.")
+
+	assert.Equal(t, true, 3600, v, "Error decoding message expiry interval.")
+}
+
+func TestPublishMessageDecodeStream(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 65536) // 1MB
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("firmware/update"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetPayload(payload)
+
+	src, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	r, w := io.Pipe()
+	go func() {
+		_, err := io.Copy(w, src)
+		w.CloseWithError(err)
+	}()
+
+	msg = NewPublishMessage()
+
+	n, err := msg.DecodeStream(r)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// 1 byte type, 3 bytes remaining length, 17 bytes topic, 2 bytes packet ID
+	assert.Equal(t, true, 23, n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, "firmware/update", string(msg.Topic()), "Incorrect topic.")
+
+	assert.Equal(t, true, 7, msg.PacketId(), "Incorrect packet ID.")
+
+	assert.Equal(t, true, 0, len(msg.Payload()), "Incorrect payload.")
+
+	b, err := ioutil.ReadAll(msg.PayloadReader())
+	assert.NoError(t, true, err, "Error reading payload.")
+
+	assert.Equal(t, true, len(payload), len(b), "Incorrect payload length.")
+
+	assert.True(t, true, bytes.Equal(payload, b), "Incorrect payload.")
+}
+
+// test remaining length too short for the topic
+func TestPublishMessageDecodeStream2(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		4,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	msg := NewPublishMessage()
+
+	_, err := msg.DecodeStream(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+}
+
+// test the payload reader of a message that's not streamed
+func TestPublishMessagePayloadReader(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetPayload([]byte("send me home"))
+
+	b, err := ioutil.ReadAll(msg.PayloadReader())
+	assert.NoError(t, true, err, "Error reading payload.")
+
+	assert.Equal(t, true, "send me home", string(b), "Incorrect payload.")
+}
+
+// test the offset reported for a truncated topic
+func TestPublishMessageDecodeError(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		5,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r',
+	}
+
+	msg := NewPublishMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	de, ok := err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, 4, de.Offset, "Incorrect offset.")
+
+	_, _, err = DecodeBytes(msgBytes)
+
+	de, ok = err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, 4, de.Offset, "Incorrect offset.")
+}
+
+func TestPublishMessageString(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetPayload([]byte{'h', 'i', 0x00, 0xff, '\\'})
+
+	assert.True(t, true, strings.Contains(msg.String(), "Payload: hi\\x00\\xff\\\\\n"), "Incorrect payload string.")
+
+	payload := append(bytes.Repeat([]byte{'a'}, 63), 0x01, 'b')
+	msg.SetPayload(payload)
+
+	assert.True(t, true, strings.Contains(msg.String(), "Payload: "+strings.Repeat("a", 63)+"\\x01... (65 bytes total)\n"), "Incorrect payload string.")
+}
+
+// test encoding a topic name that's not valid UTF-8
+func TestPublishMessageEncodeInvalidUTF8(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetPayload([]byte("send me home"))
+
+	for _, topic := range []string{"a/\xff", "a/\x00"} {
+		err := msg.SetTopic([]byte(topic))
+		assert.NoError(t, true, err, "Error setting topic.")
+
+		_, _, err = msg.Encode()
+		assert.Error(t, true, err)
+	}
+
+	msg.SetTopic([]byte("a/é"))
+
+	_, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+func TestPublishMessageMarkRetransmit(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send me home"))
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, byte(PUBLISH<<4)|2, dst.(*bytes.Buffer).Bytes()[0], "Incorrect first transmission flags.")
+
+	dst, _, err = msg.MarkRetransmit()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.True(t, true, msg.Dup(), "DUP flag should be set.")
+
+	assert.Equal(t, true, byte(PUBLISH<<4)|10, dst.(*bytes.Buffer).Bytes()[0], "Incorrect retransmission flags.")
+
+	// QoS 0 messages are never retransmitted
+	msg = NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetPayload([]byte("send me home"))
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	_, _, err = msg.MarkRetransmit()
+	assert.Error(t, true, err)
+}
+
+// test resending a message rebuilt from the stored Session state after reconnecting
+func TestPublishMessageRetransmitPersisted(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 10,
+		20,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n', 'd', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	// never encoded or decoded by this message
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send home"))
+	msg.SetDup(true)
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("send home"))
+
+	dst, _, err = msg.MarkRetransmit()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+}
+
+func TestPublishMessageAck(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+
+	ack, err := msg.Ack()
+	assert.NoError(t, true, err, "Error building acknowledgement.")
+
+	assert.Equal(t, true, PUBACK, ack.Type(), "Incorrect acknowledgement type.")
+
+	assert.Equal(t, true, uint16(7), ack.(*PubackMessage).PacketId(), "Incorrect packet ID.")
+
+	msg.SetQoS(2)
+	msg.SetPacketId(8)
+
+	ack, err = msg.Ack()
+	assert.NoError(t, true, err, "Error building acknowledgement.")
+
+	assert.Equal(t, true, PUBREC, ack.Type(), "Incorrect acknowledgement type.")
+
+	rec := ack.(*PubrecMessage)
+	assert.Equal(t, true, uint16(8), rec.PacketId(), "Incorrect packet ID.")
+
+	rel := rec.Rel()
+	assert.Equal(t, true, PUBREL, rel.Type(), "Incorrect PUBREL type.")
+
+	assert.Equal(t, true, uint16(8), rel.PacketId(), "Incorrect packet ID.")
+
+	comp := rel.Comp()
+	assert.Equal(t, true, PUBCOMP, comp.Type(), "Incorrect PUBCOMP type.")
+
+	assert.Equal(t, true, uint16(8), comp.PacketId(), "Incorrect packet ID.")
+
+	// QoS 0 messages are not acknowledged
+	msg.SetQoS(0)
+
+	_, err = msg.Ack()
+	assert.Error(t, true, err)
+}
+
+// test that the acknowledgements of a version 5 PUBLISH are version 5
+func TestPublishMessageAckV5(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(2)
+	msg.SetPacketId(7)
+
+	ack, err := msg.Ack()
+	assert.NoError(t, true, err, "Error building acknowledgement.")
+
+	rec := ack.(*PubrecMessage)
+	assert.Equal(t, true, 0x5, rec.Version(), "Incorrect version.")
+
+	err = rec.SetReasonCode(ReasonNoMatchingSubscribers)
+	assert.NoError(t, true, err, "Error setting reason code.")
+
+	err = rec.Properties().SetBytes(PropReasonString, []byte("no"))
+	assert.NoError(t, true, err, "Error setting property.")
+
+	msgBytes := []byte{
+		byte(PUBREC << 4),
+		9,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		0x10, // reason code, no matching subscribers
+		5,    // properties length (5)
+		0x1f, // reason string
+		0, 2, // string length (2)
+		'n', 'o',
+	}
+
+	dst, n, err := rec.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Version = 0x5
+
+	msg2, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	rec = msg2.(*PubrecMessage)
+	assert.Equal(t, true, ReasonNoMatchingSubscribers, rec.ReasonCode(), "Incorrect reason code.")
+
+	reason, _ := rec.Properties().Bytes(PropReasonString)
+	assert.Equal(t, true, "no", string(reason), "Incorrect reason string.")
+
+	// packet identifier not found is only defined for PUBREL and PUBCOMP
+	err = rec.SetReasonCode(ReasonPacketIdentifierNotFound)
+	assert.Error(t, true, err)
+
+	rel := rec.Rel()
+	assert.Equal(t, true, 0x5, rel.Version(), "Incorrect version.")
+
+	comp := rel.Comp()
+	assert.Equal(t, true, 0x5, comp.Version(), "Incorrect version.")
+
+	err = comp.SetReasonCode(ReasonPacketIdentifierNotFound)
+	assert.NoError(t, true, err, "Error setting reason code.")
+
+	dst, _, err = comp.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	d = NewDecoder(dst)
+	d.Version = 0x5
+
+	msg2, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, ReasonPacketIdentifierNotFound, msg2.(*PubcompMessage).ReasonCode(), "Incorrect reason code.")
+
+	// success without properties is encoded without the reason code
+	dst, _, err = rec.Rel().Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, []byte{byte(PUBREL<<4) | 2, 2, 0, 7}, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+}
+
+func TestPublishMessageDowngrade(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetRetain(true)
+	msg.SetPayload([]byte("send me home"))
+	msg.SetResponseTopic([]byte("surgemq/response"))
+	msg.Properties().AddUserProperty([]byte("zone"), []byte("east"))
+
+	_, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	msg.SetDup(true)
+
+	msg3, err := msg.Downgrade(0x4)
+	assert.NoError(t, true, err, "Error downgrading message.")
+
+	assert.Equal(t, true, 0, msg3.Properties().Len(), "Properties should be dropped.")
+
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 11,
+		23,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	dst, _, err := msg3.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect downgraded message.")
+
+	// the original message is unchanged
+	assert.Equal(t, true, 2, msg.Properties().Len(), "Incorrect number of properties.")
+
+	// a topic alias without a topic can't be downgraded
+	msg = NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.Properties().SetUint(PropTopicAlias, 1)
+
+	_, err = msg.Downgrade(0x4)
+	assert.Error(t, true, err)
+
+	_, err = NewPublishMessage().Downgrade(0x5)
+	assert.Error(t, true, err)
+}
+
+func TestPayloadEqual(t *testing.T) {
+	a := NewPublishMessage()
+	b := NewPublishMessage()
+
+	// nil and empty payloads
+	assert.True(t, true, PayloadEqual(a, b), "Nil payloads should be equal.")
+
+	b.SetPayload([]byte{})
+	assert.True(t, true, PayloadEqual(a, b), "Nil and empty payloads should be equal.")
+
+	// same payloads, other fields differ
+	a.SetPayload([]byte{'a', 0, 'b'})
+	b.SetPayload([]byte{'a', 0, 'b'})
+	a.SetTopic([]byte("a/b"))
+	a.SetQoS(QosAtLeastOnce)
+	assert.True(t, true, PayloadEqual(a, b), "Payloads should be equal.")
+
+	// differing payloads
+	b.SetPayload([]byte{'a', 0, 'c'})
+	assert.False(t, true, PayloadEqual(a, b), "Payloads should differ.")
+
+	b.SetPayload([]byte{'a', 0})
+	assert.False(t, true, PayloadEqual(a, b), "Payloads should differ.")
+
+	b.SetPayload(nil)
+	assert.False(t, true, PayloadEqual(a, b), "Payloads should differ.")
+
+	// not a PUBLISH message
+	assert.False(t, true, PayloadEqual(a, NewPingreqMessage()), "Non-PUBLISH message should not be equal.")
+	assert.False(t, true, PayloadEqual(NewPingreqMessage(), NewPingreqMessage()), "Non-PUBLISH messages should not be equal.")
+}
+
+func TestPublishMessageSubscriptionIdentifiers(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		13,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		5,    // properties length
+		0x0B, // subscription identifier
+		1,    // identifier (1)
+		0x0B, // subscription identifier
+		0xc8, // identifier (200) LSB
+		0x01, // identifier (200) MSB
+		'h', 'i',
+	}
+
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("a/b"))
+	msg.SetPayload([]byte("hi"))
+
+	assert.Equal(t, true, 0, len(msg.SubscriptionIdentifiers()), "Unexpected subscription identifiers.")
+
+	err := msg.AddSubscriptionIdentifier(1)
+	assert.NoError(t, true, err, "Error adding subscription identifier.")
+
+	err = msg.AddSubscriptionIdentifier(200)
+	assert.NoError(t, true, err, "Error adding subscription identifier.")
+
+	err = msg.AddSubscriptionIdentifier(0)
+	assert.Error(t, true, err)
+
+	err = msg.AddSubscriptionIdentifier(uint32(maxRemainingLength) + 1)
+	assert.Error(t, true, err)
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewPublishMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []uint32{1, 200}, msg.SubscriptionIdentifiers(), "Incorrect subscription identifiers.")
+
+	// only repeatable integer properties can have more than one value
+	err = msg.Properties().AddUint(PropMessageExpiryInterval, 10)
+	assert.Error(t, true, err)
+
+	err = msg.Properties().AddUint(PropUserProperty, 10)
+	assert.Error(t, true, err)
+}
+
+func TestPublishMessageContentHash(t *testing.T) {
+	a := NewPublishMessage()
+	a.SetTopic([]byte("a/b"))
+	a.SetPayload([]byte("hello"))
+	a.SetQoS(QosAtLeastOnce)
+	a.SetRetain(true)
+	a.SetPacketId(7)
+
+	b := NewPublishMessage()
+	b.SetTopic([]byte("a/b"))
+	b.SetPayload([]byte("hello"))
+	b.SetQoS(QosAtLeastOnce)
+	b.SetRetain(true)
+	b.SetPacketId(8)
+	b.SetDup(true)
+
+	// only DUP and packet ID differ
+	assert.Equal(t, true, 32, len(a.ContentHash()), "Incorrect hash length.")
+	assert.Equal(t, true, a.ContentHash(), b.ContentHash(), "Hashes should be equal.")
+
+	// QoS differs
+	b.SetQoS(QosExactlyOnce)
+	assert.NotEqual(t, true, a.ContentHash(), b.ContentHash(), "Hashes should differ.")
+	b.SetQoS(QosAtLeastOnce)
+
+	// retain differs
+	b.SetRetain(false)
+	assert.NotEqual(t, true, a.ContentHash(), b.ContentHash(), "Hashes should differ.")
+	b.SetRetain(true)
+
+	// same bytes split differently between topic and payload
+	b.SetTopic([]byte("a/bh"))
+	b.SetPayload([]byte("ello"))
+	assert.NotEqual(t, true, a.ContentHash(), b.ContentHash(), "Hashes should differ.")
+}
+
+func TestPublishMessagePublishFlags(t *testing.T) {
+	msg := NewPublishMessage()
+
+	assert.Equal(t, true, PublishFlags{}, msg.PublishFlags(), "Incorrect flags.")
+
+	for _, f := range []PublishFlags{
+		{Dup: true, QoS: QosAtLeastOnce, Retain: true},
+		{Dup: false, QoS: QosExactlyOnce, Retain: true},
+		{Dup: true, QoS: QosExactlyOnce, Retain: false},
+		{Dup: false, QoS: QosAtMostOnce, Retain: false},
+	} {
+		err := msg.SetPublishFlags(f)
+		assert.NoError(t, true, err, "Error setting flags.")
+
+		assert.Equal(t, true, f, msg.PublishFlags(), "Incorrect flags.")
+
+		assert.Equal(t, true, f.Dup, msg.Dup(), "Incorrect DUP flag.")
+		assert.Equal(t, true, f.QoS, msg.QoS(), "Incorrect QoS.")
+		assert.Equal(t, true, f.Retain, msg.Retain(), "Incorrect RETAIN flag.")
+	}
+
+	msg.SetPublishFlags(PublishFlags{Dup: true, QoS: QosAtLeastOnce, Retain: true})
+
+	// DUP with QoS 0
+	err := msg.SetPublishFlags(PublishFlags{Dup: true, QoS: QosAtMostOnce})
+	assert.Error(t, true, err)
+
+	// invalid QoS
+	err = msg.SetPublishFlags(PublishFlags{QoS: 3})
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, PublishFlags{Dup: true, QoS: QosAtLeastOnce, Retain: true}, msg.PublishFlags(), "Flags should be unchanged.")
+}
+
+func TestPublishMessageMaxQoS(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 4, // QoS 2
+		7,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	msg := NewPublishMessage()
+	assert.Equal(t, true, QosExactlyOnce, msg.MaxQoS(), "Incorrect default maximum QoS.")
+
+	err := msg.SetMaxQoS(QosAtLeastOnce)
+	assert.NoError(t, true, err, "Error setting maximum QoS.")
+
+	err = msg.SetMaxQoS(3)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, QosAtLeastOnce, msg.MaxQoS(), "Incorrect maximum QoS.")
+
+	// set
+	err = msg.SetQoS(QosExactlyOnce)
+	assert.Equal(t, true, ErrQosNotSupported, err, "Incorrect error.")
+
+	err = msg.SetPublishFlags(PublishFlags{QoS: QosExactlyOnce, Retain: true})
+	assert.Equal(t, true, ErrQosNotSupported, err, "Incorrect error.")
+	assert.False(t, true, msg.Retain(), "Flags should be unchanged.")
+
+	err = msg.SetQoS(QosAtLeastOnce)
+	assert.NoError(t, true, err, "Error setting QoS.")
+
+	// decoded
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrQosNotSupported, err, "Incorrect error.")
+
+	assert.Equal(t, true, ReasonQosNotSupported, DisconnectReason(err), "Incorrect reason code.")
+
+	// no limit
+	_, err = NewPublishMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// set through the Decoder
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.MaxQoS = QosAtLeastOnce
+	d.LimitQoS = true
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrQosNotSupported, err, "Incorrect error.")
+
+	d = NewDecoder(bytes.NewBuffer(msgBytes))
+	d.MaxQoS = QosAtLeastOnce
+
+	_, _, err = d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestPublishMessageRewriteTopic(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		'h', 'e', 'y',
+	}
+
+	msg := NewPublishMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	topic := []byte("tenant1/a/b")
+
+	err = msg.RewriteTopic(topic)
+	assert.NoError(t, true, err, "Error rewriting topic.")
+
+	// the message has its own copy
+	topic[0] = 'x'
+	assert.Equal(t, true, "tenant1/a/b", string(msg.Topic()), "Incorrect topic.")
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+	assert.Equal(t, true, len(msgBytes)+8, n, "Incorrect bytes encoded.")
+
+	msg2 := NewPublishMessage()
+
+	_, err = msg2.Decode(dst)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "tenant1/a/b", string(msg2.Topic()), "Incorrect topic.")
+	assert.Equal(t, true, uint16(7), msg2.PacketId(), "Incorrect packet ID.")
+	assert.Equal(t, true, "hey", string(msg2.Payload()), "Incorrect payload.")
+
+	// invalid topics leave the topic unchanged
+	for _, v := range [][]byte{nil, []byte("a/#"), []byte{'a', 0xff}} {
+		err = msg.RewriteTopic(v)
+		assert.Equal(t, true, ErrInvalidTopic, err, "Incorrect error.")
+	}
+
+	assert.Equal(t, true, "tenant1/a/b", string(msg.Topic()), "Incorrect topic.")
+}
+
+func TestPublishMessagePayloadString(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetPayloadString("send me home")
+
+	assert.Equal(t, true, []byte("send me home"), msg.Payload(), "Incorrect payload.")
+
+	src, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	msg2 := NewPublishMessage()
+
+	_, err = msg2.Decode(src)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, "send me home", msg2.PayloadString(), "Incorrect payload.")
+}
+
+// test a version 5 QoS 0 message without properties, which still has the properties
+// length
+func TestPublishMessageEmptyProperties(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		's', 'u', 'r',
+		0, // properties length (0)
+		's', 'e', 'n', 'd',
+	}
+
+	msg := NewPublishMessage()
+	msg.SetVersion(0x5)
+	msg.SetTopic([]byte("sur"))
+	msg.SetPayload([]byte("send"))
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// decoding a message that had properties clears them
+	msg.Properties().AddUserProperty([]byte("zone"), []byte("east"))
+
+	n, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	assert.Equal(t, true, 0, msg.Properties().Len(), "Incorrect number of properties.")
+
+	assert.Equal(t, true, "send", string(msg.Payload()), "Incorrect payload.")
+
+	msg2 := NewPublishMessage()
+	msg2.SetVersion(0x5)
+
+	_, err = msg2.DecodeStream(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	payload, err := ioutil.ReadAll(msg2.PayloadReader())
+	assert.NoError(t, true, err, "Error reading payload.")
+
+	assert.Equal(t, true, "send", string(payload), "Incorrect payload.")
 }
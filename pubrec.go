@@ -29,3 +29,13 @@ func NewPubrecMessage() *PubrecMessage {
 
 	return msg
 }
+
+// Rel returns the PUBREL message the sender of the PUBLISH replies with to this
+// PUBREC, with the same packet ID and version.
+func (this *PubrecMessage) Rel() *PubrelMessage {
+	msg := NewPubrelMessage()
+	msg.version = this.version
+	msg.SetPacketId(this.packetId)
+
+	return msg
+}
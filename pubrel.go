@@ -29,3 +29,14 @@ func NewPubrelMessage() *PubrelMessage {
 
 	return msg
 }
+
+// Comp returns the PUBCOMP message the receiver of the PUBLISH replies with to this
+// PUBREL, with the same packet ID and version. It's the last packet of the QoS 2
+// protocol exchange.
+func (this *PubrelMessage) Comp() *PubcompMessage {
+	msg := NewPubcompMessage()
+	msg.version = this.version
+	msg.SetPacketId(this.packetId)
+
+	return msg
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrPacketIdNotFound is returned when a PUBREL is received for a packet ID that
+	// isn't waiting to be released.
+	ErrPacketIdNotFound = errors.New("Packet Identifier not found")
+)
+
+// QoS2Tracker keeps the packet IDs of the QoS 2 PUBLISH packets received but not yet
+// released, which the receiver needs to deliver each message exactly once. The
+// receiver calls MarkReceived for every QoS 2 PUBLISH, and only delivers the message
+// if it's not a duplicate, then calls MarkReleased when the PUBREL is received,
+// before sending the PUBCOMP. It is safe to use from multiple goroutines.
+type QoS2Tracker struct {
+	mu       sync.Mutex
+	ids      map[uint16]struct{}
+	capacity int
+}
+
+// NewQoS2Tracker creates a new QoS2Tracker that keeps up to capacity packet IDs,
+// which is usually the Receive Maximum sent to the peer. A capacity of 0 is treated
+// as the default Receive Maximum of 65535, the same as for NewFlowController.
+func NewQoS2Tracker(capacity uint16) *QoS2Tracker {
+	if capacity == 0 {
+		capacity = 65535
+	}
+
+	return &QoS2Tracker{
+		ids:      make(map[uint16]struct{}),
+		capacity: int(capacity),
+	}
+}
+
+// Capacity returns the maximum number of packet IDs kept.
+func (this *QoS2Tracker) Capacity() int {
+	return this.capacity
+}
+
+// Len returns the number of packet IDs received but not yet released.
+func (this *QoS2Tracker) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.ids)
+}
+
+// MarkReceived records the packet ID of a QoS 2 PUBLISH. It returns true if the ID
+// was already recorded, i.e., the PUBLISH is a duplicate that must be acknowledged
+// with a PUBREC, but not delivered again. ErrReceiveMaximumExceeded is returned if
+// the ID is new and there are already Capacity IDs waiting to be released.
+func (this *QoS2Tracker) MarkReceived(id uint16) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.ids[id]; ok {
+		return true, nil
+	}
+
+	if len(this.ids) >= this.capacity {
+		return false, ErrReceiveMaximumExceeded
+	}
+
+	this.ids[id] = struct{}{}
+
+	return false, nil
+}
+
+// MarkReleased removes the packet ID once the PUBREL is received, so the ID can be
+// reused. ErrPacketIdNotFound is returned if the ID wasn't recorded, in which case
+// a version 5 PUBCOMP carries the Packet Identifier not found reason code.
+func (this *QoS2Tracker) MarkReleased(id uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.ids[id]; !ok {
+		return ErrPacketIdNotFound
+	}
+
+	delete(this.ids, id)
+
+	return nil
+}
+
+// IsDuplicate checks to see if the packet ID was received and not yet released, in
+// which case a PUBLISH with that ID is a duplicate.
+func (this *QoS2Tracker) IsDuplicate(id uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.ids[id]
+
+	return ok
+}
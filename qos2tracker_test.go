@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestQoS2TrackerDuplicate(t *testing.T) {
+	tr := NewQoS2Tracker(10)
+
+	dup, err := tr.MarkReceived(7)
+	assert.NoError(t, true, err, "Error marking received.")
+	assert.False(t, true, dup, "Expecting new packet ID.")
+
+	assert.True(t, true, tr.IsDuplicate(7), "Expecting duplicate.")
+	assert.False(t, true, tr.IsDuplicate(8), "Expecting no duplicate.")
+
+	// the PUBLISH is retransmitted before the PUBREC is received
+	dup, err = tr.MarkReceived(7)
+	assert.NoError(t, true, err, "Error marking received.")
+	assert.True(t, true, dup, "Expecting duplicate.")
+
+	assert.Equal(t, true, 1, tr.Len(), "Incorrect number of packet IDs.")
+
+	assert.NoError(t, true, tr.MarkReleased(7), "Error marking released.")
+
+	assert.False(t, true, tr.IsDuplicate(7), "Expecting no duplicate.")
+
+	assert.Equal(t, true, ErrPacketIdNotFound, tr.MarkReleased(7), "Expecting packet ID not found.")
+
+	// the packet ID can be reused once released
+	dup, err = tr.MarkReceived(7)
+	assert.NoError(t, true, err, "Error marking received.")
+	assert.False(t, true, dup, "Expecting new packet ID.")
+}
+
+func TestQoS2TrackerCapacity(t *testing.T) {
+	tr := NewQoS2Tracker(2)
+
+	assert.Equal(t, true, 2, tr.Capacity(), "Incorrect capacity.")
+
+	_, err := tr.MarkReceived(1)
+	assert.NoError(t, true, err, "Error marking received.")
+
+	_, err = tr.MarkReceived(2)
+	assert.NoError(t, true, err, "Error marking received.")
+
+	_, err = tr.MarkReceived(3)
+	assert.Equal(t, true, ErrReceiveMaximumExceeded, err, "Expecting receive maximum exceeded.")
+
+	assert.False(t, true, tr.IsDuplicate(3), "Expecting packet ID not recorded.")
+
+	// duplicates are still detected when the tracker is full
+	dup, err := tr.MarkReceived(2)
+	assert.NoError(t, true, err, "Error marking received.")
+	assert.True(t, true, dup, "Expecting duplicate.")
+
+	assert.NoError(t, true, tr.MarkReleased(1), "Error marking released.")
+
+	_, err = tr.MarkReceived(3)
+	assert.NoError(t, true, err, "Error marking received.")
+
+	assert.Equal(t, true, 2, tr.Len(), "Incorrect number of packet IDs.")
+
+	assert.Equal(t, true, 65535, NewQoS2Tracker(0).Capacity(), "Incorrect default capacity.")
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+)
+
+// ReasonCode is the type representing the reason codes introduced in MQTT 5.0. A
+// reason code is a one byte unsigned value that indicates the result of an operation.
+// Reason codes less than 0x80 indicate successful completion of an operation, and
+// reason codes of 0x80 or greater indicate failure.
+type ReasonCode byte
+
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonNormalDisconnection                 ReasonCode = 0x00
+	ReasonGrantedQos0                         ReasonCode = 0x00
+	ReasonGrantedQos1                         ReasonCode = 0x01
+	ReasonGrantedQos2                         ReasonCode = 0x02
+	ReasonDisconnectWithWillMessage           ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReAuthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUsernameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQosNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	ReasonSuccess:                             "Success",
+	ReasonGrantedQos1:                         "Granted QoS 1",
+	ReasonGrantedQos2:                         "Granted QoS 2",
+	ReasonDisconnectWithWillMessage:           "Disconnect with Will Message",
+	ReasonNoMatchingSubscribers:               "No matching subscribers",
+	ReasonNoSubscriptionExisted:               "No subscription existed",
+	ReasonContinueAuthentication:              "Continue authentication",
+	ReasonReAuthenticate:                      "Re-authenticate",
+	ReasonUnspecifiedError:                    "Unspecified error",
+	ReasonMalformedPacket:                     "Malformed Packet",
+	ReasonProtocolError:                       "Protocol Error",
+	ReasonImplementationSpecificError:         "Implementation specific error",
+	ReasonUnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ReasonClientIdentifierNotValid:            "Client Identifier not valid",
+	ReasonBadUsernameOrPassword:               "Bad User Name or Password",
+	ReasonNotAuthorized:                       "Not authorized",
+	ReasonServerUnavailable:                   "Server unavailable",
+	ReasonServerBusy:                          "Server busy",
+	ReasonBanned:                              "Banned",
+	ReasonServerShuttingDown:                  "Server shutting down",
+	ReasonBadAuthenticationMethod:             "Bad authentication method",
+	ReasonKeepAliveTimeout:                    "Keep Alive timeout",
+	ReasonSessionTakenOver:                    "Session taken over",
+	ReasonTopicFilterInvalid:                  "Topic Filter invalid",
+	ReasonTopicNameInvalid:                    "Topic Name invalid",
+	ReasonPacketIdentifierInUse:               "Packet Identifier in use",
+	ReasonPacketIdentifierNotFound:            "Packet Identifier not found",
+	ReasonReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	ReasonTopicAliasInvalid:                   "Topic Alias invalid",
+	ReasonPacketTooLarge:                      "Packet too large",
+	ReasonMessageRateTooHigh:                  "Message rate too high",
+	ReasonQuotaExceeded:                       "Quota exceeded",
+	ReasonAdministrativeAction:                "Administrative action",
+	ReasonPayloadFormatInvalid:                "Payload format invalid",
+	ReasonRetainNotSupported:                  "Retain not supported",
+	ReasonQosNotSupported:                     "QoS not supported",
+	ReasonUseAnotherServer:                    "Use another server",
+	ReasonServerMoved:                         "Server moved",
+	ReasonSharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ReasonConnectionRateExceeded:              "Connection rate exceeded",
+	ReasonMaximumConnectTime:                  "Maximum connect time",
+	ReasonSubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	ReasonWildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+// Value returns the value of the ReasonCode, which is just the byte representation.
+func (this ReasonCode) Value() byte {
+	return byte(this)
+}
+
+// String returns the name of the ReasonCode as defined in the spec. The same value
+// can have different names depending on the packet, e.g., 0x00 is Success in most
+// packets, but Normal disconnection in DISCONNECT.
+func (this ReasonCode) String() string {
+	return reasonCodeNames[this]
+}
+
+// Valid checks to see if the ReasonCode is one of the codes defined in the spec.
+func (this ReasonCode) Valid() bool {
+	_, ok := reasonCodeNames[this]
+	return ok
+}
+
+// ValidForDisconnect checks to see if the ReasonCode is one of the codes defined for
+// the DISCONNECT message. Valid accepts the codes of every message type, including
+// ones like ReasonGrantedQos1 which are only meaningful in a SUBACK.
+func (this ReasonCode) ValidForDisconnect() bool {
+	return disconnectReasonCodes[this]
+}
+
+// disconnectReasonCodes is the set of reason codes defined for the DISCONNECT
+// message, see section 3.14.2.1 of the MQTT 5.0 spec.
+var disconnectReasonCodes = map[ReasonCode]bool{
+	ReasonNormalDisconnection:                 true,
+	ReasonDisconnectWithWillMessage:           true,
+	ReasonUnspecifiedError:                    true,
+	ReasonMalformedPacket:                     true,
+	ReasonProtocolError:                       true,
+	ReasonImplementationSpecificError:         true,
+	ReasonNotAuthorized:                       true,
+	ReasonServerBusy:                          true,
+	ReasonServerShuttingDown:                  true,
+	ReasonKeepAliveTimeout:                    true,
+	ReasonSessionTakenOver:                    true,
+	ReasonTopicFilterInvalid:                  true,
+	ReasonTopicNameInvalid:                    true,
+	ReasonReceiveMaximumExceeded:              true,
+	ReasonTopicAliasInvalid:                   true,
+	ReasonPacketTooLarge:                      true,
+	ReasonMessageRateTooHigh:                  true,
+	ReasonQuotaExceeded:                       true,
+	ReasonAdministrativeAction:                true,
+	ReasonPayloadFormatInvalid:                true,
+	ReasonRetainNotSupported:                  true,
+	ReasonQosNotSupported:                     true,
+	ReasonUseAnotherServer:                    true,
+	ReasonServerMoved:                         true,
+	ReasonSharedSubscriptionsNotSupported:     true,
+	ReasonConnectionRateExceeded:              true,
+	ReasonMaximumConnectTime:                  true,
+	ReasonSubscriptionIdentifiersNotSupported: true,
+	ReasonWildcardSubscriptionsNotSupported:   true,
+}
+
+// IsError returns true if the ReasonCode indicates failure, i.e., it's 0x80 or
+// greater.
+func (this ReasonCode) IsError() bool {
+	return this >= 0x80
+}
+
+// connackReasonCodes maps the version 3 and 4 CONNACK return codes to the equivalent
+// version 5 reason codes.
+var connackReasonCodes = map[ConnackCode]ReasonCode{
+	ConnectionAccepted:          ReasonSuccess,
+	UnacceptableProtocolVersion: ReasonUnsupportedProtocolVersion,
+	IdentifierRejected:          ReasonClientIdentifierNotValid,
+	ServerUnavailable:           ReasonServerUnavailable,
+	BadUsernameOrPassword:       ReasonBadUsernameOrPassword,
+	NotAuthorized:               ReasonNotAuthorized,
+}
+
+// ToConnackCode returns the version 3 and 4 CONNACK return code equivalent to the
+// reason code, e.g., to forward the CONNACK of a version 5 Server to a version 4
+// Client. The second return value is false if there's no equivalent return code.
+func (this ReasonCode) ToConnackCode() (ConnackCode, bool) {
+	for code, reason := range connackReasonCodes {
+		if reason == this {
+			return code, true
+		}
+	}
+
+	return 0, false
+}
+
+// disconnectReasons maps the errors returned by this package to the reason code of
+// the DISCONNECT message sent because of them. Limits set by the caller, such as
+// Decoder.MaxTopics, are a Quota exceeded, and valid messages this package doesn't
+// implement, such as AUTH, are an Implementation specific error.
+var disconnectReasons = []struct {
+	err    error
+	reason ReasonCode
+}{
+	{ErrPacketTooLarge, ReasonPacketTooLarge},
+	{ErrReceiveMaximumExceeded, ReasonReceiveMaximumExceeded},
+	{ErrInvalidTopic, ReasonTopicNameInvalid},
+	{ErrInvalidTopicFilter, ReasonTopicFilterInvalid},
+	{ErrQosNotSupported, ReasonQosNotSupported},
+	{ErrTooManyTopics, ReasonQuotaExceeded},
+	{ErrTooManyUserProperties, ReasonQuotaExceeded},
+	{ErrInvalidDirection, ReasonProtocolError},
+	{ErrPacketIdNotFound, ReasonProtocolError},
+	{ErrReservedType, ReasonMalformedPacket},
+	{ErrAuthNotSupported, ReasonImplementationSpecificError},
+	{ErrUnsupportedProtocolVersion, ReasonImplementationSpecificError},
+}
+
+// DisconnectReason returns the reason code a version 5 Server or Client should send
+// in a DISCONNECT message when it closes the Network Connection because of err. nil
+// maps to ReasonNormalDisconnection, a ProtocolError to ReasonProtocolError, and a
+// DecodeError or LengthError to ReasonMalformedPacket. Errors that aren't returned by
+// this package map to ReasonUnspecifiedError. The reason code is always one that's
+// valid for DISCONNECT, see ReasonCode.ValidForDisconnect.
+func DisconnectReason(err error) ReasonCode {
+	if err == nil {
+		return ReasonNormalDisconnection
+	}
+
+	for _, r := range disconnectReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return ReasonProtocolError
+	}
+
+	var de *DecodeError
+	var le *LengthError
+	if errors.As(err, &de) || errors.As(err, &le) {
+		return ReasonMalformedPacket
+	}
+
+	return ReasonUnspecifiedError
+}
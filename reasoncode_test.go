@@ -0,0 +1,136 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestReasonCode(t *testing.T) {
+	assert.True(t, true, ReasonMalformedPacket.IsError(), "Expecting error reason code.")
+
+	assert.False(t, true, ReasonGrantedQos1.IsError(), "Not expecting error reason code.")
+
+	assert.True(t, true, ReasonTopicFilterInvalid.Valid(), "Expecting valid reason code.")
+
+	assert.False(t, true, ReasonCode(0x03).Valid(), "Not expecting valid reason code.")
+
+	assert.Equal(t, true, "Protocol Error", ReasonProtocolError.String(), "Incorrect reason code name.")
+}
+
+func TestDisconnectReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason ReasonCode
+	}{
+		{nil, ReasonNormalDisconnection},
+		{ErrPacketTooLarge, ReasonPacketTooLarge},
+		{ErrReceiveMaximumExceeded, ReasonReceiveMaximumExceeded},
+		{ErrInvalidTopic, ReasonTopicNameInvalid},
+		{ErrInvalidTopicFilter, ReasonTopicFilterInvalid},
+		{ErrQosNotSupported, ReasonQosNotSupported},
+		{ErrTooManyTopics, ReasonQuotaExceeded},
+		{ErrTooManyUserProperties, ReasonQuotaExceeded},
+		{ErrInvalidDirection, ReasonProtocolError},
+		{ErrPacketIdNotFound, ReasonProtocolError},
+		{ErrReservedType, ReasonMalformedPacket},
+		{ErrAuthNotSupported, ReasonImplementationSpecificError},
+		{ErrUnsupportedProtocolVersion, ReasonImplementationSpecificError},
+		{protocolError("test/Decode", "violation"), ReasonProtocolError},
+		{&LengthError{Type: PUBACK, Declared: 3, Consumed: 2}, ReasonMalformedPacket},
+		{fmt.Errorf("wrapped: %w", ErrTooManyTopics), ReasonQuotaExceeded},
+		{errors.New("error"), ReasonUnspecifiedError},
+	}
+
+	for _, test := range tests {
+		reason := DisconnectReason(test.err)
+		assert.Equal(t, true, test.reason, reason, "Incorrect reason code for %v.", test.err)
+		assert.True(t, true, reason.ValidForDisconnect(), "Invalid DISCONNECT reason code for %v.", test.err)
+	}
+
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		5,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r',
+	}
+
+	_, err := NewPublishMessage().Decode(bytes.NewBuffer(msgBytes))
+
+	assert.Equal(t, true, ReasonMalformedPacket, DisconnectReason(err), "Incorrect reason code.")
+
+	// packet ID 0
+	msgBytes = []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		8,
+		0, // packet ID MSB (0)
+		0, // packet ID LSB (0)
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		's', 'u', 'r',
+		1, // QoS 1
+	}
+
+	_, err = NewSubscribeMessage().Decode(bytes.NewBuffer(msgBytes))
+
+	assert.Equal(t, true, ReasonProtocolError, DisconnectReason(err), "Incorrect reason code.")
+
+	// invalid topic filter
+	msgBytes[3] = 7
+	msgBytes[8] = '#'
+
+	msg := NewSubscribeMessage()
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, ReasonTopicFilterInvalid, DisconnectReason(msg.CheckTopics()), "Incorrect reason code.")
+}
+
+func TestConnackCodeReasonCode(t *testing.T) {
+	tests := []struct {
+		code   ConnackCode
+		reason ReasonCode
+	}{
+		{ConnectionAccepted, ReasonSuccess},
+		{UnacceptableProtocolVersion, ReasonUnsupportedProtocolVersion},
+		{IdentifierRejected, ReasonClientIdentifierNotValid},
+		{ServerUnavailable, ReasonServerUnavailable},
+		{BadUsernameOrPassword, ReasonBadUsernameOrPassword},
+		{NotAuthorized, ReasonNotAuthorized},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, true, test.reason, test.code.ToReasonCode(), "Incorrect reason code.")
+
+		code, ok := test.reason.ToConnackCode()
+		assert.True(t, true, ok, "Expecting CONNACK return code.")
+
+		assert.Equal(t, true, test.code, code, "Incorrect CONNACK return code.")
+	}
+
+	assert.Equal(t, true, ReasonUnspecifiedError, ConnackCode(6).ToReasonCode(), "Incorrect reason code.")
+
+	for _, reason := range []ReasonCode{ReasonUnspecifiedError, ReasonServerBusy, ReasonBanned, ReasonGrantedQos1} {
+		_, ok := reason.ToConnackCode()
+		assert.False(t, true, ok, "Unexpected CONNACK return code.")
+	}
+}
@@ -15,6 +15,7 @@
 package mqtt
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -27,10 +28,30 @@ import (
 type SubackMessage struct {
 	fixedHeader
 
+	version     byte
 	packetId    uint16
+	properties  Properties
 	returnCodes []byte
 }
 
+// subackReasonCodes is the set of return codes allowed in a version 5 SUBACK, see
+// section 3.9.3 of the MQTT 5.0 spec. Versions 3 and 4 only allow the granted QoS
+// and QosFailure.
+var subackReasonCodes = map[byte]bool{
+	byte(ReasonGrantedQos0):                         true,
+	byte(ReasonGrantedQos1):                         true,
+	byte(ReasonGrantedQos2):                         true,
+	byte(ReasonUnspecifiedError):                    true,
+	byte(ReasonImplementationSpecificError):         true,
+	byte(ReasonNotAuthorized):                       true,
+	byte(ReasonTopicFilterInvalid):                  true,
+	byte(ReasonPacketIdentifierInUse):               true,
+	byte(ReasonQuotaExceeded):                       true,
+	byte(ReasonSharedSubscriptionsNotSupported):     true,
+	byte(ReasonSubscriptionIdentifiersNotSupported): true,
+	byte(ReasonWildcardSubscriptionsNotSupported):   true,
+}
+
 var _ Message = (*SubackMessage)(nil)
 
 // NewSubackMessage creates a new SUBACK message.
@@ -46,6 +67,31 @@ func (this SubackMessage) String() string {
 	return fmt.Sprintf("%s\nPacket ID: %d\nReturn Codes: %v\n", this.fixedHeader, this.packetId, this.returnCodes)
 }
 
+// Version returns the protocol version of the connection this message is sent over.
+// The SUBACK packet does not carry the version itself, but for version 5 (MQTT 5.0)
+// the variable header includes a properties section, and the payload may include
+// the reason codes of subscriptions that failed.
+func (this *SubackMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *SubackMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("suback/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// Properties returns the SUBACK properties, which are only encoded and decoded when
+// version is 5. Reason String and User Property are the only properties allowed.
+func (this *SubackMessage) Properties() *Properties {
+	return &this.properties
+}
+
 // PacketId returns the ID of the packet.
 func (this *SubackMessage) PacketId() uint16 {
 	return this.packetId
@@ -62,10 +108,11 @@ func (this *SubackMessage) ReturnCodes() []byte {
 }
 
 // AddReturnCodes sets the list of QoS returns from the subscriptions sent in the SUBSCRIBE message.
-// An error is returned if any of the QoS values are not valid.
+// An error is returned if any of the QoS values are not valid. Version 5 also allows
+// the reason codes of failed subscriptions, e.g., ReasonNotAuthorized.
 func (this *SubackMessage) AddReturnCodes(ret []byte) error {
 	for _, c := range ret {
-		if c != QosAtMostOnce && c != QosAtLeastOnce && c != QosExactlyOnce && c != QosFailure {
+		if !this.validReturnCode(c) {
 			return fmt.Errorf("suback/AddReturnCode: Invalid return code %d. Must be 0, 1, 2, 0x80.", c)
 		}
 
@@ -80,28 +127,53 @@ func (this *SubackMessage) AddReturnCode(ret byte) error {
 	return this.AddReturnCodes([]byte{ret})
 }
 
+// validReturnCode checks to see if the return code is allowed for the version.
+func (this *SubackMessage) validReturnCode(code byte) bool {
+	if this.version == 0x5 {
+		return subackReasonCodes[code]
+	}
+
+	return code == QosAtMostOnce || code == QosAtLeastOnce || code == QosExactlyOnce || code == QosFailure
+}
+
+// MatchesSubscribe checks to see if this message is a valid response to sub, i.e.,
+// it has the same packet ID, and exactly one return code for each topic filter in
+// the SUBSCRIBE message.
+func (this *SubackMessage) MatchesSubscribe(sub *SubscribeMessage) bool {
+	return this.packetId == sub.PacketId() && len(this.returnCodes) == len(sub.Topics())
+}
+
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *SubackMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return total, this.decodeError(err)
+	}
+
+	if this.version == 0x5 {
+		if _, err = this.properties.decode(this.buf, subackPropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
+	}
+
+	// The payload MUST contain at least one return code, as the SUBSCRIBE it answers
+	// contains at least one topic filter
+	if this.buf.Len() == 0 {
+		return total, protocolError("suback/Decode", "Empty return code list")
 	}
-	total += 2
 
-	this.returnCodes = this.buf.Next(this.buf.Len())
-	total += len(this.returnCodes)
+	// The return codes are copied, as a SUBACK may be kept, e.g., until the caller
+	// matches it with its SUBSCRIBE, after the buffer is reused or released
+	this.returnCodes = copyBytes(this.buf.Next(this.buf.Len()))
 
 	for i, code := range this.returnCodes {
-		if code != 0x00 && code != 0x01 && code != 0x02 && code != 0x80 {
+		if !this.validReturnCode(code) {
 			return total, fmt.Errorf("suback/Decode: Invalid return code %d for topic %d", code, i)
 		}
 	}
@@ -115,29 +187,71 @@ func (this *SubackMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *SubackMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *SubackMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *SubackMessage) encode(buf *bytes.Buffer) (int, error) {
 	for i, code := range this.returnCodes {
-		if code != 0x00 && code != 0x01 && code != 0x02 && code != 0x80 {
-			return nil, 0, fmt.Errorf("suback/Encode: Invalid return code %d for topic %d", code, i)
+		if !this.validReturnCode(code) {
+			return 0, fmt.Errorf("suback/Encode: Invalid return code %d for topic %d", code, i)
 		}
 	}
 
-	this.SetRemainingLength(2 + int32(len(this.returnCodes)))
+	// packet ID
+	remlen := int64(2 + len(this.returnCodes))
 
-	_, total, err := this.fixedHeader.Encode()
+	if this.version == 0x5 {
+		remlen += int64(this.properties.size())
+	}
+
+	if err := this.setEncodedLength(remlen); err != nil {
+		return 0, err
+	}
+
+	total, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
 
-	if err = writeUint16(this.buf, this.packetId); err != nil {
-		return nil, 0, err
+	if err = writeUint16(buf, this.packetId); err != nil {
+		return 0, err
 	}
 	total += 2
 
 	var n int
-	if n, err = this.buf.Write(this.returnCodes); err != nil {
-		return nil, 0, err
+
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, subackPropertySet); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	if n, err = buf.Write(this.returnCodes); err != nil {
+		return 0, err
 	}
 	total += n
 
-	return this.buf, total, nil
+	return total, nil
 }
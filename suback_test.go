@@ -60,6 +60,49 @@ func TestSubackMessageDecode(t *testing.T) {
 }
 
 // test with wrong return code
+// test the properties and reason codes of version 5
+func TestSubackMessageDecodeV5(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		11,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		6,    // properties length (6)
+		0x1f, // reason string
+		0, 3, // string length (3)
+		'b', 'a', 'd',
+		1,    // return code 1
+		0x87, // return code 0x87, not authorized
+	}
+
+	msg := NewSubackMessage()
+	msg.SetVersion(0x5)
+
+	n, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes decoded.")
+
+	reason, _ := msg.Properties().Bytes(PropReasonString)
+	assert.Equal(t, true, "bad", string(reason), "Incorrect reason string.")
+
+	assert.Equal(t, true, []byte{1, 0x87}, msg.ReturnCodes(), "Incorrect return codes.")
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// 0x87 is not a valid return code in version 4
+	msg = NewSubackMessage()
+	msg.SetVersion(0x4)
+
+	err = msg.AddReturnCode(0x87)
+	assert.Error(t, true, err)
+}
+
 func TestSubackMessageDecode2(t *testing.T) {
 	msgBytes := []byte{
 		byte(SUBACK << 4),
@@ -75,8 +118,29 @@ func TestSubackMessageDecode2(t *testing.T) {
 	src := bytes.NewBuffer(msgBytes)
 	msg := NewSubackMessage()
 
-	_, err := msg.Decode(src)
+	n, err := msg.Decode(src)
 	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+}
+
+// test insufficient bytes
+func TestSubackMessageDecode3(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		6,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // return code 1
+	}
+
+	src := bytes.NewBuffer(msgBytes)
+	msg := NewSubackMessage()
+
+	n, err := msg.Decode(src)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
 }
 
 func TestSubackMessageEncode(t *testing.T) {
@@ -98,10 +162,70 @@ func TestSubackMessageEncode(t *testing.T) {
 	msg.AddReturnCode(2)
 	msg.AddReturnCode(0x80)
 
-	dst, n, err := msg.Encode()
+	testRoundTrip(t, msg, msgBytes)
+}
+
+func TestSubackMessageMatchesSubscribe(t *testing.T) {
+	sub := NewSubscribeMessage()
+	sub.SetPacketId(7)
+	sub.AddTopic([]byte("surgemq"), 0)
+	sub.AddTopic([]byte("/a/b/#/c"), 1)
+	sub.AddTopic([]byte("/a/b/#/cdd"), 2)
+
+	msg := NewSubackMessage()
+	msg.SetPacketId(7)
+	msg.AddReturnCodes([]byte{0, 1})
+
+	assert.False(t, true, msg.MatchesSubscribe(sub), "SUBACK with 2 return codes should not match 3 topics.")
+
+	msg.AddReturnCode(0x80)
+
+	assert.True(t, true, msg.MatchesSubscribe(sub), "SUBACK should match SUBSCRIBE.")
+
+	msg.SetPacketId(8)
+
+	assert.False(t, true, msg.MatchesSubscribe(sub), "SUBACK with a different packet ID should not match.")
+
+	assert.True(t, true, sub.BuildSuback(func(topic []byte, qos byte) byte { return qos }).MatchesSubscribe(sub), "Built SUBACK should match SUBSCRIBE.")
+}
+
+// test without return codes
+func TestSubackMessageDecodeEmpty(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	n, err := NewSubackMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+}
+
+// test that the return codes are still valid once the buffer is reused
+func TestSubackMessageDecodeCopy(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		4,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		1,    // return code 1
+		0x80, // return code 2
+	}
+
+	msg := NewSubackMessage()
+
+	_, err := DecodeInto(msg, bytes.NewBuffer(msgBytes))
 	assert.NoError(t, true, err, "Error decoding message.")
 
-	assert.Equal(t, true, len(msgBytes), n, "Error decoding message.")
+	codes := msg.ReturnCodes()
+
+	// the buffer is overwritten by encoding, and returned to the pool by Release
+	msg.buf.Reset()
+	msg.buf.Write(bytes.Repeat([]byte{0xff}, len(msgBytes)))
+	msg.Release()
 
-	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
+	assert.Equal(t, true, []byte{1, 0x80}, codes, "Return codes changed with the buffer.")
 }
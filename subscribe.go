@@ -16,8 +16,10 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 )
 
 // The SUBSCRIBE Packet is sent from the Client to the Server to create one or more
@@ -29,13 +31,76 @@ import (
 type SubscribeMessage struct {
 	fixedHeader
 
-	packetId uint16
-	topics   [][]byte
-	qos      []byte
+	version    byte
+	packetId   uint16
+	properties Properties
+	topics     []topicQos
+	dedup      bool
+	maxTopics  int
+
+	// topicIndex maps each topic filter to the position of its first occurrence in
+	// topics. It's built the first time a filter is looked up in a message with at
+	// least minTopicIndex filters, and is nil until then, or once it's out of date.
+	topicIndex map[string]int
+}
+
+// minTopicIndex is the number of topic filters from which looking up a filter uses
+// an index, rather than comparing it with every filter in the message.
+const minTopicIndex = 16
+
+// topicQos is a topic filter and the byte following it in the SUBSCRIBE payload,
+// which contains the requested QoS.
+type topicQos struct {
+	topic []byte
+	qos   byte
 }
 
 var _ Message = (*SubscribeMessage)(nil)
 
+var (
+	// ErrTooManyTopics is returned when decoding a SUBSCRIBE or UNSUBSCRIBE message with
+	// more topic filters than the limit set with SetMaxTopics.
+	ErrTooManyTopics = errors.New("Too many topic filters")
+
+	// ErrMissingQos is returned when decoding a SUBSCRIBE message that ends right after
+	// a topic filter, without the byte containing the requested QoS.
+	ErrMissingQos = errors.New("Topic filter is not followed by the requested QoS")
+)
+
+// Subscription is a single topic filter in a SUBSCRIBE message, along with its
+// subscription options. In MQTT 3.1.1 the only option is the maximum QoS. MQTT 5.0
+// adds the NoLocal, RetainAsPublished and RetainHandling options, which are encoded
+// in the upper bits of the same byte.
+type Subscription struct {
+	Topic []byte
+
+	// Maximum QoS with which the Server can send Application Messages to the Client
+	Qos byte
+
+	// If set, Application Messages must not be forwarded to a connection with the
+	// same ClientId as the publishing connection.
+	NoLocal bool
+
+	// If set, Application Messages forwarded using this subscription keep the RETAIN
+	// flag they were published with.
+	RetainAsPublished bool
+
+	// Specifies whether retained messages are sent when the subscription is
+	// established. 0 sends them at the time of the subscribe, 1 only if the
+	// subscription does not currently exist, and 2 does not send them.
+	RetainHandling byte
+}
+
+func newSubscription(topic []byte, options byte) Subscription {
+	return Subscription{
+		Topic:             topic,
+		Qos:               options & 0x3,
+		NoLocal:           options&0x4 != 0,
+		RetainAsPublished: options&0x8 != 0,
+		RetainHandling:    (options >> 4) & 0x3,
+	}
+}
+
 // NewSubscribeMessage creates a new SUBSCRIBE message.
 func NewSubscribeMessage() *SubscribeMessage {
 	msg := &SubscribeMessage{}
@@ -44,6 +109,19 @@ func NewSubscribeMessage() *SubscribeMessage {
 	return msg
 }
 
+// MaxTopics returns the maximum number of topic filters accepted by Decode.
+func (this *SubscribeMessage) MaxTopics() int {
+	return this.maxTopics
+}
+
+// SetMaxTopics sets the maximum number of topic filters accepted by Decode, which
+// returns ErrTooManyTopics as soon as it reads a topic filter beyond the limit,
+// bounding the memory used by a message with a very large number of filters. 0 means
+// there's no limit, which is the default.
+func (this *SubscribeMessage) SetMaxTopics(v int) {
+	this.maxTopics = v
+}
+
 // PacketId returns the ID of the packet.
 func (this *SubscribeMessage) PacketId() uint16 {
 	return this.packetId
@@ -54,9 +132,105 @@ func (this *SubscribeMessage) SetPacketId(v uint16) {
 	this.packetId = v
 }
 
+// Version returns the protocol version of the connection this message is sent over.
+// The SUBSCRIBE packet does not carry the version itself, but for version 5 (MQTT 5.0)
+// the variable header includes a properties section.
+func (this *SubscribeMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *SubscribeMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("subscribe/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// Properties returns the SUBSCRIBE properties, which are only encoded and decoded
+// when version is 5.
+func (this *SubscribeMessage) Properties() *Properties {
+	return &this.properties
+}
+
+// SubscriptionIdentifier returns the identifier of the subscription, which the Server
+// includes in the PUBLISH packets it sends for the subscriptions in this message. The
+// second return value is false if the property is not present.
+func (this *SubscribeMessage) SubscriptionIdentifier() (uint32, bool) {
+	return this.properties.Uint(PropSubscriptionIdentifier)
+}
+
+// SetSubscriptionIdentifier sets the identifier of the subscription. An error is
+// returned if the identifier is 0 or larger than 268435455.
+func (this *SubscribeMessage) SetSubscriptionIdentifier(v uint32) error {
+	return this.properties.SetUint(PropSubscriptionIdentifier, v)
+}
+
+// DedupFilters returns whether Decode merges repeated topic filters.
+func (this *SubscribeMessage) DedupFilters() bool {
+	return this.dedup
+}
+
+// SetDedupFilters sets whether Decode merges repeated topic filters into one, keeping
+// the position of the first and the QoS of the last, the same as AddTopic. By default
+// repeated filters are kept as sent by the Client, which the spec allows, and can be
+// detected using HasDuplicateFilters.
+func (this *SubscribeMessage) SetDedupFilters(v bool) {
+	this.dedup = v
+}
+
+// HasDuplicateFilters checks to see if the same topic filter appears more than once
+// in the message.
+func (this *SubscribeMessage) HasDuplicateFilters() bool {
+	for i, t := range this.topics {
+		if this.index(t.topic) != i {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Canonicalize sorts the topic filters lexicographically and merges repeated filters
+// into one, keeping the subscription options of the one with the highest QoS, so
+// that messages with the same subscriptions always have the same filters in the
+// same order, e.g., for reproducible tests or caching. This changes the order in
+// which the filters are encoded, and so the order of the return codes in the SUBACK,
+// which is why it's never done unless asked for.
+func (this *SubscribeMessage) Canonicalize() {
+	sort.Slice(this.topics, func(i, j int) bool {
+		return bytes.Compare(this.topics[i].topic, this.topics[j].topic) < 0
+	})
+
+	topics := this.topics[:0]
+
+	for _, t := range this.topics {
+		if n := len(topics); n > 0 && bytes.Equal(topics[n-1].topic, t.topic) {
+			if t.qos&0x3 > topics[n-1].qos&0x3 {
+				topics[n-1].qos = t.qos
+			}
+			continue
+		}
+
+		topics = append(topics, t)
+	}
+
+	this.topics = topics
+	this.topicIndex = nil
+}
+
 // Topics returns a list of topics sent by the Client.
 func (this *SubscribeMessage) Topics() [][]byte {
-	return this.topics
+	topics := make([][]byte, len(this.topics))
+
+	for i, t := range this.topics {
+		topics[i] = t.topic
+	}
+
+	return topics
 }
 
 // AddTopic adds a single topic to the message, along with the corresponding QoS.
@@ -66,24 +240,13 @@ func (this *SubscribeMessage) AddTopic(topic []byte, qos byte) error {
 		return fmt.Errorf("Invalid QoS %d", qos)
 	}
 
-	var i int
-	var t []byte
-	var found bool
-
-	for i, t = range this.topics {
-		if bytes.Equal(t, topic) {
-			found = true
-			break
-		}
-	}
-
-	if found {
-		this.qos[i] = qos
+	if i := this.index(topic); i >= 0 {
+		this.topics[i].qos = qos
 		return nil
 	}
 
-	this.topics = append(this.topics, topic)
-	this.qos = append(this.qos, qos)
+	this.topics = append(this.topics, topicQos{topic, qos})
+	this.indexLast()
 
 	return nil
 }
@@ -91,88 +254,205 @@ func (this *SubscribeMessage) AddTopic(topic []byte, qos byte) error {
 // RemoveTopic removes a single topic from the list of existing ones in the message.
 // If topic does not exist it just does nothing.
 func (this *SubscribeMessage) RemoveTopic(topic []byte) {
-	var i int
-	var t []byte
-	var found bool
-
-	for i, t = range this.topics {
-		if bytes.Equal(t, topic) {
-			found = true
-			break
-		}
-	}
-
-	if found {
+	if i := this.index(topic); i >= 0 {
 		this.topics = append(this.topics[:i], this.topics[i+1:]...)
-		this.qos = append(this.qos[:i], this.qos[i+1:]...)
+		this.topicIndex = nil
 	}
 }
 
 // TopicExists checks to see if a topic exists in the list.
 func (this *SubscribeMessage) TopicExists(topic []byte) bool {
+	return this.index(topic) >= 0
+}
+
+// CheckTopics returns ErrInvalidTopicFilter if any of the topic filters is not valid,
+// see ValidTopicFilter. Decode doesn't check the topic filters, so a Server can decide
+// whether to reject the message or only refuse the invalid subscriptions.
+func (this *SubscribeMessage) CheckTopics() error {
 	for _, t := range this.topics {
-		if bytes.Equal(t, topic) {
-			return true
+		if !ValidTopicFilter(t.topic) {
+			return ErrInvalidTopicFilter
 		}
 	}
 
-	return false
+	return nil
 }
 
 // TopicQos returns the QoS level of a topic. If topic does not exist, QosFailure
 // is returned.
 func (this *SubscribeMessage) TopicQos(topic []byte) byte {
-	for i, t := range this.topics {
-		if bytes.Equal(t, topic) {
-			return this.qos[i]
-		}
+	if i := this.index(topic); i >= 0 {
+		return this.topics[i].qos
 	}
 
 	return QosFailure
 }
 
+func (this *SubscribeMessage) index(topic []byte) int {
+	if len(this.topics) < minTopicIndex {
+		for i, t := range this.topics {
+			if bytes.Equal(t.topic, topic) {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	if this.topicIndex == nil {
+		this.topicIndex = make(map[string]int, len(this.topics))
+
+		for i := range this.topics {
+			this.indexAt(i)
+		}
+	}
+
+	if i, ok := this.topicIndex[string(topic)]; ok {
+		return i
+	}
+
+	return -1
+}
+
+// indexLast adds the last topic filter to the index, if the index is in use.
+func (this *SubscribeMessage) indexLast() {
+	if this.topicIndex != nil {
+		this.indexAt(len(this.topics) - 1)
+	}
+}
+
+// indexAt adds the topic filter at position i to the index, unless the same filter
+// appears earlier in the message.
+func (this *SubscribeMessage) indexAt(i int) {
+	t := string(this.topics[i].topic)
+
+	if _, ok := this.topicIndex[t]; !ok {
+		this.topicIndex[t] = i
+	}
+}
+
+// Subscriptions returns the list of topic filters in the message along with their
+// subscription options, in the same order as Topics() and Qos().
+func (this *SubscribeMessage) Subscriptions() []Subscription {
+	subs := make([]Subscription, len(this.topics))
+
+	for i, t := range this.topics {
+		subs[i] = newSubscription(t.topic, t.qos)
+	}
+
+	return subs
+}
+
 // Qos returns the list of QoS current in the message.
 func (this *SubscribeMessage) Qos() []byte {
-	return this.qos
+	qos := make([]byte, len(this.topics))
+
+	for i, t := range this.topics {
+		qos[i] = t.qos
+	}
+
+	return qos
+}
+
+// BuildSuback returns the SUBACK message in response to this message. The authorize
+// function is called for each topic filter, in order, with the requested maximum QoS,
+// and returns the QoS granted to the subscription, or QosFailure if the subscription
+// is rejected. A granted QoS higher than the requested one is lowered to the requested
+// QoS, and any other value is treated as QosFailure. The SUBACK has the same version
+// as this message.
+func (this *SubscribeMessage) BuildSuback(authorize func(topic []byte, qos byte) byte) *SubackMessage {
+	msg := NewSubackMessage()
+	msg.version = this.version
+	msg.SetPacketId(this.packetId)
+
+	for _, t := range this.topics {
+		qos := t.qos & 0x3
+
+		granted := authorize(t.topic, qos)
+
+		if granted != QosFailure {
+			granted = GrantQoS(granted, qos)
+		}
+
+		msg.returnCodes = append(msg.returnCodes, granted)
+	}
+
+	return msg
+}
+
+// GrantQoS returns the QoS granted to a subscription that requested the given QoS,
+// when the Server supports up to max, e.g., as advertised with the Maximum QoS
+// property in version 5. The requested QoS is lowered to max if it's higher.
+// QosFailure is returned if requested is not a valid QoS. It can be used in the
+// authorize function of BuildSuback.
+func GrantQoS(requested, max byte) byte {
+	if !ValidQos(requested) {
+		return QosFailure
+	}
+
+	if requested > max {
+		return max
+	}
+
+	return requested
 }
 
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *SubscribeMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
+
+	this.topics = this.topics[:0]
+	this.topicIndex = nil
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return total, this.decodeError(err)
+	}
+
+	if this.packetId == 0 {
+		return total, protocolError("subscribe/Decode", "Packet identifier MUST be non-zero")
+	}
+
+	if this.version == 0x5 {
+		if _, err = this.properties.decode(this.buf, subscribePropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
 	}
-	total += 2
 
 	for this.buf.Len() > 0 {
-		t, n, err := readLPBytes(this.buf)
+		t, _, err := readLPBytes(this.buf)
 		if err != nil {
-			return total + n, err
+			return total, this.decodeError(err)
 		}
-		total += n
-
-		this.topics = append(this.topics, t)
 
+		// The topic filter is only added once its QoS is read, so a truncated filter
+		// doesn't leave a filter without a QoS behind
 		b, err := this.buf.ReadByte()
 		if err != nil {
-			return total, err
+			return total, this.decodeError(newDecodeError(this.buf, ErrMissingQos))
+		}
+
+		if this.dedup {
+			if i := this.index(t); i >= 0 {
+				this.topics[i].qos = b
+				continue
+			}
+		}
+
+		if this.maxTopics > 0 && len(this.topics) >= this.maxTopics {
+			return total, ErrTooManyTopics
 		}
-		total += 1
 
-		this.qos = append(this.qos, b)
+		this.topics = append(this.topics, topicQos{t, b})
+		this.indexLast()
 	}
 
 	if len(this.topics) == 0 {
-		return 0, fmt.Errorf("subscribe/Decode: Empty topic list")
+		return total, protocolError("subscribe/Decode", "Empty topic list")
 	}
 
 	return total, nil
@@ -184,38 +464,78 @@ func (this *SubscribeMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *SubscribeMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *SubscribeMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *SubscribeMessage) encode(buf *bytes.Buffer) (int, error) {
+	if this.packetId == 0 {
+		return 0, fmt.Errorf("subscribe/Encode: Packet identifier MUST be non-zero")
+	}
+
 	// packet ID
-	total := 2
+	remlen := int64(2)
 
-	for _, t := range this.topics {
-		total += 2 + len(t) + 1
+	if this.version == 0x5 {
+		remlen += int64(this.properties.size())
 	}
 
-	this.SetRemainingLength(int32(total))
+	for _, t := range this.topics {
+		remlen += int64(2 + len(t.topic) + 1)
+	}
 
-	total = 0
+	if err := this.setEncodedLength(remlen); err != nil {
+		return 0, err
+	}
 
-	_, total, err := this.fixedHeader.Encode()
+	total, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, total, err
+		return total, err
 	}
 
-	if err = writeUint16(this.buf, this.packetId); err != nil {
-		return nil, total, err
+	if err = writeUint16(buf, this.packetId); err != nil {
+		return total, err
 	}
 	total += 2
 
 	var n int
 
-	for i, t := range this.topics {
-		if n, err = writeLPBytes(this.buf, t); err != nil {
-			return nil, total, err
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, subscribePropertySet); err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	for _, t := range this.topics {
+		if n, err = writeUTF8(buf, t.topic); err != nil {
+			return total, err
 		}
 		total += n
 
-		this.buf.WriteByte(this.qos[i])
+		buf.WriteByte(t.qos)
 		total += 1
 	}
 
-	return this.buf, total, nil
+	return total, nil
 }
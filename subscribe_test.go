@@ -16,6 +16,7 @@ package mqtt
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/dataence/assert"
@@ -93,8 +94,40 @@ func TestSubscribeMessageDecode2(t *testing.T) {
 	src := bytes.NewBuffer(msgBytes)
 	msg := NewSubscribeMessage()
 
-	_, err := msg.Decode(src)
+	n, err := msg.Decode(src)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+}
+
+// test truncated topic
+func TestSubscribeMessageDecode3(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		8,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g',
+	}
+
+	src := bytes.NewBuffer(msgBytes)
+	msg := NewSubscribeMessage()
+
+	n, err := msg.Decode(src)
+	assert.Error(t, true, err)
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+
+	// stream ends before the remaining length
+	src = bytes.NewBuffer(msgBytes[:6])
+	msg = NewSubscribeMessage()
+
+	n, err = msg.Decode(src)
 	assert.Error(t, true, err)
+
+	assert.Equal(t, true, 6, n, "Incorrect bytes read.")
 }
 
 func TestSubscribeMessageEncode(t *testing.T) {
@@ -123,10 +156,548 @@ func TestSubscribeMessageEncode(t *testing.T) {
 	msg.AddTopic([]byte("/a/b/#/c"), 1)
 	msg.AddTopic([]byte("/a/b/#/cdd"), 2)
 
+	testRoundTrip(t, msg, msgBytes)
+}
+
+func TestSubscribeMessageSubscriptions(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		36,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // QoS
+		0, // topic name MSB (0)
+		8, // topic name LSB (8)
+		'/', 'a', '/', 'b', '/', '#', '/', 'c',
+		1,  // QoS
+		0,  // topic name MSB (0)
+		10, // topic name LSB (10)
+		'/', 'a', '/', 'b', '/', '#', '/', 'c', 'd', 'd',
+		2, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	subs := msg.Subscriptions()
+	assert.Equal(t, true, len(msg.Topics()), len(subs), "Incorrect number of subscriptions.")
+
+	for i, sub := range subs {
+		assert.Equal(t, true, msg.Topics()[i], sub.Topic, "Incorrect subscription topic.")
+
+		assert.Equal(t, true, msg.Qos()[i], sub.Qos, "Incorrect subscription QoS.")
+
+		assert.False(t, true, sub.NoLocal, "Incorrect subscription no local option.")
+
+		assert.False(t, true, sub.RetainAsPublished, "Incorrect subscription retain as published option.")
+
+		assert.Equal(t, true, 0, sub.RetainHandling, "Incorrect subscription retain handling option.")
+	}
+}
+
+func TestSubscribeMessageRemoveTopic(t *testing.T) {
+	msg := NewSubscribeMessage()
+	msg.AddTopic([]byte("a"), 0)
+	msg.AddTopic([]byte("b"), 1)
+	msg.AddTopic([]byte("c"), 2)
+
+	msg.RemoveTopic([]byte("b"))
+
+	assert.Equal(t, true, [][]byte{[]byte("a"), []byte("c")}, msg.Topics(), "Incorrect topics.")
+
+	assert.Equal(t, true, []byte{0, 2}, msg.Qos(), "Incorrect QoS.")
+
+	assert.Equal(t, true, 2, msg.TopicQos([]byte("c")), "Incorrect topic QoS.")
+
+	msg.AddTopic([]byte("d"), 1)
+	msg.AddTopic([]byte("a"), 1)
+
+	assert.Equal(t, true, [][]byte{[]byte("a"), []byte("c"), []byte("d")}, msg.Topics(), "Incorrect topics.")
+
+	assert.Equal(t, true, []byte{1, 2, 1}, msg.Qos(), "Incorrect QoS.")
+
+	msg.RemoveTopic([]byte("d"))
+	msg.RemoveTopic([]byte("x"))
+
+	assert.Equal(t, true, [][]byte{[]byte("a"), []byte("c")}, msg.Topics(), "Incorrect topics.")
+
+	assert.Equal(t, true, []byte{1, 2}, msg.Qos(), "Incorrect QoS.")
+}
+
+func TestSubscribeMessageSubscriptionIdentifier(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		15,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		2,    // properties length (2)
+		0x0B, // subscription identifier
+		10,   // subscription identifier (10)
+		0,    // topic name MSB (0)
+		7,    // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		1, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+	msg.SetVersion(0x5)
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte("surgemq"), 1)
+
+	_, ok := msg.SubscriptionIdentifier()
+	assert.False(t, true, ok, "Not expecting subscription identifier.")
+
+	err := msg.SetSubscriptionIdentifier(0)
+	assert.Error(t, true, err)
+
+	err = msg.SetSubscriptionIdentifier(10)
+	assert.NoError(t, true, err, "Error setting subscription identifier.")
+
 	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewSubscribeMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
 	assert.NoError(t, true, err, "Error decoding message.")
 
-	assert.Equal(t, true, len(msgBytes), n, "Error decoding message.")
+	id, ok := msg.SubscriptionIdentifier()
+	assert.True(t, true, ok, "Expecting subscription identifier.")
+
+	assert.Equal(t, true, 10, id, "Incorrect subscription identifier.")
+
+	assert.Equal(t, true, [][]byte{[]byte("surgemq")}, msg.Topics(), "Incorrect topics.")
+
+	assert.Equal(t, true, []byte{1}, msg.Qos(), "Incorrect QoS.")
+}
+
+// test decoding into a message that already has topics
+func TestSubscribeMessageDecodeReuse(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		6,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		1, // topic name LSB (1)
+		'a',
+		1, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+	msg.AddTopic([]byte("b"), 0)
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, [][]byte{[]byte("a")}, msg.Topics(), "Incorrect topics.")
+}
+
+// test packet ID 0
+func TestSubscribeMessagePacketId(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		6,
+		0, // packet ID MSB (0)
+		0, // packet ID LSB (0)
+		0, // topic name MSB (0)
+		1, // topic name LSB (1)
+		'a',
+		1, // QoS
+	}
+
+	_, err := NewSubscribeMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg := NewSubscribeMessage()
+	msg.SetPacketId(0)
+	msg.AddTopic([]byte("a"), 1)
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	msg.SetPacketId(7)
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+// test repeated topic filters, with and without dedup
+func TestSubscribeMessageDuplicateFilters(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		20,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		1, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		0, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		2, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.True(t, true, msg.HasDuplicateFilters(), "Expecting duplicate filters.")
+
+	assert.Equal(t, true, 3, len(msg.Topics()), "Incorrect number of topics.")
+
+	msg.SetDedupFilters(true)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.False(t, true, msg.HasDuplicateFilters(), "Unexpected duplicate filters.")
+
+	assert.Equal(t, true, [][]byte{[]byte("a/b"), []byte("c/d")}, msg.Topics(), "Incorrect topics.")
+
+	assert.Equal(t, true, []byte{2, 0}, msg.Qos(), "Incorrect QoS.")
+}
+
+func TestSubscribeMessageBuildSuback(t *testing.T) {
+	msg := NewSubscribeMessage()
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte("a/b"), 2)
+	msg.AddTopic([]byte("private/c"), 1)
+	msg.AddTopic([]byte("d/e"), 1)
+
+	suback := msg.BuildSuback(func(topic []byte, qos byte) byte {
+		if bytes.HasPrefix(topic, []byte("private/")) {
+			return QosFailure
+		}
+
+		// QoS 2 is downgraded to 1
+		if qos > 1 {
+			return 1
+		}
+
+		// higher than requested, lowered to the requested QoS
+		return 2
+	})
+
+	assert.Equal(t, true, 7, suback.PacketId(), "Incorrect packet ID.")
+
+	assert.Equal(t, true, []byte{1, QosFailure, 1}, suback.ReturnCodes(), "Incorrect return codes.")
+
+	_, _, err := suback.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	// invalid return values are treated as failures
+	suback = msg.BuildSuback(func(topic []byte, qos byte) byte {
+		return 3
+	})
+
+	assert.Equal(t, true, []byte{QosFailure, QosFailure, QosFailure}, suback.ReturnCodes(), "Incorrect return codes.")
+}
+
+// test that the SUBACK built in response to a version 5 SUBSCRIBE is version 5
+func TestSubscribeMessageBuildSubackV5(t *testing.T) {
+	msg := NewSubscribeMessage()
+	msg.SetVersion(0x5)
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte("a/b"), 1)
+	msg.AddTopic([]byte("private/c"), 1)
+
+	suback := msg.BuildSuback(func(topic []byte, qos byte) byte {
+		if bytes.HasPrefix(topic, []byte("private/")) {
+			return QosFailure
+		}
+
+		return qos
+	})
+
+	assert.Equal(t, true, 0x5, suback.Version(), "Incorrect version.")
+
+	msgBytes := []byte{
+		byte(SUBACK << 4),
+		5,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		0,    // properties length (0)
+		1,    // return code 1
+		0x80, // return code 0x80
+	}
+
+	dst, n, err := suback.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.Version = 0x5
+
+	msg2, _, err := d.Decode()
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []byte{1, QosFailure}, msg2.(*SubackMessage).ReturnCodes(), "Incorrect return codes.")
+
+	assert.True(t, true, msg2.(*SubackMessage).MatchesSubscribe(msg), "Decoded SUBACK should match SUBSCRIBE.")
+}
+
+func TestGrantQoS(t *testing.T) {
+	assert.Equal(t, true, byte(1), GrantQoS(2, 1), "Incorrect granted QoS.")
+
+	assert.Equal(t, true, byte(1), GrantQoS(1, 2), "Incorrect granted QoS.")
+
+	assert.Equal(t, true, byte(0), GrantQoS(2, 0), "Incorrect granted QoS.")
+
+	assert.Equal(t, true, byte(QosFailure), GrantQoS(3, 2), "Incorrect granted QoS.")
+
+	msg := NewSubscribeMessage()
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte("a/b"), 2)
+	msg.AddTopic([]byte("c/d"), 0)
+	msg.AddTopic([]byte("e/f"), 1)
+
+	// the Server supports up to QoS 1
+	suback := msg.BuildSuback(func(topic []byte, qos byte) byte {
+		return GrantQoS(qos, 1)
+	})
+
+	assert.Equal(t, true, []byte{1, 0, 1}, suback.ReturnCodes(), "Incorrect return codes.")
+}
+
+func TestSubscribeMessageMaxTopics(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		20,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		1, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		0, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'e', '/', 'f',
+		2, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+	msg.SetMaxTopics(2)
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrTooManyTopics, err, "Incorrect error.")
+
+	assert.Equal(t, true, 2, len(msg.Topics()), "Incorrect number of topics.")
+
+	msg.SetMaxTopics(3)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// limit set through the Decoder
+	d := NewDecoder(bytes.NewBuffer(msgBytes))
+	d.MaxTopics = 2
+
+	_, _, err = d.Decode()
+	assert.Equal(t, true, ErrTooManyTopics, err, "Incorrect error.")
+}
+
+func TestSubscribeMessageCanonicalize(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		26,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		0, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		1, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		2, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		0, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 4, len(msg.Topics()), "Incorrect number of topics.")
+
+	msg.Canonicalize()
+
+	assert.Equal(t, true, [][]byte{[]byte("a/b"), []byte("c/d")}, msg.Topics(), "Incorrect topics.")
+	assert.Equal(t, true, []byte{1, 2}, msg.Qos(), "Incorrect QoS.")
+	assert.False(t, true, msg.HasDuplicateFilters(), "Unexpected duplicate filters.")
+
+	canonical := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		14,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		1, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		2, // QoS
+	}
+
+	dst, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, canonical, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	// already canonical
+	msg.Canonicalize()
+
+	assert.Equal(t, true, [][]byte{[]byte("a/b"), []byte("c/d")}, msg.Topics(), "Incorrect topics.")
+	assert.Equal(t, true, []byte{1, 2}, msg.Qos(), "Incorrect QoS.")
+}
+
+// test that looking up topic filters with the index gives the same results as
+// without, as filters are added and removed
+func TestSubscribeMessageTopicIndex(t *testing.T) {
+	msg := NewSubscribeMessage()
+
+	for i := 0; i < minTopicIndex*2; i++ {
+		msg.AddTopic([]byte(fmt.Sprintf("a/%d", i)), byte(i%3))
+	}
+
+	assert.True(t, true, msg.TopicExists([]byte("a/0")), "Topic should exist.")
+	assert.True(t, true, msg.topicIndex != nil, "Index should be built.")
+
+	assert.Equal(t, true, byte(2), msg.TopicQos([]byte("a/20")), "Incorrect QoS.")
+	assert.False(t, true, msg.TopicExists([]byte("b/0")), "Topic should not exist.")
+
+	// added after the index is built
+	msg.AddTopic([]byte("b/0"), 1)
+	assert.True(t, true, msg.TopicExists([]byte("b/0")), "Topic should exist.")
+	assert.Equal(t, true, byte(1), msg.TopicQos([]byte("b/0")), "Incorrect QoS.")
+
+	// updated
+	msg.AddTopic([]byte("a/20"), 0)
+	assert.Equal(t, true, byte(0), msg.TopicQos([]byte("a/20")), "Incorrect QoS.")
+	assert.Equal(t, true, minTopicIndex*2+1, len(msg.Topics()), "Incorrect number of topics.")
+
+	// removed, which shifts the filters after it
+	msg.RemoveTopic([]byte("a/5"))
+	assert.False(t, true, msg.TopicExists([]byte("a/5")), "Topic should not exist.")
+
+	for i, topic := range msg.Topics() {
+		assert.Equal(t, true, i, msg.index(topic), "Incorrect topic index.")
+		assert.Equal(t, true, msg.Qos()[i], msg.TopicQos(topic), "Incorrect QoS.")
+	}
+
+	// reordered
+	msg.Canonicalize()
+
+	for i, topic := range msg.Topics() {
+		assert.Equal(t, true, i, msg.index(topic), "Incorrect topic index.")
+	}
+
+	// duplicates decoded without merging keep the first one
+	msgBytes := []byte{byte(SUBSCRIBE<<4) | 2, 0, 0, 7}
+
+	for i := 0; i < minTopicIndex; i++ {
+		msgBytes = append(msgBytes, 0, 3, 'c', '/', byte('a'+i), 1)
+	}
+	msgBytes = append(msgBytes, 0, 3, 'c', '/', 'a', 2)
+	msgBytes[1] = byte(len(msgBytes) - 2)
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.False(t, true, msg.TopicExists([]byte("a/0")), "Topic should not exist.")
+	assert.Equal(t, true, byte(1), msg.TopicQos([]byte("c/a")), "Incorrect QoS.")
+	assert.True(t, true, msg.HasDuplicateFilters(), "Expecting duplicate filters.")
+}
+
+func benchmarkTopicExists(b *testing.B, n int) {
+	msg := NewSubscribeMessage()
+
+	for i := 0; i < n; i++ {
+		msg.AddTopic([]byte(fmt.Sprintf("sensors/%d/temperature", i)), 1)
+	}
+
+	topic := []byte(fmt.Sprintf("sensors/%d/temperature", n-1))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !msg.TopicExists(topic) {
+			b.Fatal("Topic should exist.")
+		}
+	}
+}
+
+func BenchmarkSubscribeMessageTopicExists10(b *testing.B) {
+	benchmarkTopicExists(b, 10)
+}
+
+func BenchmarkSubscribeMessageTopicExists1000(b *testing.B) {
+	benchmarkTopicExists(b, 1000)
+}
+
+// test a topic filter at the end of the message without its QoS
+func TestSubscribeMessageDecodeMissingQos(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		13,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		1, // QoS
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+	}
+
+	msg := NewSubscribeMessage()
+
+	n, err := msg.Decode(bytes.NewBuffer(msgBytes))
+
+	de, ok := err.(*DecodeError)
+	assert.True(t, true, ok, "Expecting DecodeError.")
+
+	assert.Equal(t, true, ErrMissingQos, de.Err, "Incorrect error.")
+
+	assert.Equal(t, true, len(msgBytes), de.Offset, "Incorrect offset.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes read.")
+
+	assert.Equal(t, true, [][]byte{[]byte("a/b")}, msg.Topics(), "Incorrect topics.")
 
-	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
+	assert.False(t, true, msg.TopicExists([]byte("c/d")), "Topic without QoS should not be added.")
 }
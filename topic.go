@@ -0,0 +1,135 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	// ErrInvalidTopic is returned when a topic name is empty, contains wildcard
+	// characters, or is not a valid UTF-8 encoded string.
+	ErrInvalidTopic = errors.New("Invalid topic name")
+
+	// ErrInvalidTopicFilter is returned when a topic filter in a SUBSCRIBE or
+	// UNSUBSCRIBE message is not valid, see ValidTopicFilter.
+	ErrInvalidTopicFilter = errors.New("Invalid topic filter")
+)
+
+// NormalizeTopic returns the canonical form of a topic name, so it can be compared
+// against the topics in authorization rules. MQTT topic names are case sensitive and
+// every level, including empty ones, is significant, so a valid topic is returned
+// unchanged. ErrInvalidTopic is returned if the topic is empty, contains wildcard
+// characters, or is not a valid UTF-8 encoded string.
+func NormalizeTopic(topic []byte) ([]byte, error) {
+	if !ValidTopic(topic) || len(topic) > 65535 || !validUTF8(topic) {
+		return nil, ErrInvalidTopic
+	}
+
+	return topic, nil
+}
+
+// TopicLevels returns the number of levels in the topic, which is the number of
+// topic level separators ('/') plus one. Empty levels are counted, so "/a" has 2
+// levels and "a//b" has 3. An empty topic has 0 levels. TopicLevels does not
+// allocate.
+func TopicLevels(topic []byte) int {
+	if len(topic) == 0 {
+		return 0
+	}
+
+	return bytes.Count(topic, []byte{'/'}) + 1
+}
+
+// ValidTopicFilter checks the topic filter to see if it's valid, i.e., it's not empty,
+// it's a valid UTF-8 encoded string, and the wildcard characters are used as whole
+// levels, with the multi-level wildcard '#' only as the last level.
+func ValidTopicFilter(filter []byte) bool {
+	if len(filter) == 0 || !validUTF8(filter) {
+		return false
+	}
+
+	levels := bytes.Split(filter, []byte{'/'})
+
+	for i, level := range levels {
+		if bytes.IndexAny(level, "+#") == -1 {
+			continue
+		}
+
+		if len(level) != 1 || (level[0] == '#' && i != len(levels)-1) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilterSubsumes checks to see if the topic filter general matches every topic name
+// matched by the topic filter specific, e.g., "a/#" subsumes "a/b/c", "a/+" and "a",
+// and "a/+" subsumes "a/b", but not "a/#". Every filter subsumes itself. Both filters
+// can contain the wildcard characters '+' and '#'. As wildcards at the first level
+// don't match topic names starting with '$', a filter starting with a wildcard does
+// not subsume a filter starting with '$'. Both filters are assumed to be valid.
+func FilterSubsumes(general, specific []byte) bool {
+	if len(specific) > 0 && specific[0] == '$' && len(general) > 0 && (general[0] == '+' || general[0] == '#') {
+		return false
+	}
+
+	g := bytes.Split(general, []byte{'/'})
+	s := bytes.Split(specific, []byte{'/'})
+
+	for i, level := range g {
+		// '#' matches the parent level and any number of child levels
+		if len(level) == 1 && level[0] == '#' {
+			return true
+		}
+
+		if i >= len(s) {
+			return false
+		}
+
+		switch {
+		case len(s[i]) == 1 && s[i][0] == '#':
+			return false
+
+		case len(level) == 1 && level[0] == '+':
+			continue
+
+		case !bytes.Equal(level, s[i]):
+			return false
+		}
+	}
+
+	return len(g) == len(s)
+}
+
+// MatchRetained returns the topic names of the retained messages that match the topic
+// filter, in the same order, which are the retained messages the Server delivers when
+// a Client subscribes to the filter. As required by the spec, a filter starting with
+// a wildcard does not match topic names starting with '$', such as "$SYS/...".
+func MatchRetained(filter []byte, topics [][]byte) [][]byte {
+	var matched [][]byte
+
+	for _, topic := range topics {
+		// A topic name is a filter without wildcards, so the filter matches it if it
+		// subsumes it
+		if FilterSubsumes(filter, topic) {
+			matched = append(matched, topic)
+		}
+	}
+
+	return matched
+}
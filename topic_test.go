@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestNormalizeTopic(t *testing.T) {
+	topic, err := NormalizeTopic([]byte("a/b/c"))
+	assert.NoError(t, true, err, "Error normalizing topic.")
+
+	assert.Equal(t, true, "a/b/c", string(topic), "Incorrect topic.")
+
+	_, err = NormalizeTopic([]byte(""))
+	assert.Equal(t, true, ErrInvalidTopic, err, "Incorrect error.")
+
+	_, err = NormalizeTopic([]byte("a/#"))
+	assert.Equal(t, true, ErrInvalidTopic, err, "Incorrect error.")
+
+	_, err = NormalizeTopic([]byte{'a', '/', 0xff})
+	assert.Equal(t, true, ErrInvalidTopic, err, "Incorrect error.")
+}
+
+func TestTopicLevels(t *testing.T) {
+	assert.Equal(t, true, 3, TopicLevels([]byte("a/b/c")), "Incorrect topic levels.")
+
+	assert.Equal(t, true, 2, TopicLevels([]byte("/a")), "Incorrect topic levels.")
+
+	assert.Equal(t, true, 3, TopicLevels([]byte("a//b")), "Incorrect topic levels.")
+
+	assert.Equal(t, true, 1, TopicLevels([]byte("a")), "Incorrect topic levels.")
+
+	assert.Equal(t, true, 0, TopicLevels(nil), "Incorrect topic levels.")
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	assert.True(t, true, ValidTopicFilter([]byte("a/b/c")), "Topic filter should be valid.")
+
+	assert.True(t, true, ValidTopicFilter([]byte("+/b/#")), "Topic filter should be valid.")
+
+	assert.True(t, true, ValidTopicFilter([]byte("#")), "Topic filter should be valid.")
+
+	assert.False(t, true, ValidTopicFilter([]byte("")), "Topic filter should be invalid.")
+
+	assert.False(t, true, ValidTopicFilter([]byte("a/#/c")), "Topic filter should be invalid.")
+
+	assert.False(t, true, ValidTopicFilter([]byte("a/b+")), "Topic filter should be invalid.")
+
+	assert.False(t, true, ValidTopicFilter([]byte{'a', '/', 0xff}), "Topic filter should be invalid.")
+}
+
+func TestFilterSubsumes(t *testing.T) {
+	tests := []struct {
+		general, specific string
+		subsumes          bool
+	}{
+		{"a/#", "a/+", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/#", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"+/+", "a/+", true},
+		{"#", "a/b/#", true},
+		{"a/b", "a/b", true},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/b", "a/+", false},
+		{"a/b", "a/c", false},
+		{"a/#", "b/#", false},
+		{"a/b/c", "a/b", false},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, true, test.subsumes, FilterSubsumes([]byte(test.general), []byte(test.specific)), "Incorrect result for "+test.general+" and "+test.specific+".")
+	}
+}
+
+func TestMatchRetained(t *testing.T) {
+	topics := [][]byte{
+		[]byte("$SYS/broker/uptime"),
+		[]byte("a/b"),
+		[]byte("a"),
+		[]byte("$SYS/broker/clients"),
+		[]byte("a/b/c"),
+		[]byte("d"),
+	}
+
+	matched := MatchRetained([]byte("#"), topics)
+	assert.Equal(t, true, [][]byte{[]byte("a/b"), []byte("a"), []byte("a/b/c"), []byte("d")}, matched, "Incorrect topics.")
+
+	matched = MatchRetained([]byte("+/b"), topics)
+	assert.Equal(t, true, [][]byte{[]byte("a/b")}, matched, "Incorrect topics.")
+
+	matched = MatchRetained([]byte("a/#"), topics)
+	assert.Equal(t, true, [][]byte{[]byte("a/b"), []byte("a"), []byte("a/b/c")}, matched, "Incorrect topics.")
+
+	matched = MatchRetained([]byte("$SYS/#"), topics)
+	assert.Equal(t, true, [][]byte{[]byte("$SYS/broker/uptime"), []byte("$SYS/broker/clients")}, matched, "Incorrect topics.")
+
+	matched = MatchRetained([]byte("e/+"), topics)
+	assert.Equal(t, true, 0, len(matched), "Incorrect number of topics.")
+}
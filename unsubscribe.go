@@ -24,8 +24,11 @@ import (
 type UnsubscribeMessage struct {
 	fixedHeader
 
-	packetId uint16
-	topics   [][]byte
+	version    byte
+	packetId   uint16
+	properties Properties
+	topics     [][]byte
+	maxTopics  int
 }
 
 var _ Message = (*UnsubscribeMessage)(nil)
@@ -38,6 +41,19 @@ func NewUnsubscribeMessage() *UnsubscribeMessage {
 	return msg
 }
 
+// MaxTopics returns the maximum number of topic filters accepted by Decode.
+func (this *UnsubscribeMessage) MaxTopics() int {
+	return this.maxTopics
+}
+
+// SetMaxTopics sets the maximum number of topic filters accepted by Decode, which
+// returns ErrTooManyTopics as soon as it reads a topic filter beyond the limit,
+// bounding the memory used by a message with a very large number of filters. 0 means
+// there's no limit, which is the default.
+func (this *UnsubscribeMessage) SetMaxTopics(v int) {
+	this.maxTopics = v
+}
+
 // PacketId returns the ID of the packet.
 func (this *UnsubscribeMessage) PacketId() uint16 {
 	return this.packetId
@@ -48,6 +64,30 @@ func (this *UnsubscribeMessage) SetPacketId(v uint16) {
 	this.packetId = v
 }
 
+// Version returns the protocol version of the connection this message is sent over.
+// The UNSUBSCRIBE packet does not carry the version itself, but for version 5 (MQTT
+// 5.0) the variable header includes a properties section.
+func (this *UnsubscribeMessage) Version() byte {
+	return this.version
+}
+
+// SetVersion sets the protocol version of the connection this message is sent over.
+// An error is returned if the version is not one of the supported versions.
+func (this *UnsubscribeMessage) SetVersion(v byte) error {
+	if _, ok := SupportedVersions[v]; !ok {
+		return fmt.Errorf("unsubscribe/SetVersion: Invalid version number %d", v)
+	}
+
+	this.version = v
+	return nil
+}
+
+// Properties returns the UNSUBSCRIBE properties, which are only encoded and decoded
+// when version is 5. User properties are the only properties allowed.
+func (this *UnsubscribeMessage) Properties() *Properties {
+	return &this.properties
+}
+
 // Topics returns a list of topics sent by the Client.
 func (this *UnsubscribeMessage) Topics() [][]byte {
 	return this.topics
@@ -92,35 +132,58 @@ func (this *UnsubscribeMessage) TopicExists(topic []byte) bool {
 	return false
 }
 
+// CheckTopics returns ErrInvalidTopicFilter if any of the topic filters is not valid,
+// see ValidTopicFilter. Decode doesn't check the topic filters.
+func (this *UnsubscribeMessage) CheckTopics() error {
+	for _, t := range this.topics {
+		if !ValidTopicFilter(t) {
+			return ErrInvalidTopicFilter
+		}
+	}
+
+	return nil
+}
+
 // Decode reads from the io.Reader parameter until a full message is decoded, or
 // when io.Reader returns EOF or error. The first return value is the number of
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 func (this *UnsubscribeMessage) Decode(src io.Reader) (int, error) {
-	total := 0
-
-	n, err := this.fixedHeader.Decode(src)
+	total, err := this.fixedHeader.Decode(src)
 	if err != nil {
-		return total + n, err
+		return total, err
 	}
-	total += n
+
+	this.topics = this.topics[:0]
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return total, this.decodeError(err)
+	}
+
+	if this.packetId == 0 {
+		return total, protocolError("unsubscribe/Decode", "Packet identifier MUST be non-zero")
+	}
+
+	if this.version == 0x5 {
+		if _, err = this.properties.decode(this.buf, unsubscribePropertySet); err != nil {
+			return total, this.decodeError(err)
+		}
 	}
-	total += 2
 
 	for this.buf.Len() > 0 {
-		t, n, err := readLPBytes(this.buf)
+		t, _, err := readLPBytes(this.buf)
 		if err != nil {
-			return total + n, err
+			return total, this.decodeError(err)
+		}
+
+		if this.maxTopics > 0 && len(this.topics) >= this.maxTopics {
+			return total, ErrTooManyTopics
 		}
-		total += n
 
 		this.topics = append(this.topics, t)
 	}
 
 	if len(this.topics) == 0 {
-		return 0, fmt.Errorf("unsubscribe/Decode: Empty topic list")
+		return total, protocolError("unsubscribe/Decode", "Empty topic list")
 	}
 
 	return total, nil
@@ -132,33 +195,75 @@ func (this *UnsubscribeMessage) Decode(src io.Reader) (int, error) {
 // should be considered invalid.
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *UnsubscribeMessage) Encode() (io.Reader, int, error) {
+	buf := this.encodeBuf()
+
+	n, err := this.encode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return buf, n, nil
+}
+
+// AppendTo appends the encoded message to dst and returns the extended slice, like
+// the append built-in. No memory is allocated if dst has enough capacity. If an
+// error is returned, dst is returned unchanged.
+func (this *UnsubscribeMessage) AppendTo(dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	if _, err := this.encode(buf); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode writes the encoded message to buf and returns the number of bytes written.
+func (this *UnsubscribeMessage) encode(buf *bytes.Buffer) (int, error) {
+	if this.packetId == 0 {
+		return 0, fmt.Errorf("unsubscribe/Encode: Packet identifier MUST be non-zero")
+	}
+
 	// packet ID
-	total := 2
+	remlen := int64(2)
+
+	if this.version == 0x5 {
+		remlen += int64(this.properties.size())
+	}
 
 	for _, t := range this.topics {
-		total += 2 + len(t)
+		remlen += int64(2 + len(t))
 	}
 
-	this.SetRemainingLength(int32(total))
+	if err := this.setEncodedLength(remlen); err != nil {
+		return 0, err
+	}
 
-	_, total, err := this.fixedHeader.Encode()
+	total, err := this.fixedHeader.encode(buf)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
 
-	if err = writeUint16(this.buf, this.packetId); err != nil {
-		return nil, 0, err
+	if err = writeUint16(buf, this.packetId); err != nil {
+		return 0, err
 	}
 	total += 2
 
 	var n int
 
+	if this.version == 0x5 {
+		if n, err = this.properties.encode(buf, unsubscribePropertySet); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
 	for _, t := range this.topics {
-		if n, err = writeLPBytes(this.buf, t); err != nil {
-			return nil, 0, err
+		if n, err = writeUTF8(buf, t); err != nil {
+			return 0, err
 		}
 		total += n
 	}
 
-	return this.buf, total, nil
+	return total, nil
 }
@@ -124,3 +124,101 @@ func TestUnsubscribeMessageEncode(t *testing.T) {
 
 	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
 }
+
+func TestUnsubscribeMessageProperties(t *testing.T) {
+	msgBytes := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		19,
+		0,    // packet ID MSB (0)
+		7,    // packet ID LSB (7)
+		7,    // properties length (7)
+		0x26, // user property
+		0, 1, 'k',
+		0, 1, 'v',
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	msg := NewUnsubscribeMessage()
+	msg.SetVersion(0x5)
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte("surgemq"))
+	msg.Properties().AddUserProperty([]byte("k"), []byte("v"))
+
+	dst, n, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, len(msgBytes), n, "Incorrect bytes encoded.")
+
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect encoded message.")
+
+	msg = NewUnsubscribeMessage()
+	msg.SetVersion(0x5)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, []UserProperty{{[]byte("k"), []byte("v")}}, msg.Properties().UserProperties(), "Incorrect user properties.")
+
+	assert.Equal(t, true, [][]byte{[]byte("surgemq")}, msg.Topics(), "Incorrect topics.")
+}
+
+// test packet ID 0
+func TestUnsubscribeMessagePacketId(t *testing.T) {
+	msgBytes := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		5,
+		0, // packet ID MSB (0)
+		0, // packet ID LSB (0)
+		0, // topic name MSB (0)
+		1, // topic name LSB (1)
+		'a',
+	}
+
+	_, err := NewUnsubscribeMessage().Decode(bytes.NewBuffer(msgBytes))
+	assert.Error(t, true, err)
+
+	msg := NewUnsubscribeMessage()
+	msg.SetPacketId(0)
+	msg.AddTopic([]byte("a"))
+
+	_, _, err = msg.Encode()
+	assert.Error(t, true, err)
+
+	msg.SetPacketId(7)
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+}
+
+func TestUnsubscribeMessageMaxTopics(t *testing.T) {
+	msgBytes := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		17,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', '/', 'b',
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'c', '/', 'd',
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'e', '/', 'f',
+	}
+
+	msg := NewUnsubscribeMessage()
+	msg.SetMaxTopics(2)
+
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.Equal(t, true, ErrTooManyTopics, err, "Incorrect error.")
+
+	msg.SetMaxTopics(0)
+
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	assert.Equal(t, true, 3, len(msg.Topics()), "Incorrect number of topics.")
+}